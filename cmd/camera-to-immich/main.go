@@ -1,34 +1,68 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"log"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	_ "time/tzdata" // Time zone database for the timezone option on systems without one (Windows)
 
 	"github.com/ohavrylyuk/camera-to-immich/internal/config"
 	"github.com/ohavrylyuk/camera-to-immich/internal/drive"
+	"github.com/ohavrylyuk/camera-to-immich/internal/exif"
+	"github.com/ohavrylyuk/camera-to-immich/internal/paths"
 	"github.com/ohavrylyuk/camera-to-immich/internal/processor"
 	"github.com/ohavrylyuk/camera-to-immich/internal/scanner"
 	"github.com/ohavrylyuk/camera-to-immich/internal/state"
+	"github.com/ohavrylyuk/camera-to-immich/internal/sysload"
 	"github.com/ohavrylyuk/camera-to-immich/internal/uploader"
 )
 
 var (
 	version = "1.1.0"
+
+	// logOut receives all progress output; it is stderr with --json so stdout only
+	// carries the JSON summary
+	logOut io.Writer = os.Stdout
+
+	// summary collects the outcome of the current run
+	summary = &runSummary{Skipped: make(map[string]int)}
+
+	// manifest collects the per-file results of the current run (manifest_path)
+	manifest = &runManifest{entries: make(map[string]*manifestEntry)}
+
+	// reprocessProfile selects already processed files to process again instead of new
+	// files (--reprocess-profile): a profile name, or reprocessStale
+	reprocessProfile string
+
+	// resumeChunk is the number of files to process after the card's bookmark (--resume-chunk)
+	resumeChunk int
 )
 
 func main() {
 	// Command-line flags
 	configPath := flag.String("config", "", "Path to configuration file")
+	dataDir := flag.String("data-dir", "", "Directory for config, state and default output (default: $C2I_HOME or ~/.camera-to-immich)")
 	profilePath := flag.String("profile", "", "Path to PP3 profile (overrides config)")
 	serverURL := flag.String("server", "", "Immich server URL (overrides config)")
 	apiKey := flag.String("key", "", "Immich API key (overrides config)")
+	uploadUser := flag.String("user", "", "Upload into the account of this Immich user (email with a key in user_api_keys, overrides config)")
 	outputDir := flag.String("output", "", "Output directory for processed files (overrides config)")
 	driveLabel := flag.String("drive", "", "Drive label to search for (overrides config)")
 	dryRun := flag.Bool("dry-run", false, "Show what would be done without actually doing it")
@@ -43,10 +77,34 @@ func main() {
 	verbose := flag.Bool("verbose", false, "Enable verbose output")
 	keepFiles := flag.Bool("keep-files", false, "Keep processed files in output directory (don't clean up after upload)")
 	clearState := flag.Bool("clear-state", false, "Clear the processed files state and exit")
+	pruneMissing := flag.Bool("prune-missing-outputs", false, "Remove state entries whose recorded output file no longer exists and exit (preview with --dry-run)")
+	migrateState := flag.Bool("migrate-state", false, "Migrate the state file to the current format version, keeping a backup of the old file, and exit (preview with --dry-run)")
+	verifyOutputs := flag.Bool("verify-outputs", false, "Check kept output files against the checksums recorded in state and exit (exit code 1 if any changed or are missing)")
+	showStats := flag.Bool("stats", false, "Show processing time statistics (slowest files, averages per profile) and exit")
 	stateInfo := flag.Bool("state-info", false, "Show state file information and exit")
+	chunk := flag.Int("resume-chunk", 0, "Process the next N new RAW files after the card's bookmark and move the bookmark past them, to work through a large card over several runs")
+	reprocess := flag.String("reprocess-profile", "", "Reprocess the card's files previously processed with this profile (\""+reprocessStale+"\" = with a profile other than the one they would get now)")
+	checkCard := flag.Bool("check-card", false, "Print a one-line status of the card and exit with code 10 if it has files to process (0 if not or no card is present)")
+	cleanTemp := flag.Bool("clean-temp", false, "Delete temp directories left over by earlier runs that crashed before starting")
+	benchmark := flag.Bool("benchmark", false, "Process a sample of the card's RAW files with 1, 2, 4 and 8 workers, report the throughput of each and exit")
+	listNew := flag.Bool("list-new", false, "Scan the card and list the files that would be processed (with sizes and dates), then exit")
+	newSinceWatermark := flag.Bool("new-only", false, "Only process files newer than the newest file synced from this card before (ignores the processed files list)")
+	uploadOnly := flag.Bool("upload-only", false, "Upload processed files left by earlier --skip-upload runs, without reprocessing or a card")
+	cleanupOnly := flag.Bool("cleanup-only", false, "Delete the outputs of files uploaded by earlier runs that kept them, without a card")
+	selfTest := flag.Bool("self-test", false, "Process a generated sample image with the configured toolchain and exit")
+	jsonOutput := flag.Bool("json", false, "Print a JSON summary of the run to stdout (progress output goes to stderr)")
+	configOverride := flag.String("config-override", "", "Config file merged on top of the main config (e.g. per-machine settings)")
+	statePath := flag.String("state", "", "Path to the state file (overrides config, default: state.json in the data directory)")
 
 	flag.Parse()
 
+	if *jsonOutput {
+		logOut = os.Stderr
+	}
+	if *dataDir != "" {
+		paths.SetDataDir(*dataDir)
+	}
+
 	// Show version
 	if *showVersion {
 		fmt.Printf("camera-to-immich version %s\n", version)
@@ -59,26 +117,70 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Determine config path
+	cfgPath := *configPath
+	if cfgPath == "" {
+		var err error
+		cfgPath, err = config.DefaultConfigPath()
+		if err != nil {
+			log.Fatalf("Failed to determine config path: %v", err)
+		}
+	}
+	var overrides []string
+	if *configOverride != "" {
+		overrides = append(overrides, *configOverride)
+	}
+
+	// The state commands below don't need a config, but use its state_path and backup_state
+	// if it has one
+	if cfg, err := config.LoadWithOverrides(cfgPath, overrides); err == nil {
+		if cfg.StatePath != "" {
+			state.SetStatePath(cfg.StatePath)
+		}
+		state.SetBackups(cfg.BackupState)
+	}
+	if *statePath != "" {
+		state.SetStatePath(*statePath)
+	}
+
 	// State info mode
 	if *stateInfo {
 		showStateInfo()
 		os.Exit(0)
 	}
 
+	// Processing statistics mode
+	if *showStats {
+		showProcessingStats()
+		os.Exit(0)
+	}
+
 	// Clear state mode
 	if *clearState {
 		clearStateFile()
 		os.Exit(0)
 	}
 
-	// Determine config path
-	cfgPath := *configPath
-	if cfgPath == "" {
-		var err error
-		cfgPath, err = config.DefaultConfigPath()
-		if err != nil {
-			log.Fatalf("Failed to determine config path: %v", err)
+	// Prune missing outputs mode
+	if *pruneMissing {
+		pruneMissingOutputs(*dryRun)
+		os.Exit(0)
+	}
+
+	// Migrate state mode
+	if *migrateState {
+		if !migrateStateFile(*dryRun) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Verify outputs mode
+	if *verifyOutputs {
+		if !verifyOutputFiles() {
+			os.Exit(1)
 		}
+		os.Exit(0)
 	}
 
 	// Init config mode
@@ -92,7 +194,7 @@ func main() {
 	}
 
 	// Load configuration
-	cfg, err := config.Load(cfgPath)
+	cfg, err := config.LoadWithOverrides(cfgPath, overrides)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -107,6 +209,9 @@ func main() {
 	if *apiKey != "" {
 		cfg.ImmichAPIKey = *apiKey
 	}
+	if *uploadUser != "" {
+		cfg.UploadAsUser = *uploadUser
+	}
 	if *outputDir != "" {
 		cfg.OutputDirectory = *outputDir
 	}
@@ -118,6 +223,7 @@ func main() {
 	}
 	if *jpgOnly {
 		cfg.ProcessRAWFiles = false
+		cfg.ProcessRAWOverrides = nil
 	}
 	if *skipUpload {
 		cfg.SkipUpload = true
@@ -127,6 +233,7 @@ func main() {
 	}
 	if *noCameraJPGs {
 		cfg.UploadCameraJPGs = false
+		cfg.CameraJPGs = config.CameraJPGsNone
 	}
 	if *keepFiles {
 		cfg.CleanupAfterUpload = false
@@ -134,18 +241,201 @@ func main() {
 	if *workers > 0 {
 		cfg.Workers = *workers
 	}
+	if *reprocess != "" {
+		if !cfg.ProcessesAnyRAW() {
+			log.Fatalf("--reprocess-profile requires RAW processing")
+		}
+		reprocessProfile = *reprocess
+	}
+	if *newSinceWatermark {
+		cfg.NewSinceWatermark = true
+	}
+	if *chunk > 0 {
+		if !cfg.ProcessesAnyRAW() {
+			log.Fatalf("--resume-chunk requires RAW processing")
+		}
+		if *limit > 0 || *reprocess != "" {
+			log.Fatalf("--resume-chunk can't be combined with --limit or --reprocess-profile")
+		}
+		resumeChunk = *chunk
+	}
+
+	// Self-test mode (doesn't need a card or Immich settings)
+	if *selfTest {
+		if err := runSelfTest(cfg); err != nil {
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		os.Exit(0)
+	}
 
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
 		log.Fatalf("Invalid configuration: %v", err)
 	}
 
+	// Immich has no way for an admin key to upload into another account, so uploads for
+	// another user go through that user's own key
+	if cfg.UploadAsUser != "" {
+		cfg.ImmichAPIKey = cfg.UserAPIKey(cfg.UploadAsUser)
+	}
+
+	// Check card mode
+	if *checkCard {
+		pending, err := checkCardStatus(cfg, *verbose)
+		if err != nil {
+			log.Fatalf("Checking the card failed: %v", err)
+		}
+		if pending > 0 {
+			os.Exit(checkCardPendingExitCode)
+		}
+		os.Exit(0)
+	}
+
+	// Benchmark mode
+	if *benchmark {
+		if err := runBenchmark(cfg, *verbose); err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// List new files mode
+	if *listNew {
+		if err := listNewFiles(cfg, *verbose); err != nil {
+			log.Fatalf("Listing new files failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Cleanup-only mode (last phase, after uploads that kept their outputs)
+	if *cleanupOnly {
+		if err := runCleanupOnly(cfg); err != nil {
+			log.Fatalf("Cleanup failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Crashed runs leave their staging and intermediate directories behind
+	checkStaleTempDirs(*cleanTemp)
+
+	// Upload-only mode (second phase after a --skip-upload run)
+	if *uploadOnly {
+		if cfg.SkipUpload {
+			log.Fatalf("--upload-only can't be combined with skip_upload")
+		}
+		summary.Mode = "upload-only"
+		start := time.Now()
+		manifest.path = manifestPath(cfg, start)
+		err := runUploadOnly(cfg, *verbose)
+		writeManifestFile()
+		if cfg.MetricsFile != "" {
+			if metricsErr := writeMetricsFile(cfg.MetricsFile, err, time.Since(start)); metricsErr != nil {
+				logError("Failed to write metrics: %v", metricsErr)
+			}
+		}
+		if *jsonOutput {
+			printJSONSummary(err)
+		}
+		if err != nil {
+			log.Fatalf("Upload failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// Run the processor
-	if err := run(cfg, *verbose); err != nil {
+	start := time.Now()
+	manifest.path = manifestPath(cfg, start)
+	err = run(cfg, *verbose)
+	writeManifestFile()
+	if cfg.MetricsFile != "" {
+		if metricsErr := writeMetricsFile(cfg.MetricsFile, err, time.Since(start)); metricsErr != nil {
+			logError("Failed to write metrics: %v", metricsErr)
+		}
+	}
+	if *jsonOutput {
+		printJSONSummary(err)
+	}
+	if err != nil {
 		log.Fatalf("Processing failed: %v", err)
 	}
 }
 
+// tempDirPrefixes are the prefixes of the temp directories created during runs
+var tempDirPrefixes = []string{"camera-to-immich-", "processed-jpgs-", "camera-jpgs-", "contact-sheet-", "immich-upload-"}
+
+// staleTempAge is the age after which one of our temp directories is taken as left over by
+// a crashed run rather than in use by a run still going on
+const staleTempAge = 24 * time.Hour
+
+// findStaleTempDirs returns the temp directories left over by earlier runs and their total size
+func findStaleTempDirs() ([]string, int64) {
+	tempDir := os.TempDir()
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		return nil, 0
+	}
+
+	var dirs []string
+	var size int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			continue
+		}
+		ours := false
+		for _, prefix := range tempDirPrefixes {
+			// os.MkdirTemp replaces the "*" of the pattern with digits
+			suffix := name[strings.LastIndex(name, "-")+1:]
+			if strings.HasPrefix(name, prefix) && suffix != "" && strings.Trim(suffix, "0123456789") == "" {
+				ours = true
+				break
+			}
+		}
+		if !ours {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempAge {
+			continue
+		}
+
+		path := filepath.Join(tempDir, name)
+		dirs = append(dirs, path)
+		filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return dirs, size
+}
+
+// checkStaleTempDirs reports temp directories left over by crashed runs, and deletes them
+// with --clean-temp
+func checkStaleTempDirs(clean bool) {
+	dirs, size := findStaleTempDirs()
+	if len(dirs) == 0 {
+		return
+	}
+	if !clean {
+		logInfo("Found %d temp directories left over by earlier runs in %s (%.1f MB), run with --clean-temp to delete them", len(dirs), os.TempDir(), megabytes(size))
+		return
+	}
+
+	removed := 0
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logError("Failed to delete %s: %v", dir, err)
+			continue
+		}
+		removed++
+	}
+	logSuccess("Deleted %d temp directories left over by earlier runs (%.1f MB)", removed, megabytes(size))
+}
+
 func listAllDrives() {
 	drives, err := drive.ListAllDrives()
 	if err != nil {
@@ -159,6 +449,12 @@ func listAllDrives() {
 		if label == "" {
 			label = "(no label)"
 		}
+		if d.ReadOnly {
+			label += " (read-only)"
+		}
+		if d.Serial != "" {
+			label += "  serial " + d.Serial
+		}
 		if d.Letter != "" {
 			fmt.Printf("  %s  %s  [%s]\n", d.Letter, label, d.Path)
 		} else {
@@ -195,6 +491,81 @@ func showStateInfo() {
 	if stats.CardID != "" {
 		fmt.Printf("Card ID: %s\n", stats.CardID)
 	}
+	if stats.PendingUploads > 0 {
+		fmt.Printf("Processed files waiting for upload: %d (run with --upload-only)\n", stats.PendingUploads)
+	}
+	if phases := appState.PhaseCounts(); phases[state.PhaseUploaded] > 0 {
+		fmt.Printf("Uploaded files whose output is still on disk: %d (run with --cleanup-only)\n", phases[state.PhaseUploaded])
+	}
+	if stats.FailedCount > 0 {
+		fmt.Printf("Failed files: %d\n", stats.FailedCount)
+		for _, f := range appState.GetFailedFiles() {
+			fmt.Printf("  - %s (%s failed %d time(s), last %s)\n", f.Filename, f.Stage, f.Attempts, f.FailedAt.Format("2006-01-02 15:04:05"))
+		}
+	}
+}
+
+// slowestFilesShown is the number of slowest files listed by --stats
+const slowestFilesShown = 10
+
+// showProcessingStats prints the average processing time per profile and the slowest files
+func showProcessingStats() {
+	statePath, err := state.DefaultStatePath()
+	if err != nil {
+		fmt.Printf("Error getting state path: %v\n", err)
+		return
+	}
+
+	appState, err := state.Load(statePath)
+	if err != nil {
+		fmt.Printf("Error loading state: %v\n", err)
+		return
+	}
+
+	if len(appState.ProfileTimings) == 0 {
+		fmt.Println("No processing times recorded yet.")
+		return
+	}
+
+	fmt.Println("Processing Statistics")
+	fmt.Println("=====================")
+	if avg := appState.GetAverageProcessingTime(); avg > 0 {
+		fmt.Printf("Recent average: %.1fs per file\n", avg.Seconds())
+	}
+
+	profiles := make([]string, 0, len(appState.ProfileTimings))
+	for profile := range appState.ProfileTimings {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+
+	fmt.Println("\nPer profile (all cards):")
+	for _, profile := range profiles {
+		timing := appState.ProfileTimings[profile]
+		fmt.Printf("  %-20s %5d files, avg %.1fs, slowest %.1fs (%s)\n",
+			profile, timing.Files, timing.TotalSeconds/float64(timing.Files), timing.MaxSeconds, timing.MaxFile)
+	}
+
+	var timed []state.ProcessedFile
+	for _, pf := range appState.ProcessedFiles {
+		if pf.ProcessingSeconds > 0 {
+			timed = append(timed, pf)
+		}
+	}
+	if len(timed) == 0 {
+		return
+	}
+	sort.Slice(timed, func(i, j int) bool {
+		return timed[i].ProcessingSeconds > timed[j].ProcessingSeconds
+	})
+	if len(timed) > slowestFilesShown {
+		timed = timed[:slowestFilesShown]
+	}
+
+	fmt.Println("\nSlowest files (current card):")
+	for _, pf := range timed {
+		fmt.Printf("  %-20s %6.1fs  %s\n", pf.Filename, pf.ProcessingSeconds, pf.ProfileUsed)
+	}
 }
 
 func clearStateFile() {
@@ -219,542 +590,3824 @@ func clearStateFile() {
 	fmt.Printf("Cleared %d processed file entries from state.\n", count)
 }
 
-func run(cfg *config.Config, verbose bool) error {
-	totalStart := time.Now()
-	
-	// Step 1: Find the camera drive
-	logStep("Searching for drive '%s'...", cfg.DriveLabel)
-	driveStart := time.Now()
-	
-	driveInfo, err := drive.FindDriveByLabel(cfg.DriveLabel)
-	if err != nil {
-		return fmt.Errorf("camera drive not found: %v", err)
-	}
-	
-	logSuccess("Found drive at: %s", driveInfo.Path)
-	logTiming("Drive detection", driveStart)
-
-	// Step 2: Load state
+// pruneMissingOutputs drops state entries whose recorded output was deleted from disk
+func pruneMissingOutputs(dryRun bool) {
 	statePath, err := state.DefaultStatePath()
 	if err != nil {
-		return fmt.Errorf("failed to determine state path: %v", err)
+		fmt.Printf("Error getting state path: %v\n", err)
+		return
 	}
 
 	appState, err := state.Load(statePath)
 	if err != nil {
-		return fmt.Errorf("failed to load state: %v", err)
+		fmt.Printf("Error loading state: %v\n", err)
+		return
 	}
 
-	if verbose {
-		logInfo("Previously processed %d files", appState.GetProcessedCount())
+	missing := appState.PruneMissingOutputs(dryRun)
+	if len(missing) == 0 {
+		fmt.Println("All recorded output files exist.")
+		return
 	}
 
-	// Step 3: Scan for images
-	rawExtensions := cfg.GetRawExtensionsMap()
-	logStep("Scanning for RAW files (%v) and JPG files...", cfg.RawExtensions)
-	scanStart := time.Now()
-	
-	scanResult, err := scanner.ScanForImages(driveInfo.Path, rawExtensions)
-	if err != nil {
-		return fmt.Errorf("failed to scan drive: %v", err)
+	for _, pf := range missing {
+		action := "remove entry (will be processed again)"
+		if pf.Uploaded {
+			action = "forget output path (already uploaded)"
+		}
+		fmt.Printf("  - %s: %s missing, %s\n", pf.Filename, pf.OutputPath, action)
 	}
 
-	logInfo("Found %d RAW files and %d JPG files", len(scanResult.RAWFiles), len(scanResult.JPGFiles))
-	logTiming("File scanning", scanStart)
+	if dryRun {
+		fmt.Printf("Dry run: %d entries with missing outputs would be pruned.\n", len(missing))
+		return
+	}
 
-	// Sync state with current card contents (remove entries for files no longer on card)
-	filesOnCard := make(map[string]bool)
-	for _, f := range scanResult.RAWFiles {
-		filesOnCard[f.Name] = true
+	if err := appState.Save(); err != nil {
+		fmt.Printf("Error saving state: %v\n", err)
+		return
 	}
-	for _, f := range scanResult.JPGFiles {
-		filesOnCard[f.Name] = true
+
+	fmt.Printf("Pruned %d entries with missing outputs from state.\n", len(missing))
+}
+
+// migrateStateFile migrates the state file to the current format version, keeping the old
+// file as <state>.v<version>.bak; returns false if it failed
+func migrateStateFile(dryRun bool) bool {
+	statePath, err := state.DefaultStatePath()
+	if err != nil {
+		fmt.Printf("Error getting state path: %v\n", err)
+		return false
 	}
-	removed := appState.SyncWithCard(filesOnCard)
-	if removed > 0 && verbose {
-		logInfo("Cleaned up %d stale entries from state (files no longer on card)", removed)
+	if _, err := os.Stat(statePath); os.IsNotExist(err) {
+		fmt.Printf("No state file at %s, nothing to migrate.\n", statePath)
+		return true
 	}
 
-	// Step 4: Initialize Immich uploader (skip if upload is disabled)
-	var im *uploader.Immich
-	if !cfg.SkipUpload {
-		logStep("Initializing Immich uploader...")
-		
-		immichConfig := uploader.ImmichConfig{
-			ExecutablePath: cfg.ImmichExecutable,
-			ServerURL:      cfg.ImmichServerURL,
-			APIKey:         cfg.ImmichAPIKey,
-			Album:          cfg.ImmichAlbum,
-			Tags:           cfg.ImmichTags,
-			ShowProgress:   verbose, // Show upload progress in verbose mode
-		}
+	appState, err := state.Load(statePath)
+	if err != nil {
+		fmt.Printf("Error loading state: %v\n", err)
+		return false
+	}
 
-		var err error
-		im, err = uploader.NewImmich(immichConfig)
-		if err != nil {
-			return fmt.Errorf("failed to initialize Immich uploader: %v", err)
-		}
+	from := appState.LoadedVersion()
+	if from > state.CurrentVersion {
+		fmt.Printf("State file is version %d, written by a newer version of camera-to-immich (this one supports up to %d).\n", from, state.CurrentVersion)
+		return false
+	}
+	if from == state.CurrentVersion {
+		fmt.Printf("State file is already at version %d, nothing to migrate.\n", from)
+		return true
+	}
 
-		logSuccess("Connected to Immich server")
-	} else {
-		logInfo("Skipping Immich initialization (--skip-upload flag)")
+	fmt.Printf("Migrating %s from version %d to %d:\n", statePath, from, state.CurrentVersion)
+	for _, change := range appState.Migrations() {
+		fmt.Printf("  - %s\n", change)
 	}
 
-	// Handle RAW processing mode vs JPG-only mode
-	var runErr error
-	if cfg.ProcessRAWFiles {
-		runErr = runWithRAWProcessing(cfg, appState, scanResult, im, verbose)
-	} else {
-		runErr = runJPGOnlyMode(cfg, appState, scanResult, im, verbose)
+	if dryRun {
+		fmt.Println("Dry run: state file not changed.")
+		return true
 	}
-	
-	// Log total execution time
-	logTiming("TOTAL TIME", totalStart)
-	
-	return runErr
-}
 
-// runWithRAWProcessing handles the workflow when RAW processing is enabled
-func runWithRAWProcessing(cfg *config.Config, appState *state.State, scanResult *scanner.ScanResult, im *uploader.Immich, verbose bool) error {
-	// Filter unprocessed RAW files
-	processedMap := appState.GetProcessedFilesMap()
-	newRAWFiles := scanner.FilterNewFiles(scanResult.RAWFiles, processedMap)
+	backupPath := fmt.Sprintf("%s.v%d.bak", statePath, from)
+	if err := copyFileSimple(statePath, backupPath); err != nil {
+		fmt.Printf("Error backing up state: %v\n", err)
+		return false
+	}
+	if err := appState.Save(); err != nil {
+		fmt.Printf("Error saving state: %v\n", err)
+		return false
+	}
 
-	if len(newRAWFiles) == 0 {
-		logSuccess("No new RAW files to process!")
-		return nil
+	fmt.Printf("State migrated, the old file was kept as %s\n", backupPath)
+	return true
+}
+
+// verifyOutputFiles re-checksums kept output files and reports those that changed or are
+// missing; returns false if any did
+func verifyOutputFiles() bool {
+	statePath, err := state.DefaultStatePath()
+	if err != nil {
+		fmt.Printf("Error getting state path: %v\n", err)
+		return false
 	}
 
-	// Apply limit if specified
-	if cfg.Limit > 0 && len(newRAWFiles) > cfg.Limit {
-		logInfo("Limiting to %d files (out of %d new files)", cfg.Limit, len(newRAWFiles))
-		newRAWFiles = newRAWFiles[:cfg.Limit]
+	appState, err := state.Load(statePath)
+	if err != nil {
+		fmt.Printf("Error loading state: %v\n", err)
+		return false
 	}
 
-	logInfo("%d new RAW files to process", len(newRAWFiles))
+	checks := appState.VerifyOutputs()
+	if len(checks) == 0 {
+		fmt.Println("No kept output files recorded in state.")
+		return true
+	}
 
-	if cfg.DryRun {
-		logInfo("DRY RUN - Would process the following files:")
-		for _, f := range newRAWFiles {
-			fmt.Printf("  - %s\n", f.Name)
+	counts := make(map[string]int)
+	for _, check := range checks {
+		counts[check.Status]++
+		switch {
+		case check.Err != nil:
+			fmt.Printf("  - %s: %s can't be read: %v\n", check.File.Filename, check.File.OutputPath, check.Err)
+		case check.Status != state.OutputOK:
+			fmt.Printf("  - %s: %s %s\n", check.File.Filename, check.File.OutputPath, check.Status)
 		}
-		return nil
 	}
 
-	// Initialize DNG converter if enabled (for cameras not natively supported by RawTherapee)
-	var dngConverter *processor.DNGConverter
-	var dngOutputDir string
-	var dngFilesToCleanup []string
-	
-	if cfg.ConvertToDNG {
-		logStep("Initializing Adobe DNG Converter...")
-		
-		// Use temp directory for DNG files if not specified
-		dngOutputDir = cfg.DNGOutputDirectory
-		if dngOutputDir == "" {
-			var err error
-			dngOutputDir, err = os.MkdirTemp("", "camera-to-immich-dng-*")
-			if err != nil {
-				return fmt.Errorf("failed to create temp directory for DNG files: %v", err)
-			}
-			// Clean up temp directory on exit
-			defer os.RemoveAll(dngOutputDir)
-		} else {
-			// Ensure directory exists
-			if err := os.MkdirAll(dngOutputDir, 0755); err != nil {
-				return fmt.Errorf("failed to create DNG output directory: %v", err)
-			}
+	fmt.Printf("Verified %d output files: %d ok, %d changed, %d missing, %d without checksum\n",
+		len(checks), counts[state.OutputOK], counts[state.OutputChanged], counts[state.OutputMissing], counts[state.OutputUnverified])
+
+	return counts[state.OutputChanged] == 0 && counts[state.OutputMissing] == 0
+}
+
+// benchmarkWorkers are the worker counts compared by --benchmark
+var benchmarkWorkers = []int{1, 2, 4, 8}
+
+// benchmarkFiles is the number of RAW files from the card processed per worker count
+const benchmarkFiles = 8
+
+// runBenchmark processes the same RAW files from the card with each of benchmarkWorkers
+// workers, reports the throughput of each and recommends a workers setting
+// Only the RawTherapee step is measured; outputs go to a temp directory and nothing is
+// uploaded or recorded in the state.
+func runBenchmark(cfg *config.Config, verbose bool) error {
+	cfg.DryRun = true
+
+	_, scanResult, err := scanCard(cfg, verbose)
+	if err != nil {
+		return err
+	}
+	files := scanResult.RAWFiles
+	if len(files) == 0 {
+		return fmt.Errorf("no RAW files on the card to benchmark with")
+	}
+	if len(files) > benchmarkFiles {
+		files = files[:benchmarkFiles]
+	}
+
+	tempDir, err := os.MkdirTemp("", "camera-to-immich-benchmark-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rt, err := processor.NewRawTherapee(processor.RawTherapeeConfig{
+		ExecutablePath: cfg.RawTherapeeExecutable,
+		ProfilePath:    cfg.PP3ProfilePath,
+		OutputDir:      tempDir,
+		Quality:        cfg.JPEGQuality,
+		DPI:            cfg.JPEGDPI,
+		Overwrite:      true,
+		Overrides:      cfg.RTOverrides,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize RawTherapee: %v", err)
+	}
+	defer rt.Close()
+
+	logStep("Benchmarking RawTherapee with %d RAW files (profile %s, %d CPU cores)...", len(files), rt.GetProfileName(), runtime.NumCPU())
+	if cfg.ConvertToDNG || len(cfg.RawDecoderCommand) > 0 {
+		logInfo("The DNG conversion/RAW decoding step is not part of the benchmark")
+	}
+
+	elapsed := make([]time.Duration, len(benchmarkWorkers))
+	for n, workers := range benchmarkWorkers {
+		paths := make(chan string, len(files))
+		for _, f := range files {
+			paths <- f.Path
 		}
-		
-		dngConfig := processor.DNGConverterConfig{
-			ExecutablePath: cfg.DNGConverterPath,
-			OutputDir:      dngOutputDir,
-			Compressed:     cfg.DNGCompressed,
-			EmbedOriginal:  cfg.DNGEmbedOriginal,
+		close(paths)
+
+		var mu sync.Mutex
+		var firstErr error
+		var wg sync.WaitGroup
+		start := time.Now()
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for path := range paths {
+					if _, _, err := rt.ProcessFile(path); err != nil {
+						mu.Lock()
+						if firstErr == nil {
+							firstErr = fmt.Errorf("%s: %v", filepath.Base(path), err)
+						}
+						mu.Unlock()
+					}
+				}
+			}()
 		}
-		
-		var err error
-		dngConverter, err = processor.NewDNGConverter(dngConfig)
-		if err != nil {
-			return fmt.Errorf("failed to initialize DNG Converter: %v", err)
+		wg.Wait()
+		elapsed[n] = time.Since(start)
+		if firstErr != nil {
+			return fmt.Errorf("processing with %d workers failed: %v", workers, firstErr)
 		}
-		
-		logSuccess("DNG Converter initialized (output: %s)", dngOutputDir)
+
+		logInfo("%d workers: %s (%.1f files/min)", workers, elapsed[n].Round(100*time.Millisecond), float64(len(files))/elapsed[n].Minutes())
 	}
 
-	// Initialize RawTherapee processor
+	// The fewest workers within 5% of the fastest run, as every worker costs memory
+	fastest := elapsed[0]
+	for _, e := range elapsed {
+		if e < fastest {
+			fastest = e
+		}
+	}
+	for n, e := range elapsed {
+		if float64(e) <= float64(fastest)*1.05 {
+			logSuccess("Recommended: \"workers\": %d", benchmarkWorkers[n])
+			break
+		}
+	}
+
+	return nil
+}
+
+// runSelfTest processes a generated sample image with RawTherapee to verify the toolchain
+func runSelfTest(cfg *config.Config) error {
+	totalStart := time.Now()
+
+	tempDir, err := os.MkdirTemp("", "camera-to-immich-selftest-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// RawTherapee accepts regular images as input, so a synthetic PNG exercises
+	// the same executable, profile and output path as a real RAW would
+	logStep("Generating sample image...")
+	samplePath := filepath.Join(tempDir, "self-test.png")
+	if err := writeSampleImage(samplePath); err != nil {
+		return fmt.Errorf("failed to generate sample image: %v", err)
+	}
+	logSuccess("Sample image: %s", samplePath)
+
 	logStep("Initializing RawTherapee processor...")
-	
 	rtConfig := processor.RawTherapeeConfig{
 		ExecutablePath: cfg.RawTherapeeExecutable,
 		ProfilePath:    cfg.PP3ProfilePath,
-		OutputDir:      cfg.OutputDirectory,
+		OutputDir:      filepath.Join(tempDir, "output"),
 		Quality:        cfg.JPEGQuality,
+		DPI:            cfg.JPEGDPI,
+		VerifyOutput:   true,
+		Overwrite:      true,
+		Overrides:      cfg.RTOverrides,
+	}
+
+	rt, err := processor.NewRawTherapee(rtConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize RawTherapee: %v", err)
+	}
+	defer rt.Close()
+	logSuccess("Using profile: %s", rt.GetProfileName())
+
+	logStep("Processing sample image...")
+	processStart := time.Now()
+	outputPath, warnings, err := rt.ProcessFile(samplePath)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		logError("rawtherapee-cli: %s", warning)
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read output: %v", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("output file is empty: %s", outputPath)
+	}
+	logSuccess("Created: %s (%d bytes)", filepath.Base(outputPath), info.Size())
+	logTiming("RawTherapee processing", processStart)
+
+	// Check that the uploader can be found, without uploading anything
+	if !cfg.SkipUpload {
+		logStep("Checking immich-go...")
+		if _, err := uploader.NewImmich(uploader.ImmichConfig{
+			ExecutablePath: cfg.ImmichExecutable,
+			ServerURL:      cfg.ImmichServerURL,
+			APIKey:         cfg.ImmichAPIKey,
+		}); err != nil {
+			logError("Uploader not ready: %v", err)
+		} else {
+			logSuccess("immich-go found")
+		}
+	}
+
+	logTiming("TOTAL TIME", totalStart)
+	logSuccess("Self-test passed")
+
+	return nil
+}
+
+// writeSampleImage writes a small synthetic gradient image used by the self-test
+func writeSampleImage(path string) error {
+	const width, height = 300, 200
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: 128,
+				A: 255,
+			})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return png.Encode(f, img)
+}
+
+func run(cfg *config.Config, verbose bool) error {
+	totalStart := time.Now()
+	
+	appState, scanResult, err := scanCard(cfg, verbose)
+	if err != nil {
+		return err
+	}
+
+	// Step 4: Initialize Immich uploader (skip if upload is disabled)
+	var im *uploader.Immich
+	if !cfg.SkipUpload {
+		im, err = newUploader(cfg, verbose)
+		if err != nil {
+			return err
+		}
+	} else {
+		logInfo("Skipping Immich initialization (--skip-upload flag)")
+	}
+
+	// Skip files the server already has (e.g. after the local state was lost)
+	if cfg.SkipExistingOnServer && !cfg.SkipUpload {
+		candidates, _ := filesToProcess(cfg, scanResult)
+		markExistingOnServer(uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey), appState, candidates, scanResult.JPGFiles, verbose)
+	}
+
+	// Handle RAW processing mode vs JPG-only mode; with process_raw_overrides a card can
+	// need both, for different extensions or folders
+	rawPart, jpgPart := splitByProcessing(cfg, scanResult)
+	switch {
+	case rawPart != nil && jpgPart != nil:
+		summary.Mode = "mixed"
+	case rawPart != nil:
+		summary.Mode = "raw"
+	default:
+		summary.Mode = "jpg-only"
+	}
+
+	var runErr error
+	if rawPart != nil {
+		runErr = runWithRAWProcessing(cfg, appState, rawPart, im, verbose)
+	}
+	if jpgPart != nil && runErr == nil {
+		if rawPart != nil {
+			logStep("Uploading the JPGs of folders and extensions without RAW processing...")
+		}
+		runErr = runJPGOnlyMode(cfg, appState, jpgPart, im, verbose)
+	}
+
+	if runErr == nil && summary.Uploaded > 0 && cfg.ShareWithPartner != "" {
+		shareWithPartner(cfg)
+	}
+	reportAlbums(cfg)
+
+	if skipped := summary.skippedText(); skipped != "" {
+		logInfo("Skipped: %s", skipped)
+	}
+	if len(summary.Warnings) > 0 {
+		names := make([]string, 0, len(summary.Warnings))
+		for name := range summary.Warnings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logError("%d files were processed with rawtherapee-cli warnings and may need a look: %s", len(names), strings.Join(names, ", "))
+	}
+	summary.State.finish(appState)
+	logInfo("State: %s", summary.State)
+
+	// Log total execution time
+	logTiming("TOTAL TIME", totalStart)
+	
+	return runErr
+}
+
+// listNewFiles scans the card and prints the files a run would pick up, without
+// initializing any processor or uploader
+func listNewFiles(cfg *config.Config, verbose bool) error {
+	// Nothing is written, not even a card marker
+	cfg.DryRun = true
+
+	appState, scanResult, err := scanCard(cfg, verbose)
+	if err != nil {
+		return err
+	}
+
+	files, kind := filesToProcess(cfg, scanResult)
+	newFiles := selectNewFiles(cfg, appState, files)
+	sortFiles(cfg, newFiles)
+
+	if len(newFiles) == 0 {
+		fmt.Printf("No new %s files.\n", kind)
+		return nil
+	}
+
+	var total int64
+	for _, f := range newFiles {
+		total += f.Size
+		fmt.Printf("  %-40s %8.1f MB  %s\n", path.Join(f.RelDir, f.Name), megabytes(f.Size), time.Unix(f.ModTime, 0).Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("%d new %s files, %.1f MB\n", len(newFiles), kind, megabytes(total))
+	if cfg.Limit > 0 && len(newFiles) > cfg.Limit {
+		fmt.Printf("Only the first %d would be processed (limit)\n", cfg.Limit)
+	}
+	if skipped := summary.skippedText(); skipped != "" {
+		fmt.Printf("Skipped: %s\n", skipped)
+	}
+	return nil
+}
+
+// checkCardPendingExitCode is the exit code of --check-card when the card has files to process
+const checkCardPendingExitCode = 10
+
+// checkCardStatus scans the configured card without processing anything and prints a
+// one-line status, returning the number of files a run would process (0 without a card)
+// Progress output is only shown with verbose.
+func checkCardStatus(cfg *config.Config, verbose bool) (int, error) {
+	// Nothing is written, not even a card marker
+	cfg.DryRun = true
+	if !verbose {
+		logOut = io.Discard
+	}
+
+	if _, err := drive.FindDriveByLabel(cfg.DriveLabel); err != nil {
+		fmt.Printf("No card: drive '%s' not found\n", cfg.DriveLabel)
+		return 0, nil
+	}
+
+	appState, scanResult, err := scanCard(cfg, verbose)
+	if err != nil {
+		return 0, err
+	}
+
+	files, kind := filesToProcess(cfg, scanResult)
+	newFiles := selectNewFiles(cfg, appState, files)
+
+	var total int64
+	for _, f := range newFiles {
+		total += f.Size
+	}
+	fmt.Printf("Card '%s' at %s: %d new %s files (%.1f MB) to process\n", cfg.DriveLabel, scanResult.BasePath, len(newFiles), kind, megabytes(total))
+	return len(newFiles), nil
+}
+
+// scanCard finds the camera drive, loads the state and scans the card, returning the
+// files left after syncing the state and applying the free space check and patterns
+func scanCard(cfg *config.Config, verbose bool) (*state.State, *scanner.ScanResult, error) {
+	// Step 1: Find the camera drive
+	logStep("Searching for drive '%s'...", cfg.DriveLabel)
+	driveStart := time.Now()
+	
+	driveInfo, err := drive.FindDriveByLabel(cfg.DriveLabel)
+	if err != nil {
+		return nil, nil, fmt.Errorf("camera drive not found: %v", err)
+	}
+	if cfg.IsIgnoredDrive(driveInfo.Serial) {
+		return nil, nil, fmt.Errorf("the card at %s (serial %s) is listed in ignore_drive_serials, refusing to touch it", driveInfo.Path, driveInfo.Serial)
+	}
+	
+	logSuccess("Found drive at: %s", driveInfo.Path)
+	if driveInfo.ReadOnly {
+		logInfo("The card is mounted read-only (lock switch on?); files can be read but nothing on the card can be changed")
+	}
+	logTiming("Drive detection", driveStart)
+
+	// Step 2: Load state
+	statePath, err := state.DefaultStatePath()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to determine state path: %v", err)
+	}
+
+	appState, err := state.Load(statePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load state: %v", err)
+	}
+	appState.SetCompression(cfg.CompressState)
+	summary.State = newStateDelta(appState)
+
+	if verbose {
+		logInfo("Previously processed %d files", appState.GetProcessedCount())
+	}
+
+	// Step 3: Scan for images
+	rawExtensions := cfg.GetRawExtensionsMap()
+	logStep("Scanning for RAW files (%v) and JPG files...", cfg.RawExtensionsList())
+	scanStart := time.Now()
+	
+	cardID := cardIdentifier(cfg, driveInfo)
+	appState.SetCardID(cardID)
+
+	var scanCache *scanner.ScanCache
+	cacheKey := scanner.CacheKey(cardID, rawExtensions, cfg.AutoDetectRAW, cfg.FollowSymlinks)
+	if cfg.ScanCache {
+		if cachePath, err := scanner.DefaultScanCachePath(); err == nil {
+			scanCache = scanner.LoadScanCache(cachePath)
+		}
+	}
+
+	var scanResult *scanner.ScanResult
+	if scanCache != nil {
+		if cached, ok := scanCache.Get(cacheKey); ok {
+			scanResult = cached
+			logInfo("Card unchanged since last scan, using cached scan result")
+		}
+	}
+
+	if scanResult == nil {
+		scanResult, err = scanner.ScanForImages(driveInfo.Path, rawExtensions, cfg.AutoDetectRAW, cfg.FollowSymlinks)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan drive: %v", err)
+		}
+
+		if scanCache != nil {
+			scanCache.Put(cacheKey, scanResult)
+			if err := scanCache.Save(); err != nil && verbose {
+				logError("Failed to save scan cache: %v", err)
+			}
+		}
+	}
+
+	// Other scan roots are merged into one import with the card (and never cached, as the
+	// cache is keyed by card)
+	if len(cfg.ScanRoots) > 0 {
+		if scanResult, err = scanExtraRoots(cfg, scanResult, rawExtensions); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	logInfo("Found %d RAW files and %d JPG files", len(scanResult.RAWFiles), len(scanResult.JPGFiles))
+	if len(scanResult.DetectedRAWExtensions) > 0 {
+		logInfo("Detected RAW files with extensions not in raw_extensions: %s (add them to your config)", strings.Join(scanResult.DetectedRAWExtensions, ", "))
+	}
+	logTiming("File scanning", scanStart)
+
+	// Sync state with current card contents (remove entries for files no longer on card)
+	// Entries from before files were keyed by folder are still keyed by the bare name
+	filesOnCard := make(map[string]bool)
+	for _, files := range [][]scanner.FileInfo{scanResult.RAWFiles, scanResult.JPGFiles} {
+		for _, f := range files {
+			filesOnCard[f.StateKey()] = true
+			filesOnCard[f.Name] = true
+		}
+	}
+	removed := appState.SyncWithCard(filesOnCard)
+	summary.State.Removed = removed
+	if removed > 0 && verbose {
+		logInfo("Cleaned up %d stale entries from state (files no longer on card)", removed)
+	}
+
+	// The newest shots may be incomplete: still being written mid-shoot (skip_newest), or cut
+	// off because the card filled up (skip_newest_when_full)
+	skipNewest := cfg.SkipNewest
+	if cfg.CardMinFreeMB > 0 && cardNearlyFull(cfg, driveInfo) && cfg.SkipNewestWhenFull {
+		skipNewest = max(skipNewest, 1)
+	}
+	if skipNewest > 0 {
+		scanResult = skipNewestShots(cfg, driveInfo, scanResult, skipNewest)
+	}
+
+	// Apply include/exclude patterns (after syncing, so filtered-out files keep their state)
+	patterns, err := scanner.NewPatternFilter(cfg.IncludePatterns, cfg.ExcludePatterns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !patterns.IsEmpty() {
+		filtered := *scanResult
+		filtered.RAWFiles = patterns.Filter(scanResult.RAWFiles)
+		filtered.JPGFiles = patterns.Filter(scanResult.JPGFiles)
+		logInfo("%d RAW files and %d JPG files match the include/exclude patterns", len(filtered.RAWFiles), len(filtered.JPGFiles))
+		summary.skip(skipExcluded, droppedFiles(cfg, scanResult, &filtered))
+		scanResult = &filtered
+	}
+
+	return appState, scanResult, nil
+}
+
+// scanExtraRoots scans the scan_roots directories and drives and merges their files into a
+// copy of the card's scan result. A root that can't be scanned is an error, as its files
+// would otherwise be dropped from the state as if they were deleted.
+func scanExtraRoots(cfg *config.Config, cardResult *scanner.ScanResult, rawExtensions map[string]bool) (*scanner.ScanResult, error) {
+	merged := *cardResult
+	merged.RAWFiles = append([]scanner.FileInfo{}, cardResult.RAWFiles...)
+	merged.JPGFiles = append([]scanner.FileInfo{}, cardResult.JPGFiles...)
+
+	for _, root := range cfg.ScanRoots {
+		rootPath := root
+		if label, ok := strings.CutPrefix(root, "label:"); ok {
+			driveInfo, err := drive.FindDriveByLabel(label)
+			if err != nil {
+				return nil, fmt.Errorf("scan root %s not found: %v", root, err)
+			}
+			if cfg.IsIgnoredDrive(driveInfo.Serial) {
+				return nil, fmt.Errorf("the drive at %s (serial %s) is listed in ignore_drive_serials, refusing to touch it", driveInfo.Path, driveInfo.Serial)
+			}
+			rootPath = driveInfo.Path
+		} else if info, err := os.Stat(rootPath); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("scan root %s is not an accessible directory", root)
+		}
+
+		result, err := scanner.ScanForImages(rootPath, rawExtensions, cfg.AutoDetectRAW, cfg.FollowSymlinks)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", rootPath, err)
+		}
+		duplicates := merged.Merge(result)
+		logInfo("Found %d RAW files and %d JPG files in %s", len(result.RAWFiles), len(result.JPGFiles), rootPath)
+		for _, f := range duplicates {
+			logInfo("Skipping %s: %s was already found in %s", f.Path, f.StateKey(), rootOf(&merged, f.StateKey()))
+		}
+		summary.skip(skipDuplicateName, len(duplicates))
+	}
+	return &merged, nil
+}
+
+// rootOf returns the scan root of the file with the given state key in a scan result
+func rootOf(scanResult *scanner.ScanResult, key string) string {
+	for _, files := range [][]scanner.FileInfo{scanResult.RAWFiles, scanResult.JPGFiles} {
+		for _, f := range files {
+			if f.StateKey() == key {
+				return f.Root
+			}
+		}
+	}
+	return ""
+}
+
+// cardNearlyFull warns and returns true when the card has less than card_min_free_mb free
+func cardNearlyFull(cfg *config.Config, driveInfo *drive.DriveInfo) bool {
+	free, _, err := drive.FreeSpace(driveInfo.Path)
+	if err != nil {
+		logError("Could not determine free space on the card: %v", err)
+		return false
+	}
+
+	minFree := uint64(cfg.CardMinFreeMB) * 1024 * 1024
+	if free >= minFree {
+		return false
+	}
+	logError("Only %d MB free on the card (threshold %d MB); the last capture may be incomplete", free/(1024*1024), cfg.CardMinFreeMB)
+	return true
+}
+
+// skipNewestShots drops the n newest shots on the card (RAW and JPG together) from the scan
+// result, as they may still be being written (skip_newest) or be incomplete because the card
+// filled up (skip_newest_when_full); they are picked up by a later run
+func skipNewestShots(cfg *config.Config, driveInfo *drive.DriveInfo, scanResult *scanner.ScanResult, n int) *scanner.ScanResult {
+	// Newest file time and sequence of each shot on the card
+	type shot struct {
+		key      string
+		modTime  int64
+		sequence int
+	}
+	shots := make(map[string]*shot)
+	for _, files := range [][]scanner.FileInfo{scanResult.RAWFiles, scanResult.JPGFiles} {
+		for _, f := range files {
+			if f.Root != "" && f.Root != driveInfo.Path {
+				continue
+			}
+			s := shots[f.ShotKey()]
+			if s == nil {
+				s = &shot{key: f.ShotKey()}
+				shots[s.key] = s
+			}
+			s.modTime = max(s.modTime, f.ModTime)
+			s.sequence = max(s.sequence, f.Sequence())
+		}
+	}
+
+	newest := make([]*shot, 0, len(shots))
+	for _, s := range shots {
+		newest = append(newest, s)
+	}
+	sort.Slice(newest, func(i, j int) bool {
+		if newest[i].modTime != newest[j].modTime {
+			return newest[i].modTime > newest[j].modTime
+		}
+		if newest[i].sequence != newest[j].sequence {
+			return newest[i].sequence > newest[j].sequence
+		}
+		return newest[i].key > newest[j].key
+	})
+	skip := make(map[string]bool)
+	for _, s := range newest[:min(n, len(newest))] {
+		skip[s.key] = true
+	}
+
+	withoutNewest := func(files []scanner.FileInfo) []scanner.FileInfo {
+		var kept []scanner.FileInfo
+		for _, f := range files {
+			if skip[f.ShotKey()] && (f.Root == "" || f.Root == driveInfo.Path) {
+				logInfo("Skipping %s, one of the %d newest shots (possibly incomplete)", f.Name, n)
+				continue
+			}
+			kept = append(kept, f)
+		}
+		return kept
+	}
+
+	filtered := *scanResult
+	filtered.RAWFiles = withoutNewest(scanResult.RAWFiles)
+	filtered.JPGFiles = withoutNewest(scanResult.JPGFiles)
+	summary.skip(skipIncomplete, droppedFiles(cfg, scanResult, &filtered))
+	return &filtered
+}
+
+// droppedFiles counts the files a filter dropped from a scan result the way the runs count
+// them, deciding per file like splitByProcessing: RAW files where RAWs are processed, and
+// JPGs where they are uploaded as they are (not as the companion of a processed RAW)
+func droppedFiles(cfg *config.Config, before, after *scanner.ScanResult) int {
+	kept := make(map[string]bool)
+	for _, f := range after.RAWFiles {
+		kept[f.Path] = true
+	}
+	for _, f := range after.JPGFiles {
+		kept[f.Path] = true
+	}
+
+	dropped := 0
+	processedShots := make(map[string]bool)
+	unprocessedShots := make(map[string]bool)
+	for _, f := range before.RAWFiles {
+		if !cfg.ProcessesRAW(f.Extension, f.RelDir) {
+			unprocessedShots[f.ShotKey()] = true
+			continue
+		}
+		processedShots[f.ShotKey()] = true
+		if !kept[f.Path] {
+			dropped++
+		}
+	}
+	for _, f := range before.JPGFiles {
+		if kept[f.Path] || processedShots[f.ShotKey()] {
+			continue
+		}
+		if unprocessedShots[f.ShotKey()] || !cfg.ProcessesRAW("", f.RelDir) {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// sortFiles orders files by sort_order (keeping the scan order without one)
+func sortFiles(cfg *config.Config, files []scanner.FileInfo) {
+	var less func(a, b scanner.FileInfo) bool
+	switch cfg.SortOrder {
+	case config.SortNewest:
+		less = func(a, b scanner.FileInfo) bool { return a.ModTime > b.ModTime }
+	case config.SortOldest:
+		less = func(a, b scanner.FileInfo) bool { return a.ModTime < b.ModTime }
+	case config.SortName:
+		less = func(a, b scanner.FileInfo) bool { return path.Join(a.RelDir, a.Name) < path.Join(b.RelDir, b.Name) }
+	case config.SortSize:
+		less = func(a, b scanner.FileInfo) bool { return a.Size < b.Size }
+	default:
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool { return less(files[i], files[j]) })
+}
+
+// selectNewFiles returns the files that still need to be processed
+// By default these are the files missing from the processed files list; in watermark
+// mode they are the files newer than the newest file previously synced from the card.
+func selectNewFiles(cfg *config.Config, appState *state.State, files []scanner.FileInfo) []scanner.FileInfo {
+	if !cfg.NewSinceWatermark {
+		return filterProcessed(appState, files)
+	}
+
+	wm, ok := appState.GetWatermark(appState.CardID)
+	if !ok {
+		logInfo("No watermark recorded for this card yet, using the processed files list")
+		return filterProcessed(appState, files)
+	}
+
+	var newFiles []scanner.FileInfo
+	for _, f := range files {
+		// DCF sequence numbers are immune to clock changes, so prefer them when known
+		if seq := f.Sequence(); seq > 0 && wm.MaxSequence > 0 {
+			if seq > wm.MaxSequence {
+				newFiles = append(newFiles, f)
+			}
+		} else if f.ModTime > wm.MaxModTime {
+			newFiles = append(newFiles, f)
+		}
+	}
+	summary.skip(skipNotNewer, len(files)-len(newFiles))
+	return newFiles
+}
+
+// reprocessStale is the --reprocess-profile value selecting files processed with a profile
+// other than the one they would be processed with now
+const reprocessStale = "stale"
+
+// selectReprocessFiles returns the processed files to reprocess for --reprocess-profile
+func selectReprocessFiles(cfg *config.Config, appState *state.State, files []scanner.FileInfo) []scanner.FileInfo {
+	var processed []scanner.FileInfo
+	for _, f := range files {
+		pf, ok := processedEntry(appState, f)
+		if !ok || pf.ProfileUsed == "on-server" || pf.ProfileUsed == "bracket-skipped" {
+			continue
+		}
+		processed = append(processed, f)
+	}
+
+	if reprocessProfile == reprocessStale && len(cfg.ProfileRules) > 0 {
+		scanner.LoadMetadata(processed)
+	}
+
+	var selected []scanner.FileInfo
+	for _, f := range processed {
+		pf, _ := processedEntry(appState, f)
+		used := pf.ProfileUsed
+		if reprocessProfile == reprocessStale {
+			if used != processor.ProfileName(profileFor(cfg, f)) {
+				selected = append(selected, f)
+			}
+		} else if strings.EqualFold(used, reprocessProfile) {
+			selected = append(selected, f)
+		}
+	}
+
+	logInfo("Reprocessing %d of %d processed files on the card (profile: %s)", len(selected), len(processed), reprocessProfile)
+	return selected
+}
+
+// filterProcessed returns the files missing from the processed files list, tallying the
+// skipped ones by whether they were processed here or found on the server
+func filterProcessed(appState *state.State, files []scanner.FileInfo) []scanner.FileInfo {
+	for _, f := range files {
+		if pf, ok := processedEntry(appState, f); ok {
+			if pf.ProfileUsed == "on-server" {
+				summary.skip(skipOnServer, 1)
+			} else {
+				summary.skip(skipAlreadyProcessed, 1)
+			}
+		}
+	}
+	return scanner.FilterNewFiles(files, appState.GetProcessedFilesMap())
+}
+
+// processedEntry returns the state entry of a file; entries recorded before files were
+// keyed by folder (and without a source folder to migrate them by) are keyed by name
+func processedEntry(appState *state.State, f scanner.FileInfo) (state.ProcessedFile, bool) {
+	if pf, ok := appState.ProcessedFiles[f.StateKey()]; ok {
+		return pf, true
+	}
+	pf, ok := appState.ProcessedFiles[f.Name]
+	return pf, ok
+}
+
+// markExistingOnServer marks unprocessed files whose shot already exists on the Immich
+// server as processed, so they are neither processed nor uploaded again
+// A shot is on the server if its camera JPG is (by SHA-1 checksum), or an asset with its
+// base name taken at the same second. DCF names repeat across folders and cards, so the
+// name alone would skip new shots.
+func markExistingOnServer(api *uploader.API, appState *state.State, files, jpgFiles []scanner.FileInfo, verbose bool) {
+	newFiles := scanner.FilterNewFiles(files, appState.GetProcessedFilesMap())
+	if len(newFiles) == 0 {
+		return
+	}
+
+	logStep("Checking Immich server for %d already uploaded files...", len(newFiles))
+	checkStart := time.Now()
+
+	// Camera JPGs are uploaded unchanged, so their checksum identifies the shot exactly
+	checksums := make(map[string]string)
+	for _, f := range newFiles {
+		jpg := &f
+		if !f.IsJPG {
+			jpg = scanner.FindMatchingJPG(f, jpgFiles)
+		}
+		if jpg == nil {
+			continue
+		}
+		sum, err := uploader.SHA1File(jpg.Path)
+		if err != nil {
+			logError("Failed to checksum %s: %v", jpg.Name, err)
+			continue
+		}
+		checksums[f.Path] = sum
+	}
+	onServer := make(map[string]bool)
+	if len(checksums) > 0 {
+		found, err := api.ExistingChecksums(checksums)
+		if err != nil {
+			logError("Server check failed, continuing without it: %v", err)
+			return
+		}
+		onServer = found
+	}
+
+	// Processed JPGs match nothing on the card, so the rest are matched by name and capture
+	// time; files without a capture time are processed again rather than risk skipping them
+	scanner.LoadMetadata(newFiles)
+	existing := 0
+	for _, f := range newFiles {
+		if !onServer[f.Path] {
+			if f.Meta == nil || f.Meta.DateTimeOriginal.IsZero() {
+				continue
+			}
+			assets, err := api.FindAssetsByBaseName(f.BaseName)
+			if err != nil {
+				logError("Server check failed, continuing without it: %v", err)
+				return
+			}
+			if !takenAt(assets, f.Meta.DateTimeOriginal) {
+				continue
+			}
+		}
+
+		existing++
+		appState.MarkProcessed(f.StateKey(), "on-server", "")
+		appState.MarkUploaded(f.StateKey())
+		if verbose {
+			logInfo("Already on server: %s", f.Name)
+		}
+	}
+
+	logInfo("%d of %d files already exist on the server and will be skipped", existing, len(newFiles))
+	logTiming("Server check", checkStart)
+}
+
+// takenAt reports whether one of the assets was captured at the given time, to the second
+func takenAt(assets []uploader.Asset, captured time.Time) bool {
+	for _, asset := range assets {
+		if asset.LocalDateTime.UTC().Truncate(time.Second).Equal(captured.Truncate(time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cardIdentifier returns an identifier for the card in the given drive
+// A marker file at the card root gives a stable ID; without one the volume label and
+// mount path are used
+func cardIdentifier(cfg *config.Config, driveInfo *drive.DriveInfo) string {
+	if id := drive.ReadCardMarker(driveInfo.Path); id != "" {
+		return "marker:" + id
+	}
+
+	if cfg.AutoCreateCardMarker && !driveInfo.ReadOnly && !cfg.DryRun {
+		id, err := drive.CreateCardMarker(driveInfo.Path)
+		if err == nil {
+			logInfo("Created card marker %s (card ID %s)", drive.CardMarkerFile, id)
+			return "marker:" + id
+		}
+		logError("Could not create card marker: %v", err)
+	}
+
+	return driveInfo.VolumeLabel + "@" + driveInfo.Path
+}
+
+// newUploader initializes the immich-go uploader
+func newUploader(cfg *config.Config, verbose bool) (*uploader.Immich, error) {
+	logStep("Initializing Immich uploader...")
+	
+	immichConfig := uploader.ImmichConfig{
+		ExecutablePath: cfg.ImmichExecutable,
+		ServerURL:      cfg.ImmichServerURL,
+		APIKey:         cfg.ImmichAPIKey,
+		Album:          cfg.ImmichAlbum,
+		Tags:           cfg.ImmichTags,
+		ShowProgress:   verbose, // Show upload progress in verbose mode
+		ProgressOutput: logOut,
+		Timeout:        time.Duration(cfg.UploadTimeout) * time.Second,
+		Concurrency:    cfg.UploadConcurrency,
+		DeviceUUID:     cfg.DeviceUUID,
+	}
+
+	if cfg.SaveUploadLog {
+		logFile, err := createUploadLog()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create upload log: %v", err)
+		}
+		immichConfig.LogOutput = logFile
+		logInfo("Saving immich-go output to %s", logFile.Name())
+	}
+
+	im, err := uploader.NewImmich(immichConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Immich uploader: %v", err)
+	}
+
+	if v := im.Version(); v != "" {
+		logSuccess("Connected to Immich server (immich-go %s)", v)
+	} else {
+		logSuccess("Connected to Immich server")
+		logInfo("Could not determine the immich-go version; version 0.22.0 or newer is required")
+	}
+
+	// Make sure a key from user_api_keys really is the user's before uploading into the
+	// wrong account
+	if cfg.UploadAsUser != "" {
+		user, err := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey).CurrentUser()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the user of the API key for %s: %v", cfg.UploadAsUser, err)
+		}
+		if !strings.EqualFold(user.Email, cfg.UploadAsUser) {
+			return nil, fmt.Errorf("the API key for %s in user_api_keys belongs to %s", cfg.UploadAsUser, user.Email)
+		}
+		logSuccess("Uploading into the account of %s", user.Email)
+	}
+
+	return im, nil
+}
+
+// createUploadLog creates a timestamped file for the immich-go output of this run in
+// the logs folder of the data directory; it stays open until the program exits
+func createUploadLog() (*os.File, error) {
+	dataDir, err := paths.DataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	logDir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return os.Create(filepath.Join(logDir, "upload-"+time.Now().Format("20060102-150405")+".log"))
+}
+
+// runUploadOnly uploads processed files from earlier --skip-upload runs without
+// reprocessing them (and without needing the card)
+func runUploadOnly(cfg *config.Config, verbose bool) error {
+	totalStart := time.Now()
+
+	statePath, err := state.DefaultStatePath()
+	if err != nil {
+		return fmt.Errorf("failed to determine state path: %v", err)
+	}
+
+	appState, err := state.Load(statePath)
+	if err != nil {
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	appState.SetCompression(cfg.CompressState)
+
+	pending := appState.GetPendingUploads()
+	if len(pending) == 0 {
+		logSuccess("No processed files waiting for upload!")
+		return nil
+	}
+
+	// Group by profile, since processed files are tagged with the profile they were processed
+	// with; camera JPGs kept by --skip-upload runs go by their upload_visibility category
+	byProfile := make(map[string][]uploadItem)
+	byCategory := make(map[string][]uploadItem)
+	for _, pf := range pending {
+		item, ok := outputItem(pf)
+		if !ok {
+			continue
+		}
+		if category, ok := stashedCategories[pf.ProfileUsed]; ok {
+			byCategory[category] = append(byCategory[category], item)
+			continue
+		}
+		byProfile[pf.ProfileUsed] = append(byProfile[pf.ProfileUsed], item)
+	}
+
+	profiles := make([]string, 0, len(byProfile))
+	count := 0
+	for profile, items := range byProfile {
+		profiles = append(profiles, profile)
+		count += len(items)
+	}
+	sort.Strings(profiles)
+	categories := make([]string, 0, len(byCategory))
+	cameraCount := 0
+	for category, items := range byCategory {
+		categories = append(categories, category)
+		cameraCount += len(items)
+	}
+	sort.Strings(categories)
+
+	logInfo("%d processed files waiting for upload", count)
+	if cameraCount > 0 {
+		logInfo("%d camera JPGs waiting for upload", cameraCount)
+	}
+
+	if cfg.DryRun {
+		logInfo("DRY RUN - Would upload the following files:")
+		for _, profile := range profiles {
+			for _, item := range byProfile[profile] {
+				fmt.Fprintf(logOut, "  - %s\n", item.path)
+			}
+		}
+		for _, category := range categories {
+			for _, item := range byCategory[category] {
+				fmt.Fprintf(logOut, "  - %s\n", item.path)
+			}
+		}
+		return nil
+	}
+
+	if count+cameraCount == 0 {
+		return nil
+	}
+
+	im, err := newUploader(cfg, verbose)
+	if err != nil {
+		return err
+	}
+
+	var uploaded []uploadItem
+	for _, profile := range profiles {
+		items, _ := uploadProcessed(cfg, im, appState, byProfile[profile], profile, verbose)
+		uploaded = append(uploaded, items...)
+	}
+	for _, category := range categories {
+		uploaded = append(uploaded, uploadStashedJPGs(cfg, im, appState, byCategory[category], category, verbose)...)
+	}
+
+	if cfg.CleanupAfterUpload && len(uploaded) > 0 {
+		cleanupOutputs(cfg, appState, uploaded)
+	}
+
+	if err := appState.Save(); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+
+	if len(uploaded) > 0 && cfg.ShareWithPartner != "" {
+		shareWithPartner(cfg)
+	}
+	reportAlbums(cfg)
+
+	logSuccess("Done! Uploaded %d files.", len(uploaded))
+	logTiming("TOTAL TIME", totalStart)
+
+	return nil
+}
+
+// outputItem describes the recorded output of a processed file for uploading or cleaning
+// it up without the card; false if the output is missing
+func outputItem(pf state.ProcessedFile) (uploadItem, bool) {
+	info, err := os.Stat(pf.OutputPath)
+	if err != nil {
+		logError("Output of %s is missing: %s", pf.Filename, pf.OutputPath)
+		return uploadItem{}, false
+	}
+
+	modTime := pf.SourceModTime
+	if modTime == 0 {
+		modTime = info.ModTime().Unix()
+	}
+	// The rating of the source is all favorite_if min_rating needs from its metadata
+	var meta *exif.Metadata
+	if pf.SourceRating > 0 {
+		meta = &exif.Metadata{Rating: pf.SourceRating}
+	}
+	name := path.Base(pf.Filename)
+	return uploadItem{
+		path: pf.OutputPath,
+		keep: pf.KeptOutput,
+		source: scanner.FileInfo{
+			Path:     pf.OutputPath,
+			Name:     name,
+			BaseName: strings.TrimSuffix(name, filepath.Ext(name)),
+			ModTime:  modTime,
+			RelDir:   pf.SourceDir,
+			Meta:     meta,
+		},
+	}, true
+}
+
+// runCleanupOnly deletes the outputs of files uploaded by earlier runs that kept them
+// (keep-files, or an upload from another machine sharing the state), without a card
+// With verify_before_cleanup only outputs the server confirms to have are deleted.
+func runCleanupOnly(cfg *config.Config) error {
+	statePath, err := state.DefaultStatePath()
+	if err != nil {
+		return fmt.Errorf("failed to determine state path: %v", err)
+	}
+
+	appState, err := state.Load(statePath)
+	if err != nil {
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	appState.SetCompression(cfg.CompressState)
+
+	var items []uploadItem
+	for _, pf := range appState.GetPendingCleanup() {
+		if item, ok := outputItem(pf); ok {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		logSuccess("No uploaded files waiting for cleanup!")
+		return nil
+	}
+
+	if cfg.DryRun {
+		logInfo("DRY RUN - Would delete the following files:")
+		for _, item := range items {
+			fmt.Fprintf(logOut, "  - %s\n", item.path)
+		}
+		return nil
+	}
+
+	cleanupOutputs(cfg, appState, items)
+
+	if err := appState.Save(); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	return nil
+}
+
+// errProcessingAborted is the result of jobs still queued when a run is aborted
+var errProcessingAborted = errors.New("processing aborted")
+
+// runWithRAWProcessing handles the workflow when RAW processing is enabled
+func runWithRAWProcessing(cfg *config.Config, appState *state.State, scanResult *scanner.ScanResult, im *uploader.Immich, verbose bool) error {
+	// Filter unprocessed RAW files (or the processed ones to reprocess)
+	var newRAWFiles []scanner.FileInfo
+	if reprocessProfile != "" {
+		newRAWFiles = selectReprocessFiles(cfg, appState, scanResult.RAWFiles)
+	} else {
+		newRAWFiles = selectNewFiles(cfg, appState, scanResult.RAWFiles)
+	}
+
+	// JPG-only shots are selected before processing, which moves the watermark past them
+	var orphanJPGs []scanner.FileInfo
+	if cfg.CameraJPGMode() == config.CameraJPGsOrphansOnly {
+		orphanJPGs = selectNewFiles(cfg, appState, findOrphanJPGs(scanResult))
+	}
+
+	if len(newRAWFiles) == 0 {
+		logSuccess("No new RAW files to process!")
+		if len(orphanJPGs) > 0 {
+			return uploadOrphanJPGs(cfg, appState, im, orphanJPGs, verbose)
+		}
+		return nil
+	}
+
+	// Drop low-resolution shots before the limit is applied, so it counts only wanted files
+	if cfg.MinMegapixels > 0 {
+		newRAWFiles = filterResolution(cfg, newRAWFiles, verbose)
+		if len(newRAWFiles) == 0 {
+			logSuccess("No new RAW files of at least %g megapixels to process!", cfg.MinMegapixels)
+			if len(orphanJPGs) > 0 {
+				return uploadOrphanJPGs(cfg, appState, im, orphanJPGs, verbose)
+			}
+			return nil
+		}
+	}
+
+	// Apply limit if specified, to the files that come first in sort_order
+	sortFiles(cfg, newRAWFiles)
+	if resumeChunk > 0 {
+		newRAWFiles = nextChunk(cfg, appState, scanResult.RAWFiles, newRAWFiles)
+		if len(newRAWFiles) == 0 {
+			logSuccess("No new RAW files after the bookmark, the card has been processed in chunks")
+			if !cfg.DryRun {
+				appState.SetBookmark(appState.CardID, "")
+				if err := appState.Save(); err != nil {
+					logError("Failed to save state: %v", err)
+				}
+			}
+			if len(orphanJPGs) > 0 {
+				return uploadOrphanJPGs(cfg, appState, im, orphanJPGs, verbose)
+			}
+			return nil
+		}
+	} else if cfg.Limit > 0 && len(newRAWFiles) > cfg.Limit {
+		logInfo("Limiting to %d files (out of %d new files)", cfg.Limit, len(newRAWFiles))
+		summary.skip(skipOverLimit, len(newRAWFiles)-cfg.Limit)
+		newRAWFiles = newRAWFiles[:cfg.Limit]
+	}
+
+	logInfo("%d new RAW files to process", len(newRAWFiles))
+
+	if needsMetadata(cfg) {
+		scanner.LoadMetadata(newRAWFiles)
+	}
+
+	var shotTags map[string][]string // Bracket and burst tags by state key
+	var bracketSkipped []scanner.FileInfo
+	candidates := newRAWFiles
+	if cfg.BracketMode != "" {
+		newRAWFiles, bracketSkipped, shotTags = groupBrackets(cfg, newRAWFiles, verbose)
+	}
+	if cfg.BurstGap != "" {
+		shotTags = tagBursts(cfg, candidates, shotTags, verbose)
+	}
+
+	if cfg.DryRun {
+		logInfo("DRY RUN - Would process the following files:")
+		var totalRAW, totalOutput int64
+		estimated := 0
+		for _, f := range newRAWFiles {
+			totalRAW += f.Size
+			if size, ok := appState.EstimateOutputSize(f.Extension, f.Size); ok {
+				fmt.Fprintf(logOut, "  - %s (%.1f MB -> ~%.1f MB)\n", f.Name, megabytes(f.Size), megabytes(size))
+				totalOutput += size
+				estimated++
+			} else {
+				fmt.Fprintf(logOut, "  - %s (%.1f MB)\n", f.Name, megabytes(f.Size))
+			}
+		}
+		switch {
+		case estimated == len(newRAWFiles):
+			logInfo("Total: %.1f MB of RAW files -> ~%.1f MB of processed JPGs", megabytes(totalRAW), megabytes(totalOutput))
+		case estimated > 0:
+			logInfo("Total: %.1f MB of RAW files -> ~%.1f MB of processed JPGs for %d of %d files", megabytes(totalRAW), megabytes(totalOutput), estimated, len(newRAWFiles))
+		default:
+			logInfo("Total: %.1f MB of RAW files (output sizes are estimated once files have been processed)", megabytes(totalRAW))
+		}
+		if len(bracketSkipped) > 0 {
+			logInfo("DRY RUN - Would skip the following bracket exposures:")
+			for _, f := range bracketSkipped {
+				fmt.Fprintf(logOut, "  - %s\n", f.Name)
+			}
+		}
+		if len(orphanJPGs) > 0 {
+			logInfo("DRY RUN - Would upload the following JPG-only shots:")
+			for _, f := range orphanJPGs {
+				fmt.Fprintf(logOut, "  - %s\n", f.Name)
+			}
+		}
+		return nil
+	}
+
+	// Bracket exposures that aren't processed are recorded so they aren't picked up again
+	for _, f := range bracketSkipped {
+		appState.MarkProcessed(f.StateKey(), "bracket-skipped", "")
+		appState.UpdateWatermark(appState.CardID, f.ModTime, f.Sequence())
+	}
+
+	// Initialize the RAW decoder if enabled (for cameras not natively supported by RawTherapee):
+	// Adobe DNG Converter, or an external command producing a TIFF
+	var decoder processor.Decoder
+	var intermediateFilesToCleanup []string
+
+	if !cfg.UseEmbeddedPreview && (cfg.ConvertToDNG || len(cfg.RawDecoderCommand) > 0) {
+		// Use temp directory for intermediate files if not specified
+		intermediateDir := cfg.DNGOutputDirectory
+		if intermediateDir == "" {
+			var err error
+			intermediateDir, err = os.MkdirTemp("", "camera-to-immich-dng-*")
+			if err != nil {
+				return fmt.Errorf("failed to create temp directory for intermediate files: %v", err)
+			}
+			// Clean up temp directory on exit
+			defer os.RemoveAll(intermediateDir)
+		} else {
+			// Ensure directory exists
+			if err := os.MkdirAll(intermediateDir, 0755); err != nil {
+				return fmt.Errorf("failed to create DNG output directory: %v", err)
+			}
+		}
+
+		if len(cfg.RawDecoderCommand) > 0 {
+			logStep("Initializing RAW decoder (%s)...", cfg.RawDecoderCommand[0])
+
+			var err error
+			decoder, err = processor.NewCommandDecoder(processor.CommandDecoderConfig{
+				Command:   cfg.RawDecoderCommand,
+				OutputDir: intermediateDir,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize RAW decoder: %v", err)
+			}
+
+			logSuccess("RAW decoder initialized (output: %s)", intermediateDir)
+		} else {
+			logStep("Initializing Adobe DNG Converter...")
+
+			dngConfig := processor.DNGConverterConfig{
+				ExecutablePath:   cfg.DNGConverterPath,
+				OutputDir:        intermediateDir,
+				Compressed:       cfg.DNGCompressed,
+				EmbedOriginal:    cfg.DNGEmbedOriginal,
+				CameraRawVersion: cfg.DNGCameraRawVersion,
+				DNGVersion:       cfg.DNGVersion,
+				WaitTimeout:      time.Duration(cfg.DNGWaitTimeout) * time.Second,
+				SettleTime:       time.Duration(cfg.DNGSettleTime) * time.Millisecond,
+			}
+
+			dngConverter, err := processor.NewDNGConverter(dngConfig)
+			if err != nil {
+				return fmt.Errorf("failed to initialize DNG Converter: %v", err)
+			}
+			decoder = dngConverter
+
+			logSuccess("DNG Converter initialized (output: %s)", intermediateDir)
+		}
+	}
+
+	// Initialize RawTherapee processor
+	if cfg.UseEmbeddedPreview {
+		logStep("Using the embedded JPEG previews instead of RawTherapee...")
+	} else {
+		logStep("Initializing RawTherapee processor...")
+	}
+	
+	// Reprocessing replaces the outputs of the earlier profile, which would otherwise be
+	// kept and uploaded again as they are
+	overwrite := cfg.OverwriteExisting || reprocessProfile != ""
+
+	rtConfig := processor.RawTherapeeConfig{
+		ExecutablePath: cfg.RawTherapeeExecutable,
+		ProfilePath:    cfg.PP3ProfilePath,
+		OutputDir:      cfg.OutputDirectory,
+		Quality:        cfg.JPEGQuality,
+		DPI:            cfg.JPEGDPI,
+		VerifyOutput:   cfg.VerifyOutput,
+		Overwrite:      overwrite,
+		KeepSidecars:   cfg.KeepPP3Sidecars,
+		TIFFBitDepth:   cfg.TIFFBitDepth,
+		Overrides:      cfg.RTOverrides,
+	}
+	if verbose {
+		rtConfig.Progress = func(inputPath string, percent int) {
+			switch percent {
+			case 0:
+				logInfo("RawTherapee: started %s", filepath.Base(inputPath))
+			case 100:
+				logInfo("RawTherapee: finished %s", filepath.Base(inputPath))
+			default:
+				logInfo("RawTherapee: %s %d%%", filepath.Base(inputPath), percent)
+			}
+		}
+	}
+
+	// One processor per PP3 profile and output directory, as profile_rules and
+	// output_directories can differ per file (one extractor per output directory with
+	// use_embedded_preview)
+	processors := make(map[string]*processor.RawTherapee)
+	defer func() {
+		for _, rt := range processors {
+			rt.Close()
+		}
+	}()
+	extractors := make(map[string]*processor.PreviewExtractor)
+	fileProcessors := make([]string, len(newRAWFiles))
+	profileCounts := make(map[string]int)
+	for i, f := range newRAWFiles {
+		outputDir := cfg.OutputDirectoryFor(f.Extension)
+		if cfg.UseEmbeddedPreview {
+			fileProcessors[i] = outputDir
+			if extractors[outputDir] == nil {
+				extractor, err := processor.NewPreviewExtractor(processor.PreviewExtractorConfig{
+					OutputDir:    outputDir,
+					VerifyOutput: cfg.VerifyOutput,
+					Overwrite:    overwrite,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to initialize preview extraction: %v", err)
+				}
+				extractors[outputDir] = extractor
+			}
+			profileCounts[processor.EmbeddedPreviewProfile]++
+			continue
+		}
+
+		profilePath := profileFor(cfg, f)
+		key := profilePath + "\x00" + outputDir
+		fileProcessors[i] = key
+		if processors[key] == nil {
+			rtConfig.ProfilePath = profilePath
+			rtConfig.OutputDir = outputDir
+			rtConfig.TIFFOutputDir = cfg.TIFFOutputDirectoryFor(outputDir)
+			rt, err := processor.NewRawTherapee(rtConfig)
+			if err != nil {
+				return fmt.Errorf("failed to initialize RawTherapee: %v", err)
+			}
+			processors[key] = rt
+		}
+		profileCounts[processors[key].GetProfileName()]++
+	}
+
+	profileNames := make([]string, 0, len(profileCounts))
+	for name := range profileCounts {
+		profileNames = append(profileNames, name)
+	}
+	sort.Strings(profileNames)
+	for _, name := range profileNames {
+		if len(profileNames) == 1 {
+			logSuccess("Using profile: %s", name)
+		} else {
+			logSuccess("Using profile: %s (%d files)", name, profileCounts[name])
+		}
+	}
+
+	// Process and upload files
+	var processedJPGs []uploadItem
+	var cameraJPGs []uploadItem
+	processedByProfile := make(map[string][]uploadItem) // Processed files are tagged with their profile
+
+	var totalRawProcessingTime time.Duration
+	
+	// Determine number of workers for parallel processing
+	// Default to 4 workers max to avoid memory issues (RawTherapee uses ~1-2GB per instance)
+	// Users can override with --workers flag or config for systems with more RAM
+	const defaultMaxWorkers = 4
+	numWorkers := cfg.Workers
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+		// Cap at default max to avoid memory exhaustion
+		if numWorkers > defaultMaxWorkers {
+			numWorkers = defaultMaxWorkers
+		}
+	}
+	// Don't use more workers than files
+	if numWorkers > len(newRAWFiles) {
+		numWorkers = len(newRAWFiles)
+	}
+	
+	logInfo("Processing %d files with %d parallel workers...", len(newRAWFiles), numWorkers)
+	if stagger := cfg.WorkerStaggerDelay(); stagger > 0 && numWorkers > 1 {
+		logInfo("Worker starts staggered by %s", stagger)
+	}
+	var throttle *loadThrottle
+	if (cfg.ThrottleCPUPercent > 0 || cfg.ThrottleMemoryPercent > 0) && numWorkers > 1 {
+		throttle = &loadThrottle{cfg: cfg, monitor: sysload.NewMonitor()}
+		logInfo("Workers are held back while the system is busy (throttle_cpu_percent/throttle_memory_percent)")
+	}
+	if avg := appState.GetAverageProcessingTime(); avg > 0 {
+		eta := avg * time.Duration(len(newRAWFiles)) / time.Duration(numWorkers)
+		logInfo("Estimated time: ~%d files × %.1fs avg ÷ %d workers ≈ %s", len(newRAWFiles), avg.Seconds(), numWorkers, eta.Round(time.Second))
+	}
+	if cfg.UseEmbeddedPreview {
+		logInfo("Extracting embedded JPEG previews (use_embedded_preview), RAW files are not developed")
+	} else {
+		if cfg.RawTherapeeBatchMode {
+			logInfo("RawTherapee batch mode enabled (one rawtherapee-cli call per worker)")
+		}
+		if cfg.TIFFOutputDirectoryFor(cfg.OutputDirectory) != "" {
+			logInfo("Archival %d-bit TIFFs enabled (written in a second RawTherapee pass, not uploaded)", cfg.TIFFBitDepth)
+		}
+		if len(cfg.RawDecoderCommand) > 0 {
+			logInfo("RAW decoding to TIFF enabled for camera compatibility")
+		} else if cfg.ConvertToDNG {
+			logInfo("DNG conversion enabled for camera compatibility")
+		}
+	}
+	
+	// Define result structure for processed files
+	type processResult struct {
+		index            int
+		rawFile          scanner.FileInfo
+		outputPath       string
+		profileName      string
+		intermediatePath string   // Path to the intermediate DNG/TIFF file (if a decoder was used)
+		warnings         []string // Warnings rawtherapee-cli printed for the file
+		elapsed          time.Duration
+		err              error
+	}
+	
+	// Create channels for job distribution and results
+	// Each job is a batch of files: a single file in per-file mode, or a chunk of files
+	// handed to one rawtherapee-cli call in batch mode
+	type rawJob struct {
+		index   int
+		rawFile scanner.FileInfo
+		rt      *processor.RawTherapee     // Processor with the file's profile (the same for a whole batch)
+		preview *processor.PreviewExtractor // Extractor used instead of rt with use_embedded_preview
+	}
+	jobs := make(chan []rawJob, len(newRAWFiles))
+	results := make(chan processResult, len(newRAWFiles))
+	// Closed when the run is aborted (max_consecutive_failures); queued jobs are then
+	// returned unprocessed
+	aborted := make(chan struct{})
+	
+	// Start worker goroutines
+	stagger := cfg.WorkerStaggerDelay()
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			// Staggered starts keep several rawtherapee-cli processes from allocating their
+			// memory at the same moment
+			time.Sleep(time.Duration(workerID) * stagger)
+			for batch := range jobs {
+				throttle.wait(workerID, aborted)
+				select {
+				case <-aborted:
+					for _, job := range batch {
+						results <- processResult{index: job.index, rawFile: job.rawFile, err: errProcessingAborted}
+					}
+					continue
+				default:
+				}
+				if batch[0].preview != nil {
+					for _, job := range batch {
+						start := time.Now()
+						outputPath, err := job.preview.ProcessFile(job.rawFile.Path)
+						results <- processResult{index: job.index, rawFile: job.rawFile, outputPath: outputPath, profileName: processor.EmbeddedPreviewProfile, elapsed: time.Since(start), err: err}
+					}
+					continue
+				}
+
+				rt := batch[0].rt
+				rtStart := time.Now()
+				var inputPaths []string
+				var pending []processResult
+				
+				// Decode to DNG/TIFF first if enabled (DNG files are DNG already)
+				for _, job := range batch {
+					result := processResult{index: job.index, rawFile: job.rawFile, profileName: rt.GetProfileName()}
+					inputPath := job.rawFile.Path
+					if decoder != nil && !(cfg.ConvertToDNG && job.rawFile.Extension == config.DNGExtension) {
+						intermediatePath, err := decoder.ConvertFile(job.rawFile.Path)
+						if err != nil {
+							result.elapsed = time.Since(rtStart)
+							result.err = fmt.Errorf("RAW decoding failed: %v", err)
+							results <- result
+							continue
+						}
+						inputPath = intermediatePath
+						result.intermediatePath = intermediatePath
+					}
+					inputPaths = append(inputPaths, inputPath)
+					pending = append(pending, result)
+				}
+				if len(pending) == 0 {
+					continue
+				}
+				
+				// Process with RawTherapee
+				if cfg.RawTherapeeBatchMode {
+					batchResults := rt.ProcessBatch(inputPaths)
+					// A batch is a single process, so spread its time evenly over its files
+					perFile := time.Since(rtStart) / time.Duration(len(pending))
+					for i := range pending {
+						pending[i].outputPath = batchResults[i].OutputPath
+						pending[i].warnings = batchResults[i].Warnings
+						pending[i].err = batchResults[i].Err
+						pending[i].elapsed = perFile
+						results <- pending[i]
+					}
+					continue
+				}
+				
+				outputPath, warnings, err := rt.ProcessFile(inputPaths[0])
+				pending[0].outputPath = outputPath
+				pending[0].warnings = warnings
+				pending[0].elapsed = time.Since(rtStart)
+				pending[0].err = err
+				results <- pending[0]
+			}
+		}(w)
+	}
+	
+	jobFor := func(i int) rawJob {
+		return rawJob{index: i, rawFile: newRAWFiles[i], rt: processors[fileProcessors[i]], preview: extractors[fileProcessors[i]]}
+	}
+
+	// Send jobs to workers
+	if cfg.RawTherapeeBatchMode {
+		// One chunk per worker keeps all workers busy with a single rawtherapee-cli call each
+		// A call uses a single profile and output directory, so the files of each processor
+		// are chunked separately
+		byProcessor := make(map[string][]rawJob)
+		for i := range newRAWFiles {
+			byProcessor[fileProcessors[i]] = append(byProcessor[fileProcessors[i]], jobFor(i))
+		}
+		keys := make([]string, 0, len(byProcessor))
+		for key := range byProcessor {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			group := byProcessor[key]
+			chunkSize := (len(group) + numWorkers - 1) / numWorkers
+			for start := 0; start < len(group); start += chunkSize {
+				end := start + chunkSize
+				if end > len(group) {
+					end = len(group)
+				}
+				jobs <- group[start:end]
+			}
+		}
+	} else {
+		for i := range newRAWFiles {
+			jobs <- []rawJob{jobFor(i)}
+		}
+	}
+	// The job queue stays open until every file has a final result, as failed files may be
+	// queued again (process_retries)
+	
+	// Wait for all workers to complete in a separate goroutine, then close results
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	
+	// Collect results
+	processedCount := 0
+	attempts := make(map[int]int)
+	consecutiveFailures := 0
+	var abortErr error
+	for result := range results {
+		totalRawProcessingTime += result.elapsed
+		
+		// An existing output (e.g. hand-edited) is kept as is and never cleaned up
+		kept := errors.Is(result.err, processor.ErrOutputExists)
+		if result.err != nil && !kept && abortErr == nil && attempts[result.index] < cfg.ProcessRetries {
+			attempts[result.index]++
+			logError("Failed to process %s, retrying (%d/%d): %v", result.rawFile.Name, attempts[result.index], cfg.ProcessRetries, result.err)
+			jobs <- []rawJob{jobFor(result.index)}
+			continue
+		}
+
+		processedCount++
+		if processedCount == len(newRAWFiles) {
+			close(jobs)
+		}
+		if errors.Is(result.err, errProcessingAborted) {
+			continue
+		}
+		entry := manifest.entry(result.rawFile)
+		entry.profile = result.profileName
+		entry.duration += result.elapsed
+		if result.err != nil && !kept {
+			logError("[%d/%d] Failed to process %s: %v", processedCount, len(newRAWFiles), result.rawFile.Name, result.err)
+			recordFailure(cfg, appState, result.rawFile, "process", result.err)
+			// A run of failures points to a systemic problem (RawTherapee missing, disk
+			// full, card unreadable) rather than a few bad files
+			consecutiveFailures++
+			if abortErr == nil && cfg.MaxConsecutiveFailures > 0 && consecutiveFailures >= cfg.MaxConsecutiveFailures {
+				abortErr = fmt.Errorf("aborted after %d consecutive processing failures (last: %v)", consecutiveFailures, result.err)
+				logError("%d files in a row failed to process, aborting the run (max_consecutive_failures)", consecutiveFailures)
+				close(aborted)
+			}
+			continue
+		}
+		consecutiveFailures = 0
+
+		entry.output = result.outputPath
+		entry.status = "processed"
+		if kept {
+			entry.status = "kept"
+		}
+		if info, err := os.Stat(result.outputPath); err == nil {
+			entry.size = info.Size()
+		}
+
+		item := uploadItem{path: result.outputPath, source: result.rawFile, tags: shotTags[result.rawFile.StateKey()], keep: kept}
+		processedJPGs = append(processedJPGs, item)
+		processedByProfile[result.profileName] = append(processedByProfile[result.profileName], item)
+		
+		// Track intermediate files for cleanup
+		if result.intermediatePath != "" {
+			intermediateFilesToCleanup = append(intermediateFilesToCleanup, result.intermediatePath)
+		}
+		
+		if kept {
+			logInfo("[%d/%d] Kept existing output: %s (overwrite_existing is disabled)", processedCount, len(newRAWFiles), filepath.Base(result.outputPath))
+		} else {
+			logSuccess("[%d/%d] Created: %s (%.1fs)", processedCount, len(newRAWFiles), filepath.Base(result.outputPath), result.elapsed.Seconds())
+		}
+		if len(result.warnings) > 0 {
+			summary.warn(result.rawFile.Name, result.warnings)
+			for _, warning := range result.warnings {
+				logError("rawtherapee-cli warning for %s: %s", result.rawFile.Name, warning)
+			}
+		}
+
+		// Find matching camera JPG if enabled (orphans-only uploads just JPGs without a RAW)
+		if cfg.CameraJPGMode() == config.CameraJPGsAll {
+			if matchingJPG := scanner.FindMatchingJPG(result.rawFile, scanResult.JPGFiles); matchingJPG != nil {
+				// The camera JPG is the same shot, so it goes into the same date album
+				source := *matchingJPG
+				if source.Meta == nil {
+					source.Meta = result.rawFile.Meta
+				}
+				cameraJPGs = append(cameraJPGs, uploadItem{path: matchingJPG.Path, source: source, tags: shotTags[result.rawFile.StateKey()]})
+				if verbose {
+					logInfo("Found matching camera JPG: %s", matchingJPG.Name)
+				}
+			}
+		}
+		if cfg.NormalizeOrientation && !kept {
+			if matchingJPG := scanner.FindMatchingJPG(result.rawFile, scanResult.JPGFiles); matchingJPG != nil {
+				if err := normalizeOrientation(result.outputPath, matchingJPG.Path); err != nil {
+					logError("Orientation mismatch: %v", err)
+				}
+			}
+		}
+		if cfg.VerifyEXIF && !kept {
+			if lost, err := compareEXIF(result.rawFile.Path, result.outputPath); err != nil {
+				logError("Failed to verify EXIF of %s: %v", filepath.Base(result.outputPath), err)
+			} else if len(lost) > 0 {
+				logError("EXIF of %s lost or changed: %s", filepath.Base(result.outputPath), strings.Join(lost, ", "))
+			}
+		}
+		if rt := jobFor(result.index).rt; cfg.VerifyDimensions && !kept && rt != nil && result.profileName != processor.EmbeddedPreviewProfile {
+			if mismatch, err := checkDimensions(rt, result.rawFile, result.outputPath); err != nil {
+				logError("Failed to verify the size of %s: %v", filepath.Base(result.outputPath), err)
+			} else if mismatch != "" {
+				logError("Unexpected size of %s: %s (check the profile's resize and crop settings)", filepath.Base(result.outputPath), mismatch)
+			}
+		}
+
+		// Done after every change to the outputs, as each one updates their time
+		if cfg.PreserveFileTimes && !kept {
+			outputs := []string{result.outputPath}
+			if rt := jobFor(result.index).rt; rt != nil {
+				outputs = append(outputs, rt.TIFFPath(result.rawFile.Path))
+			}
+			if err := preserveFileTimes(cfg, result.rawFile, outputs); err != nil {
+				logError("Failed to set the file time of %s: %v", filepath.Base(result.outputPath), err)
+			}
+		}
+
+		// Mark as processed
+		appState.MarkProcessed(result.rawFile.StateKey(), result.profileName, result.outputPath)
+		appState.UpdateWatermark(appState.CardID, result.rawFile.ModTime, result.rawFile.Sequence())
+		appState.RecordSource(result.rawFile.StateKey(), result.rawFile.RelDir, result.rawFile.ModTime)
+		if result.rawFile.Meta != nil && result.rawFile.Meta.Rating > 0 {
+			appState.RecordRating(result.rawFile.StateKey(), result.rawFile.Meta.Rating)
+		}
+		if sum, err := state.ChecksumFile(result.outputPath); err == nil {
+			appState.RecordOutputChecksum(result.rawFile.StateKey(), sum)
+		} else {
+			logError("Failed to checksum %s: %v", filepath.Base(result.outputPath), err)
+		}
+		if kept {
+			appState.MarkOutputKept(result.rawFile.StateKey())
+		}
+		if !kept {
+			appState.RecordProcessingTime(result.rawFile.StateKey(), result.elapsed)
+			if info, err := os.Stat(result.outputPath); err == nil {
+				appState.RecordOutputSize(result.rawFile.Extension, result.rawFile.Size, info.Size())
+			}
+		}
+
+		// Autosave so a crash during a long run loses at most the last few files
+		if cfg.AutosaveInterval > 0 && len(processedJPGs)%cfg.AutosaveInterval == 0 {
+			if err := appState.Save(); err != nil {
+				logError("Failed to autosave state: %v", err)
+			} else if verbose {
+				logInfo("State saved (%d files processed)", len(processedJPGs))
+			}
+			manifest.flush()
+		}
+	}
+
+	if abortErr != nil {
+		if err := appState.Save(); err != nil {
+			logError("Failed to save state: %v", err)
+		}
+		if len(processedJPGs) > 0 {
+			logInfo("%d files were processed before the abort, run with --upload-only to upload them", len(processedJPGs))
+		}
+		return abortErr
+	}
+
+	// Log total processing time
+	if len(processedJPGs) > 0 {
+		if cfg.UseEmbeddedPreview {
+			logTiming(fmt.Sprintf("Embedded preview extraction (%d files)", len(processedJPGs)), time.Now().Add(-totalRawProcessingTime))
+		} else if decoder != nil {
+			logTiming(fmt.Sprintf("RAW decoding + RawTherapee processing (%d files)", len(processedJPGs)), time.Now().Add(-totalRawProcessingTime))
+		} else {
+			logTiming(fmt.Sprintf("RawTherapee processing (%d files)", len(processedJPGs)), time.Now().Add(-totalRawProcessingTime))
+		}
+	}
+
+	var contactSheets []string
+	if cfg.GenerateContactSheet && len(processedJPGs) > 0 {
+		contactSheets = writeContactSheet(cfg, processedJPGs)
+	}
+
+	// Upload processed JPGs (unless skip-upload is enabled)
+	var totalUploadTime time.Duration
+	var uploadedJPGs []uploadItem
+	
+	if cfg.SkipUpload {
+		logInfo("Upload skipped (--skip-upload flag), run with --upload-only later to upload the processed files")
+	} else if len(processedJPGs) > 0 {
+		profiles := make([]string, 0, len(processedByProfile))
+		for profile := range processedByProfile {
+			profiles = append(profiles, profile)
+		}
+		sort.Strings(profiles)
+
+		for _, profile := range profiles {
+			uploaded, uploadTime := uploadProcessed(cfg, im, appState, processedByProfile[profile], profile, verbose)
+			uploadedJPGs = append(uploadedJPGs, uploaded...)
+			totalUploadTime += uploadTime
+		}
+	}
+
+	// Camera JPGs of a --skip-upload run are kept for the --upload-only run
+	if cfg.SkipUpload && len(cameraJPGs) > 0 && !cfg.DryRun {
+		stashCameraJPGs(cfg, appState, cameraJPGs, stashedCameraProfile)
+	}
+
+	// Upload camera JPGs (unless skip-upload is enabled)
+	if !cfg.SkipUpload && len(cameraJPGs) > 0 {
+		logStep("Uploading %d camera JPGs to Immich (batch upload)...", len(cameraJPGs))
+		
+		tags := []string{"camera-original"}
+
+		uploadTime, failed := uploadStaged(cfg, im, cameraJPGs, tags, "camera JPGs", "camera-jpgs-*")
+		totalUploadTime += uploadTime
+		summary.Uploaded += len(cameraJPGs) - len(failed)
+		manifest.uploaded(cameraJPGs, failed, "camera-jpg")
+		markFavorites(cfg, cameraJPGs, failed, tags, verbose)
+		setVisibility(cfg, cameraJPGs, failed, config.UploadCamera, verbose)
+		recordOriginalNames(cfg, cameraJPGs, failed, verbose)
+		for _, item := range failed {
+			recordFailure(cfg, appState, item.source, "upload", item.err)
+		}
+	}
+
+	if !cfg.SkipUpload && len(contactSheets) > 0 && cfg.UploadContactSheet {
+		logStep("Uploading contact sheet to Immich...")
+		items := make([]uploadItem, len(contactSheets))
+		for i, path := range contactSheets {
+			items[i] = uploadItem{path: path, source: processedJPGs[0].source}
+		}
+		uploadTime, failed := uploadStaged(cfg, im, items, []string{"contact-sheet"}, "contact sheet", "contact-sheet-*")
+		totalUploadTime += uploadTime
+		for _, item := range failed {
+			logError("Failed to upload contact sheet %s: %v", filepath.Base(item.path), item.err)
+		}
+	}
+
+	// Cleanup processed files after successful upload (if enabled)
+	// Files that failed to upload are kept for a later --upload-only run
+	if cfg.CleanupAfterUpload && len(uploadedJPGs) > 0 {
+		cleanupOutputs(cfg, appState, uploadedJPGs)
+	}
+
+	// Cleanup intermediate DNG/TIFF files (if a decoder was used and cleanup is enabled)
+	if decoder != nil && cfg.CleanupDNGFiles && len(intermediateFilesToCleanup) > 0 {
+		logStep("Cleaning up intermediate files...")
+		cleanupCount := 0
+		for _, path := range intermediateFilesToCleanup {
+			if err := os.Remove(path); err != nil {
+				logError("Failed to delete %s: %v", filepath.Base(path), err)
+			} else {
+				cleanupCount++
+			}
+		}
+		logSuccess("Deleted %d intermediate files", cleanupCount)
+	}
+
+	// Save state
+	if err := appState.Save(); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+
+	if cfg.OrientationReport {
+		sources := make([]scanner.FileInfo, len(processedJPGs))
+		for i, item := range processedJPGs {
+			sources[i] = item.source
+		}
+		logOrientationReport(sources)
+	}
+
+	summary.Processed = len(processedJPGs)
+	logSuccess("Done! Processed %d files.", len(processedJPGs))
+
+	if len(orphanJPGs) > 0 {
+		return uploadOrphanJPGs(cfg, appState, im, orphanJPGs, verbose)
+	}
+	
+	return nil
+}
+
+// writeContactSheet saves a thumbnail grid of the processed files to the output directory
+// and returns the paths of its pages (none if it couldn't be created)
+func writeContactSheet(cfg *config.Config, items []uploadItem) []string {
+	logStep("Generating contact sheet of %d files...", len(items))
+	start := time.Now()
+
+	jpegPaths := make([]string, len(items))
+	for i, item := range items {
+		jpegPaths[i] = item.path
+	}
+
+	path := filepath.Join(cfg.OutputDirectory, "contact-sheet-"+time.Now().Format("20060102-150405")+".jpg")
+	pages, count, err := processor.GenerateContactSheet(jpegPaths, path)
+	if err != nil {
+		logError("Failed to generate contact sheet: %v", err)
+		if len(pages) == 0 {
+			return nil
+		}
+	}
+
+	if len(pages) > 1 {
+		logSuccess("Contact sheet of %d files saved to %d pages in %s", count, len(pages), cfg.OutputDirectory)
+	} else {
+		logSuccess("Contact sheet of %d files saved to %s", count, pages[0])
+	}
+	logTiming("Contact sheet", start)
+	return pages
+}
+
+// megabytes converts a size in bytes to megabytes
+func megabytes(size int64) float64 {
+	return float64(size) / (1024 * 1024)
+}
+
+// profileFor returns the PP3 profile for a file: the profile of the first matching entry of
+// profile_rules, or pp3_profile_path
+func profileFor(cfg *config.Config, f scanner.FileInfo) string {
+	for _, rule := range cfg.ProfileRules {
+		if profileRuleMatches(rule, f) {
+			return rule.Profile
+		}
+	}
+	return cfg.PP3ProfilePath
+}
+
+// profileRuleMatches reports whether a file matches all criteria of a profile rule
+func profileRuleMatches(rule config.ProfileRule, f scanner.FileInfo) bool {
+	if f.Meta == nil {
+		return false
+	}
+	if rule.MinISO > 0 && f.Meta.ISO < rule.MinISO {
+		return false
+	}
+	if rule.Make != "" && !strings.Contains(strings.ToUpper(f.Meta.Make), strings.ToUpper(rule.Make)) {
+		return false
+	}
+	if rule.Model != "" && !strings.Contains(strings.ToUpper(f.Meta.Model), strings.ToUpper(rule.Model)) {
+		return false
+	}
+	return true
+}
+
+// filterResolution drops files whose EXIF image size is below min_megapixels
+// Files without a known image size are kept.
+func filterResolution(cfg *config.Config, files []scanner.FileInfo, verbose bool) []scanner.FileInfo {
+	scanner.LoadMetadata(files)
+
+	var kept []scanner.FileInfo
+	for _, f := range files {
+		if f.Meta != nil && f.Meta.Width > 0 && f.Meta.Height > 0 {
+			if megapixels := float64(f.Meta.Width) * float64(f.Meta.Height) / 1e6; megapixels < cfg.MinMegapixels {
+				if verbose {
+					logInfo("Skipping %s (%.1f megapixels)", f.Name, megapixels)
+				}
+				continue
+			}
+		}
+		kept = append(kept, f)
+	}
+
+	if dropped := len(files) - len(kept); dropped > 0 {
+		logInfo("Skipping %d files below %g megapixels", dropped, cfg.MinMegapixels)
+		summary.skip(skipLowResolution, dropped)
+	}
+	return kept
+}
+
+// groupBrackets detects exposure brackets among the files and returns the files to process,
+// the bracket exposures to skip ("middle" mode) and the tags of each bracketed file by state key
+// Bracketed files are tagged "bracket" and "bracket:<first shot>" to group them in Immich.
+func groupBrackets(cfg *config.Config, files []scanner.FileInfo, verbose bool) ([]scanner.FileInfo, []scanner.FileInfo, map[string][]string) {
+	brackets := scanner.FindBrackets(files, cfg.BracketSize)
+	if len(brackets) == 0 {
+		return files, nil, nil
+	}
+
+	// Keyed by state key, as the same file name can be in several DCF folders
+	tags := make(map[string][]string)
+	skip := make(map[string]bool)
+	for _, bracket := range brackets {
+		middle := bracket.Middle()
+		for _, f := range bracket.Files {
+			tags[f.StateKey()] = []string{"bracket", "bracket:" + bracket.Name()}
+			if cfg.BracketMode == config.BracketMiddle && f.StateKey() != middle.StateKey() {
+				skip[f.StateKey()] = true
+			}
+		}
+		if verbose {
+			logInfo("Bracket %s: %d shots, middle exposure %s", bracket.Name(), len(bracket.Files), middle.Name)
+		}
+	}
+
+	var selected, skipped []scanner.FileInfo
+	for _, f := range files {
+		if skip[f.StateKey()] {
+			skipped = append(skipped, f)
+		} else {
+			selected = append(selected, f)
+		}
+	}
+
+	if len(skipped) > 0 {
+		logInfo("Found %d exposure brackets, processing only their middle exposures", len(brackets))
+		summary.skip(skipBracket, len(skipped))
+	} else {
+		logInfo("Found %d exposure brackets", len(brackets))
+	}
+	return selected, skipped, tags
+}
+
+// tagBursts detects bursts among the files (leaving out bracketed shots, which are tagged
+// already) and adds the tags of each burst shot to tags, keyed by state key
+// Burst shots are tagged "burst" and "burst:<first shot>" to group them in Immich.
+func tagBursts(cfg *config.Config, files []scanner.FileInfo, tags map[string][]string, verbose bool) map[string][]string {
+	var unbracketed []scanner.FileInfo
+	for _, f := range files {
+		if len(tags[f.StateKey()]) == 0 {
+			unbracketed = append(unbracketed, f)
+		}
+	}
+
+	bursts := scanner.FindBursts(unbracketed, cfg.BurstMaxGap())
+	if len(bursts) == 0 {
+		return tags
+	}
+
+	if tags == nil {
+		tags = make(map[string][]string)
+	}
+	for _, burst := range bursts {
+		for _, f := range burst.Files {
+			tags[f.StateKey()] = []string{"burst", "burst:" + burst.Name()}
+		}
+		if verbose {
+			logInfo("Burst %s: %d shots", burst.Name(), len(burst.Files))
+		}
+	}
+	logInfo("Found %d bursts", len(bursts))
+	return tags
+}
+
+// loadCheckInterval is how often the system usage is sampled for throttle_cpu_percent and
+// throttle_memory_percent
+const loadCheckInterval = 5 * time.Second
+
+// loadThrottle holds back workers while the system is busier than the configured
+// thresholds. The first worker always keeps going, so a run never stalls; as the usage
+// includes this tool's own processing, the workers settle on what the machine can spare.
+type loadThrottle struct {
+	cfg     *config.Config
+	monitor *sysload.Monitor
+
+	mu       sync.Mutex
+	checked  time.Time // Time of the last sample
+	busy     string    // Why the system was busy at the last sample ("" = it wasn't)
+	disabled bool      // The usage couldn't be read
+}
+
+// wait blocks a worker (other than the first) while the system is busy or until the run is
+// aborted; a nil throttle never blocks
+func (t *loadThrottle) wait(workerID int, aborted <-chan struct{}) {
+	if t == nil || workerID == 0 {
+		return
+	}
+	for t.check() != "" {
+		select {
+		case <-aborted:
+			return
+		case <-time.After(loadCheckInterval):
+		}
+	}
+}
+
+// check samples the system usage (at most once per loadCheckInterval) and returns why the
+// system is busy, or "" if it is within the thresholds
+func (t *loadThrottle) check() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.disabled || time.Since(t.checked) < loadCheckInterval {
+		return t.busy
+	}
+	t.checked = time.Now()
+
+	usage, err := t.monitor.Sample()
+	if err != nil {
+		logError("Failed to read the system load, throttling disabled: %v", err)
+		t.disabled = true
+		t.busy = ""
+		return ""
+	}
+
+	busy := ""
+	switch {
+	case t.cfg.ThrottleCPUPercent > 0 && usage.CPUPercent > float64(t.cfg.ThrottleCPUPercent):
+		busy = fmt.Sprintf("CPU at %.0f%%", usage.CPUPercent)
+	case t.cfg.ThrottleMemoryPercent > 0 && usage.MemoryPercent > float64(t.cfg.ThrottleMemoryPercent):
+		busy = fmt.Sprintf("memory at %.0f%%", usage.MemoryPercent)
+	}
+	if busy != "" && t.busy == "" {
+		logInfo("System busy (%s), holding back new jobs", busy)
+	} else if busy == "" && t.busy != "" {
+		logInfo("System load back within the limits, resuming all workers")
+	}
+	t.busy = busy
+	return busy
+}
+
+// splitByProcessing splits a scan into the part whose RAW files are processed and the part
+// whose JPGs are uploaded as they are, following process_raw_files and process_raw_overrides
+// A shot's JPG goes with its RAW file; JPGs without one follow the overrides of their folder.
+// Either part is nil when it has no files (the RAW part, without overrides, when RAW
+// processing is enabled).
+func splitByProcessing(cfg *config.Config, scanResult *scanner.ScanResult) (*scanner.ScanResult, *scanner.ScanResult) {
+	if len(cfg.ProcessRAWOverrides) == 0 {
+		if cfg.ProcessRAWFiles {
+			return scanResult, nil
+		}
+		return nil, scanResult
+	}
+
+	rawPart, jpgPart := *scanResult, *scanResult
+	rawPart.RAWFiles, rawPart.JPGFiles = nil, nil
+	jpgPart.RAWFiles, jpgPart.JPGFiles = nil, nil
+
+	processedShots := make(map[string]bool)
+	unprocessedShots := make(map[string]bool)
+	for _, f := range scanResult.RAWFiles {
+		if cfg.ProcessesRAW(f.Extension, f.RelDir) {
+			rawPart.RAWFiles = append(rawPart.RAWFiles, f)
+			processedShots[f.ShotKey()] = true
+		} else {
+			unprocessedShots[f.ShotKey()] = true
+		}
+	}
+	for _, f := range scanResult.JPGFiles {
+		switch {
+		case processedShots[f.ShotKey()]:
+			rawPart.JPGFiles = append(rawPart.JPGFiles, f)
+		case unprocessedShots[f.ShotKey()] || !cfg.ProcessesRAW("", f.RelDir):
+			jpgPart.JPGFiles = append(jpgPart.JPGFiles, f)
+		default:
+			rawPart.JPGFiles = append(rawPart.JPGFiles, f)
+		}
+	}
+
+	var raw, jpg *scanner.ScanResult
+	if len(rawPart.RAWFiles) > 0 || len(rawPart.JPGFiles) > 0 {
+		raw = &rawPart
+	}
+	if len(jpgPart.JPGFiles) > 0 {
+		jpg = &jpgPart
+	}
+	if raw == nil && jpg == nil {
+		// Nothing on the card; report it the way the global setting would
+		if cfg.ProcessRAWFiles {
+			return scanResult, nil
+		}
+		return nil, scanResult
+	}
+	return raw, jpg
+}
+
+// filesToProcess returns the files a run would process or upload: the RAW files that are
+// processed and the JPGs uploaded instead of RAW files, with a description of their kind
+func filesToProcess(cfg *config.Config, scanResult *scanner.ScanResult) ([]scanner.FileInfo, string) {
+	rawPart, jpgPart := splitByProcessing(cfg, scanResult)
+	switch {
+	case rawPart != nil && jpgPart != nil:
+		return append(append([]scanner.FileInfo{}, rawPart.RAWFiles...), jpgPart.JPGFiles...), "RAW and JPG"
+	case rawPart != nil:
+		return rawPart.RAWFiles, "RAW"
+	default:
+		return jpgPart.JPGFiles, "JPG"
+	}
+}
+
+// findOrphanJPGs returns the camera JPGs without a matching RAW file (JPG-only shots)
+func findOrphanJPGs(scanResult *scanner.ScanResult) []scanner.FileInfo {
+	rawShots := make(map[string]bool, len(scanResult.RAWFiles))
+	for _, f := range scanResult.RAWFiles {
+		rawShots[f.ShotKey()] = true
+	}
+
+	var orphans []scanner.FileInfo
+	for _, f := range scanResult.JPGFiles {
+		if !rawShots[f.ShotKey()] {
+			orphans = append(orphans, f)
+		}
+	}
+	return orphans
+}
+
+// uploadOrphanJPGs uploads JPG-only shots in camera_jpgs orphans-only mode and records them
+// in the state so they are uploaded once
+func uploadOrphanJPGs(cfg *config.Config, appState *state.State, im *uploader.Immich, orphans []scanner.FileInfo, verbose bool) error {
+	if cfg.SkipUpload {
+		logInfo("Upload of %d JPG-only shots skipped (--skip-upload flag), run with --upload-only later to upload them", len(orphans))
+		if cfg.DryRun {
+			return nil
+		}
+		items := make([]uploadItem, len(orphans))
+		for i, f := range orphans {
+			items[i] = uploadItem{path: f.Path, source: f}
+		}
+		stashCameraJPGs(cfg, appState, items, stashedJPGOnlyProfile)
+		for _, f := range orphans {
+			appState.UpdateWatermark(appState.CardID, f.ModTime, f.Sequence())
+		}
+		if err := appState.Save(); err != nil {
+			return fmt.Errorf("failed to save state: %v", err)
+		}
+		return nil
+	}
+	if cfg.DryRun {
+		logInfo("DRY RUN - Would upload the following JPG-only shots:")
+		for _, f := range orphans {
+			fmt.Fprintf(logOut, "  - %s\n", f.Name)
+		}
+		return nil
+	}
+
+	logStep("Uploading %d JPG-only shots to Immich (batch upload)...", len(orphans))
+
+	if needsMetadata(cfg) {
+		scanner.LoadMetadata(orphans)
+	}
+
+	items := make([]uploadItem, len(orphans))
+	for i, f := range orphans {
+		items[i] = uploadItem{path: f.Path, source: f}
+		if verbose {
+			logInfo("JPG-only shot: %s", f.Name)
+		}
+	}
+
+	tags := []string{"camera-original"}
+	_, failed := uploadStaged(cfg, im, items, tags, "JPG-only shots", "camera-jpgs-*")
+	manifest.uploaded(items, failed, "camera-jpg")
+	markFavorites(cfg, items, failed, tags, verbose)
+	setVisibility(cfg, items, failed, config.UploadJPGOnly, verbose)
+	recordOriginalNames(cfg, items, failed, verbose)
+
+	failedNames := make(map[string]bool, len(failed))
+	for _, item := range failed {
+		failedNames[item.source.StateKey()] = true
+		recordFailure(cfg, appState, item.source, "upload", item.err)
+	}
+
+	for _, f := range orphans {
+		if failedNames[f.StateKey()] {
+			continue
+		}
+		appState.MarkProcessed(f.StateKey(), "camera-jpg", "")
+		appState.MarkUploaded(f.StateKey())
+		appState.UpdateWatermark(appState.CardID, f.ModTime, f.Sequence())
+		summary.Uploaded++
+	}
+
+	if err := appState.Save(); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	return nil
+}
+
+// Profile names recorded for the camera JPGs a --skip-upload run keeps for --upload-only;
+// "camera-jpg" is also what uploaded JPG-only shots are recorded with
+const (
+	stashedCameraProfile  = "camera-original" // Camera JPGs of RAW files
+	stashedJPGOnlyProfile = "camera-jpg"      // JPG-only shots
+)
+
+// stashedCategories maps the profile names of kept camera JPGs to their upload_visibility
+// category
+var stashedCategories = map[string]string{
+	stashedCameraProfile:  config.UploadCamera,
+	stashedJPGOnlyProfile: config.UploadJPGOnly,
+}
+
+// pendingCameraJPGDir is the folder below the output directory that camera JPGs of
+// --skip-upload runs are copied to
+const pendingCameraJPGDir = "camera-jpgs"
+
+// stashCameraJPGs copies camera JPGs whose upload a --skip-upload run leaves for later into
+// the output directory (the card may be gone by then) and records the copies in the state as
+// pending uploads, under the given profile name
+func stashCameraJPGs(cfg *config.Config, appState *state.State, items []uploadItem, profile string) {
+	dir := filepath.Join(cfg.OutputDirectory, pendingCameraJPGDir)
+	stashed := 0
+	for _, item := range items {
+		// A copy still waiting from an earlier card keeps its name
+		dest := filepath.Join(dir, filepath.FromSlash(item.source.RelDir), item.source.Name)
+		base, ext := strings.TrimSuffix(dest, filepath.Ext(dest)), filepath.Ext(dest)
+		for n := 2; ; n++ {
+			if _, err := os.Stat(dest); os.IsNotExist(err) {
+				break
+			}
+			dest = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			logError("Failed to keep %s for upload: %v", item.source.Name, err)
+			continue
+		}
+		if err := copyFileSimple(item.path, dest); err != nil {
+			logError("Failed to keep %s for upload: %v", item.source.Name, err)
+			continue
+		}
+		appState.MarkProcessed(item.source.StateKey(), profile, dest)
+		appState.RecordSource(item.source.StateKey(), item.source.RelDir, item.source.ModTime)
+		if item.source.Meta != nil && item.source.Meta.Rating > 0 {
+			appState.RecordRating(item.source.StateKey(), item.source.Meta.Rating)
+		}
+		if sum, err := state.ChecksumFile(dest); err == nil {
+			appState.RecordOutputChecksum(item.source.StateKey(), sum)
+		}
+		stashed++
+	}
+	if stashed > 0 {
+		logInfo("Copied %d camera JPGs to %s for the --upload-only run", stashed, dir)
+	}
+}
+
+// uploadStashedJPGs uploads the camera JPGs kept by --skip-upload runs, returning the ones
+// that were uploaded
+func uploadStashedJPGs(cfg *config.Config, im *uploader.Immich, appState *state.State, items []uploadItem, category string, verbose bool) []uploadItem {
+	logStep("Uploading %d camera JPGs to Immich (batch upload)...", len(items))
+
+	tags := []string{"camera-original"}
+	_, failed := uploadStaged(cfg, im, items, tags, "camera JPGs", "camera-jpgs-*")
+	manifest.uploaded(items, failed, "camera-jpg")
+	markFavorites(cfg, items, failed, tags, verbose)
+	setVisibility(cfg, items, failed, category, verbose)
+	recordOriginalNames(cfg, items, failed, verbose)
+
+	failedPaths := make(map[string]bool, len(failed))
+	for _, item := range failed {
+		failedPaths[item.path] = true
+		recordFailure(cfg, appState, item.source, "upload", item.err)
+	}
+
+	var uploaded []uploadItem
+	for _, item := range items {
+		if failedPaths[item.path] {
+			continue
+		}
+		appState.MarkUploaded(item.source.StateKey())
+		uploaded = append(uploaded, item)
+	}
+	summary.Uploaded += len(uploaded)
+	return uploaded
+}
+
+// runJPGOnlyMode handles the workflow when RAW processing is disabled (JPG upload only)
+func runJPGOnlyMode(cfg *config.Config, appState *state.State, scanResult *scanner.ScanResult, im *uploader.Immich, verbose bool) error {
+	logInfo("RAW processing disabled - uploading JPG files only")
+	
+	// Filter unprocessed JPG files
+	newJPGFiles := selectNewFiles(cfg, appState, scanResult.JPGFiles)
+
+	if len(newJPGFiles) == 0 {
+		logSuccess("No new JPG files to upload!")
+		return nil
+	}
+
+	logInfo("%d new JPG files to upload", len(newJPGFiles))
+
+	if needsMetadata(cfg) {
+		scanner.LoadMetadata(newJPGFiles)
+	}
+
+	if cfg.DryRun {
+		logInfo("DRY RUN - Would upload the following files:")
+		for _, f := range newJPGFiles {
+			fmt.Fprintf(logOut, "  - %s\n", f.Name)
+		}
+		return nil
+	}
+
+	// Upload JPG files
+	logStep("Uploading %d JPG files to Immich...", len(newJPGFiles))
+	
+	tags := []string{"camera-original"}
+	uploadedCount := 0
+	var uploadedFiles []scanner.FileInfo
+
+	for i, jpgFile := range newJPGFiles {
+		if verbose {
+			logStep("[%d/%d] Uploading %s...", i+1, len(newJPGFiles), jpgFile.Name)
+		}
+
+		if err := im.WithAlbum(albumFor(cfg, jpgFile)).UploadFile(jpgFile.Path, tags); err != nil {
+			logError("Failed to upload %s: %v", jpgFile.Name, err)
+			recordFailure(cfg, appState, jpgFile, "upload", err)
+			continue
+		}
+
+		uploadedCount++
+		summary.Uploaded++
+		summary.addToAlbum(albumFor(cfg, jpgFile), 1)
+		uploadedFiles = append(uploadedFiles, jpgFile)
+		manifest.uploaded([]uploadItem{{path: jpgFile.Path, source: jpgFile}}, nil, "jpg-only")
+		if verbose {
+			logSuccess("Uploaded: %s", jpgFile.Name)
+		}
+
+		// Mark as processed (use "jpg-only" as profile name)
+		appState.MarkProcessed(jpgFile.StateKey(), "jpg-only", "")
+		appState.MarkUploaded(jpgFile.StateKey())
+		appState.UpdateWatermark(appState.CardID, jpgFile.ModTime, jpgFile.Sequence())
+	}
+
+	// Save state
+	if err := appState.Save(); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+
+	if cfg.FavoriteIf != nil || cfg.UploadVisibility[config.UploadJPGOnly] != "" || cfg.OriginalName != "" {
+		items := make([]uploadItem, len(uploadedFiles))
+		for i, f := range uploadedFiles {
+			items[i] = uploadItem{path: f.Path, source: f}
+		}
+		markFavorites(cfg, items, nil, tags, verbose)
+		setVisibility(cfg, items, nil, config.UploadJPGOnly, verbose)
+		recordOriginalNames(cfg, items, nil, verbose)
+	}
+
+	if cfg.OrientationReport {
+		logOrientationReport(uploadedFiles)
+	}
+
+	logSuccess("Done! Uploaded %d JPG files.", uploadedCount)
+	
+	return nil
+}
+
+// nextChunk returns the first resumeChunk of the sorted new files that come after the card's
+// bookmark in sort_order, and moves the bookmark to the last of them
+// Files before the bookmark that are still new (e.g. failed ones) are left for a normal run.
+func nextChunk(cfg *config.Config, appState *state.State, allFiles, newFiles []scanner.FileInfo) []scanner.FileInfo {
+	ordered := append([]scanner.FileInfo(nil), allFiles...)
+	sortFiles(cfg, ordered)
+	position := make(map[string]int, len(ordered))
+	for i, f := range ordered {
+		position[f.StateKey()] = i
+	}
+
+	after := -1
+	if bookmark := appState.GetBookmark(appState.CardID); bookmark != "" {
+		if i, ok := position[bookmark]; ok {
+			after = i
+			logInfo("Resuming after %s (file %d of %d on the card)", bookmark, i+1, len(ordered))
+		} else {
+			logInfo("Bookmarked file %s is no longer on the card, starting from the beginning", bookmark)
+		}
+	}
+
+	var chunk []scanner.FileInfo
+	for _, f := range newFiles {
+		if position[f.StateKey()] > after {
+			chunk = append(chunk, f)
+		}
+	}
+	summary.skip(skipBeforeBookmark, len(newFiles)-len(chunk))
+	if len(chunk) > resumeChunk {
+		summary.skip(skipOverLimit, len(chunk)-resumeChunk)
+		chunk = chunk[:resumeChunk]
+	}
+	if len(chunk) > 0 {
+		last := chunk[len(chunk)-1].StateKey()
+		appState.SetBookmark(appState.CardID, last)
+		logInfo("Processing a chunk of %d files, the bookmark moves to %s", len(chunk), last)
+	}
+	return chunk
+}
+
+// Reasons files are skipped, tallied in the run summary
+const (
+	skipAlreadyProcessed = "already processed"
+	skipOnServer         = "already on server"
+	skipNotNewer         = "not newer than watermark"
+	skipExcluded         = "excluded by pattern"
+	skipOverLimit        = "over limit"
+	skipBeforeBookmark   = "before bookmark"
+	skipIncomplete       = "possibly incomplete"
+	skipBracket          = "bracket exposure"
+	skipLowResolution    = "below min_megapixels"
+	skipDuplicateName    = "same path in another scan root"
+)
+
+// runSummary is the outcome of a run, shown at the end and printed with --json
+type runSummary struct {
+	Mode          string                  `json:"mode"`
+	Processed     int                     `json:"processed"`
+	Uploaded      int                     `json:"uploaded"`
+	Failed        int                     `json:"failed"`
+	FailedUploads int                     `json:"failed_uploads"`
+	Skipped       map[string]int          `json:"skipped"`            // Reason -> number of files
+	Warnings      map[string][]string     `json:"warnings,omitempty"` // File -> rawtherapee-cli warnings of files processed anyway
+	Albums        map[string]*albumReport `json:"albums,omitempty"`   // Album -> files uploaded into it
+	State         *stateDelta             `json:"state,omitempty"`
+	Error         string                  `json:"error,omitempty"`
+}
+
+// albumReport tells how many files a run uploaded into an album
+type albumReport struct {
+	Uploaded   int `json:"uploaded"`              // Files uploaded into the album by this run
+	AssetCount int `json:"asset_count,omitempty"` // Assets in the album on the server after the run (0 = unknown)
+}
+
+// stateDelta describes how the processed files list of the state changed during a run
+type stateDelta struct {
+	Before  int `json:"before"`  // Entries when the state was loaded
+	After   int `json:"after"`   // Entries at the end of the run
+	Added   int `json:"added"`   // Files processed or uploaded for the first time
+	Removed int `json:"removed"` // Entries of files no longer on the card
+
+	names map[string]bool // Entries when the state was loaded
+}
+
+// newStateDelta records the processed files of a freshly loaded state
+func newStateDelta(appState *state.State) *stateDelta {
+	names := appState.GetProcessedFilesMap()
+	return &stateDelta{Before: len(names), names: names}
+}
+
+// finish records the processed files at the end of the run
+func (d *stateDelta) finish(appState *state.State) {
+	d.After = appState.GetProcessedCount()
+	d.Added = 0
+	for name := range appState.GetProcessedFilesMap() {
+		if !d.names[name] {
+			d.Added++
+		}
+	}
+}
+
+// String formats the delta, e.g. "1200 -> 1230 entries (+35 new, -5 no longer on card)"
+func (d *stateDelta) String() string {
+	return fmt.Sprintf("%d -> %d entries (+%d new, -%d no longer on card)", d.Before, d.After, d.Added, d.Removed)
+}
+
+// skip adds n files to the tally of a skip reason
+func (s *runSummary) skip(reason string, n int) {
+	if n > 0 {
+		s.Skipped[reason] += n
+	}
+}
+
+// warn records the rawtherapee-cli warnings of a file that was processed anyway
+func (s *runSummary) warn(name string, warnings []string) {
+	if s.Warnings == nil {
+		s.Warnings = make(map[string][]string)
+	}
+	s.Warnings[name] = append(s.Warnings[name], warnings...)
+}
+
+// addToAlbum records n files uploaded into an album (nothing for uploads without album)
+func (s *runSummary) addToAlbum(album string, n int) {
+	if album == "" || n == 0 {
+		return
+	}
+	if s.Albums == nil {
+		s.Albums = make(map[string]*albumReport)
+	}
+	if s.Albums[album] == nil {
+		s.Albums[album] = &albumReport{}
+	}
+	s.Albums[album].Uploaded += n
+}
+
+// skippedText formats the skip tally, most frequent reason first
+// (e.g. "12 already processed, 3 excluded by pattern")
+func (s *runSummary) skippedText() string {
+	reasons := make([]string, 0, len(s.Skipped))
+	for reason := range s.Skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if s.Skipped[reasons[i]] != s.Skipped[reasons[j]] {
+			return s.Skipped[reasons[i]] > s.Skipped[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%d %s", s.Skipped[reason], reason)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// printJSONSummary writes the run summary as JSON to stdout
+func printJSONSummary(runErr error) {
+	if runErr != nil {
+		summary.Error = runErr.Error()
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		logError("Failed to marshal summary: %v", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// metricsPrefix is the prefix of all exported Prometheus metrics
+const metricsPrefix = "camera_to_immich_"
+
+// writeMetricsFile writes the run summary as Prometheus metrics in the text exposition
+// format, for the node_exporter textfile collector. Counters are carried over from the
+// previous file so they accumulate across runs.
+func writeMetricsFile(path string, runErr error, duration time.Duration) error {
+	totals := readMetricsFile(path)
+	totals["files_processed_total"] += float64(summary.Processed)
+	totals["files_uploaded_total"] += float64(summary.Uploaded)
+	totals["failures_total"] += float64(summary.Failed)
+	totals["upload_failures_total"] += float64(summary.FailedUploads)
+
+	success := 1
+	if runErr != nil {
+		success = 0
+	}
+
+	var b strings.Builder
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n", metricsPrefix, name, help)
+		fmt.Fprintf(&b, "# TYPE %s%s %s\n", metricsPrefix, name, kind)
+		fmt.Fprintf(&b, "%s%s %g\n", metricsPrefix, name, value)
+	}
+	metric("files_processed_total", "counter", "RAW files processed.", totals["files_processed_total"])
+	metric("files_uploaded_total", "counter", "Files uploaded to Immich.", totals["files_uploaded_total"])
+	metric("failures_total", "counter", "Files that failed to process or upload.", totals["failures_total"])
+	metric("upload_failures_total", "counter", "Files that failed to upload.", totals["upload_failures_total"])
+	metric("last_run_duration_seconds", "gauge", "Duration of the last run.", duration.Seconds())
+	metric("last_run_timestamp_seconds", "gauge", "Unix time the last run finished.", float64(time.Now().Unix()))
+	metric("last_run_success", "gauge", "Whether the last run finished without an error.", float64(success))
+
+	// Write to a temp file and rename it, so the collector never reads a partial file
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readMetricsFile returns the values of the metrics in a previously written metrics file,
+// keyed by name without the prefix (empty if the file doesn't exist)
+func readMetricsFile(path string) map[string]float64 {
+	values := make(map[string]float64)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], metricsPrefix) {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			values[strings.TrimPrefix(fields[0], metricsPrefix)] = value
+		}
+	}
+	return values
+}
+
+// manifestEntry is the result of one file in the run manifest
+type manifestEntry struct {
+	source   string
+	output   string
+	profile  string
+	status   string // "processed", "kept", "camera-jpg", "jpg-only" or "failed"
+	size     int64  // Size of the output (or uploaded file) in bytes
+	duration time.Duration
+	uploaded bool
+	err      string
+}
+
+// runManifest collects the per-file results of a run in the order files were first seen
+type runManifest struct {
+	path    string // File the manifest is written to ("" = disabled)
+	order   []string
+	entries map[string]*manifestEntry
+}
+
+// entry returns the manifest entry of a card file, creating it on first use
+func (m *runManifest) entry(f scanner.FileInfo) *manifestEntry {
+	if e, ok := m.entries[f.Path]; ok {
+		return e
+	}
+	e := &manifestEntry{source: f.Path}
+	m.entries[f.Path] = e
+	m.order = append(m.order, f.Path)
+	return e
+}
+
+// uploaded records the files of an upload that weren't returned as failed; files without
+// a status yet (uploaded as they are) get the given one
+func (m *runManifest) uploaded(items, failed []uploadItem, status string) {
+	failedPaths := make(map[string]bool, len(failed))
+	for _, item := range failed {
+		failedPaths[item.path] = true
+	}
+
+	for _, item := range items {
+		e := m.entry(item.source)
+		if e.status == "" {
+			e.status = status
+			e.output = item.path
+			if info, err := os.Stat(item.path); err == nil {
+				e.size = info.Size()
+			}
+		}
+		if !failedPaths[item.path] {
+			e.uploaded = true
+		}
+	}
+	m.flush()
+}
+
+// fail records the failure of a file; upload failures keep the processing status
+func (m *runManifest) fail(f scanner.FileInfo, stage string, err error) {
+	e := m.entry(f)
+	if stage != "upload" || e.status == "" {
+		e.status = "failed"
+	}
+	// Keep each error on a single line; tool output often spans several
+	e.err = stage + ": " + strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// manifestPath returns manifest_path with "{timestamp}" replaced by the start time of the
+// run, or "" if the manifest is disabled
+func manifestPath(cfg *config.Config, start time.Time) string {
+	if cfg.ManifestPath == "" {
+		return ""
+	}
+	return strings.ReplaceAll(cfg.ManifestPath, "{timestamp}", start.Format("20060102-150405"))
+}
+
+// flush rewrites the manifest file with the results so far, so a run that crashes or is
+// killed still leaves a manifest of the files it got through
+func (m *runManifest) flush() {
+	if m.path == "" {
+		return
+	}
+	if err := m.write(m.path); err != nil {
+		logError("Failed to write manifest: %v", err)
+	}
+}
+
+// writeManifestFile writes the final manifest of the run
+func writeManifestFile() {
+	if manifest.path == "" {
+		return
+	}
+
+	if err := manifest.write(manifest.path); err != nil {
+		logError("Failed to write manifest: %v", err)
+		return
+	}
+	logInfo("Manifest of %d files written to %s", len(manifest.order), manifest.path)
+}
+
+// write saves the manifest as a CSV file, through a temp file so an interrupted write
+// never leaves a truncated manifest behind
+func (m *runManifest) write(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"source", "output", "profile", "status", "size_bytes", "duration_seconds", "uploaded", "error"})
+	for _, source := range m.order {
+		e := m.entries[source]
+		uploaded := "no"
+		if e.uploaded {
+			uploaded = "yes"
+		}
+		w.Write([]string{
+			e.source,
+			e.output,
+			e.profile,
+			e.status,
+			strconv.FormatInt(e.size, 10),
+			strconv.FormatFloat(e.duration.Seconds(), 'f', 1, 64),
+			uploaded,
+			e.err,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// shareWithPartner makes sure the library is shared with the configured partner account
+func shareWithPartner(cfg *config.Config) {
+	api := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey)
+
+	user, err := api.FindUserByEmail(cfg.ShareWithPartner)
+	if err != nil {
+		logError("Failed to share with partner: %v", err)
+		return
+	}
+
+	added, err := api.SharePartner(user.ID)
+	if err != nil {
+		logError("Failed to share with partner %s: %v", user.Email, err)
+		return
+	}
+	if added {
+		logSuccess("Shared library with partner %s", user.Email)
+	}
+}
+
+// reportAlbums logs how many files the run uploaded into each album, along with the
+// album's asset count on the server to confirm the files landed there
+func reportAlbums(cfg *config.Config) {
+	if len(summary.Albums) == 0 {
+		return
+	}
+
+	counts := make(map[string]int)
+	albums, err := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey).Albums()
+	if err != nil {
+		logError("Failed to look up the albums on the server: %v", err)
+	}
+	for _, album := range albums {
+		counts[album.AlbumName] += album.AssetCount
+	}
+
+	names := make([]string, 0, len(summary.Albums))
+	for name := range summary.Albums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	logStep("Albums:")
+	for _, name := range names {
+		report := summary.Albums[name]
+		count, found := counts[name]
+		switch {
+		case err != nil:
+			logInfo("  %s: %d files uploaded", name, report.Uploaded)
+		case !found:
+			logError("  %s: %d files uploaded, but the server has no album with that name", name, report.Uploaded)
+		default:
+			report.AssetCount = count
+			logSuccess("  %s: %d files uploaded (%d assets in the album)", name, report.Uploaded, count)
+		}
+	}
+}
+
+// normalizeOrientation makes a processed JPG display with the same orientation as the
+// camera JPG of the same shot, so the pair doesn't look mismatched next to each other
+func normalizeOrientation(outputPath, cameraJPGPath string) error {
+	processed, err := processor.ReadJPEGOrientation(outputPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filepath.Base(outputPath), err)
+	}
+	camera, err := processor.ReadJPEGOrientation(cameraJPGPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filepath.Base(cameraJPGPath), err)
+	}
+
+	// Without an orientation on the camera JPG there is nothing to match
+	if camera.Orientation == 0 || processed.Portrait() == camera.Portrait() {
+		return nil
+	}
+
+	// Same pixel layout as the camera JPG, so the processed file only lacks its rotation tag
+	if (processed.Height > processed.Width) == (camera.Height > camera.Width) {
+		if err := processor.SetJPEGOrientation(outputPath, camera.Orientation); err != nil {
+			return err
+		}
+		logInfo("Set orientation of %s to match %s", filepath.Base(outputPath), filepath.Base(cameraJPGPath))
+		return nil
+	}
+
+	return fmt.Errorf("%s and %s display with different orientations", filepath.Base(outputPath), filepath.Base(cameraJPGPath))
+}
+
+// compareEXIF returns the EXIF fields of a RAW file that are missing or different in its
+// processed JPG
+func compareEXIF(rawPath, outputPath string) ([]string, error) {
+	original, err := exif.ReadFile(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RAW EXIF: %v", err)
+	}
+	processed, err := exif.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JPG EXIF: %v", err)
+	}
+	return exif.LostFields(original, processed), nil
+}
+
+// dimensionTolerance is how far the size of a processed JPG may be off the size expected
+// from its RAW file, as RAW sizes include sensor margins RawTherapee may not keep
+const dimensionTolerance = 0.05
+
+// checkDimensions compares the size of a processed JPG with the size expected from the
+// EXIF size of its RAW file and the profile's resize settings (verify_dimensions)
+// Returns a description of the mismatch, or "" if the size matches or can't be predicted.
+func checkDimensions(rt *processor.RawTherapee, rawFile scanner.FileInfo, outputPath string) (string, error) {
+	meta := rawFile.Meta
+	if meta == nil {
+		var err error
+		if meta, err = exif.ReadFile(rawFile.Path); err != nil {
+			return "", fmt.Errorf("failed to read RAW EXIF: %v", err)
+		}
+	}
+	if meta.Width == 0 || meta.Height == 0 {
+		return "", nil
+	}
+
+	// Resize settings apply to the rotated image
+	width, height := meta.Width, meta.Height
+	if meta.Orientation >= 5 {
+		width, height = height, width
+	}
+	wantWidth, wantHeight, ok := rt.ExpectedSize(width, height)
+	if !ok {
+		return "", nil
+	}
+
+	gotWidth, gotHeight, err := processor.JPEGSize(outputPath)
+	if err != nil {
+		return "", err
+	}
+
+	// Outputs may or may not have the rotation applied, so compare long and short sides
+	near := func(got, want int) bool {
+		return math.Abs(float64(got-want)) <= float64(want)*dimensionTolerance
+	}
+	if near(max(gotWidth, gotHeight), max(wantWidth, wantHeight)) && near(min(gotWidth, gotHeight), min(wantWidth, wantHeight)) {
+		return "", nil
+	}
+	return fmt.Sprintf("%dx%d, expected about %dx%d", gotWidth, gotHeight, wantWidth, wantHeight), nil
+}
+
+// needsMetadata reports whether any enabled option needs the EXIF metadata of the files
+func needsMetadata(cfg *config.Config) bool {
+	return cfg.OrientationReport || (cfg.FavoriteIf != nil && cfg.FavoriteIf.MinRating > 0) || cfg.BracketMode != "" || len(cfg.ProfileRules) > 0 || cfg.TagTimeOfDay || cfg.BurstGap != "" || cfg.PreserveFileTimes || cfg.DateAlbumFormat != ""
+}
+
+// isFavorite reports whether an uploaded file matches the favorite_if rule
+func isFavorite(cfg *config.Config, source scanner.FileInfo, tags []string) bool {
+	rule := cfg.FavoriteIf
+	if rule == nil {
+		return false
+	}
+
+	if rule.MinRating > 0 && source.Meta != nil && source.Meta.Rating >= rule.MinRating {
+		return true
+	}
+	for _, tag := range rule.Tags {
+		for _, uploadTag := range tags {
+			if strings.EqualFold(tag, uploadTag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markFavorites marks the uploaded files matching the favorite_if rule as favorites in Immich,
+// skipping failed uploads
+func markFavorites(cfg *config.Config, items, failed []uploadItem, tags []string, verbose bool) {
+	if cfg.FavoriteIf == nil || len(items) == 0 {
+		return
+	}
+
+	allTags := append(append([]string{}, cfg.ImmichTags...), tags...)
+	var favorites []uploadItem
+	for _, item := range items {
+		if isFavorite(cfg, item.source, append(allTags, itemTags(cfg, item)...)) {
+			favorites = append(favorites, item)
+		}
+	}
+	if len(favorites) == 0 {
+		return
+	}
+
+	api := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey)
+	assetIDs, err := uploadedAssets(api, favorites, failed)
+	if err != nil {
+		logError("Failed to look up the uploaded files for favorites: %v", err)
+		return
+	}
+
+	var ids []string
+	for _, item := range favorites {
+		id, ok := assetIDs[item.path]
+		if !ok {
+			continue
+		}
+		if verbose {
+			logInfo("Marking as favorite: %s", filepath.Base(item.path))
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if err := api.SetFavorite(ids, true); err != nil {
+		logError("Failed to mark favorites: %v", err)
+		return
+	}
+	logSuccess("Marked %d files as favorites", len(ids))
+}
+
+// setVisibility applies the upload_visibility of a category to the uploaded files
+// (archiving camera JPGs, say); files that failed to upload are left out
+func setVisibility(cfg *config.Config, items, failed []uploadItem, category string, verbose bool) {
+	visibility := cfg.UploadVisibility[category]
+	if visibility == "" || visibility == "timeline" || len(items) == 0 {
+		return
+	}
+
+	api := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey)
+	assetIDs, err := uploadedAssets(api, items, failed)
+	if err != nil {
+		logError("Failed to look up the uploaded %s files to set their visibility: %v", category, err)
+		return
+	}
+
+	var ids []string
+	for _, id := range assetIDs {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if err := api.SetVisibility(ids, visibility); err != nil {
+		logError("Failed to set visibility of %s files to %s: %v", category, visibility, err)
+		return
+	}
+	if verbose {
+		logInfo("Set visibility of %d %s files to %s", len(ids), category, visibility)
+	}
+}
+
+// uploadedAssets returns the server asset IDs of the items that were uploaded, keyed by
+// item path. immich-go doesn't report the IDs of the assets it creates; looking them up by
+// SHA-1 checksum finds exactly the uploaded files, where the file name would also find older
+// shots of the same name and the other files of the shot.
+func uploadedAssets(api *uploader.API, items, failed []uploadItem) (map[string]string, error) {
+	failedPaths := make(map[string]bool, len(failed))
+	for _, item := range failed {
+		failedPaths[item.path] = true
+	}
+
+	checksums := make(map[string]string, len(items))
+	for _, item := range items {
+		if failedPaths[item.path] {
+			continue
+		}
+		sum, err := uploader.SHA1File(item.path)
+		if err != nil {
+			logError("Failed to checksum %s: %v", filepath.Base(item.path), err)
+			continue
+		}
+		checksums[item.path] = sum
+	}
+	if len(checksums) == 0 {
+		return nil, nil
+	}
+	return api.AssetIDsByChecksum(checksums)
+}
+
+// originalNameTagParent is the parent tag of the camera file name tags (original_name)
+const originalNameTagParent = "original-name"
+
+// recordOriginalNames records the camera file name (without extension) of each uploaded file
+// in Immich as a tag or the asset description (original_name), skipping failed uploads
+func recordOriginalNames(cfg *config.Config, items, failed []uploadItem, verbose bool) {
+	if cfg.OriginalName == "" || len(items) == 0 {
+		return
+	}
+
+	api := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey)
+	assetIDs, err := uploadedAssets(api, items, failed)
+	if err != nil {
+		logError("Failed to look up the uploaded files to record their original names: %v", err)
+		return
+	}
+
+	recorded := 0
+	for _, item := range items {
+		id, ok := assetIDs[item.path]
+		if !ok {
+			continue
+		}
+
+		original := strings.TrimSuffix(item.source.Name, filepath.Ext(item.source.Name))
+		switch cfg.OriginalName {
+		case config.OriginalNameTag:
+			err = api.TagAssets(originalNameTagParent+"/"+original, []string{id})
+		case config.OriginalNameDescription:
+			err = api.SetDescription(id, original)
+		}
+		if err != nil {
+			logError("Failed to record the original name of %s: %v", filepath.Base(item.path), err)
+			continue
+		}
+		recorded++
+	}
+
+	if verbose && recorded > 0 {
+		logInfo("Recorded the original file name of %d assets (%s)", recorded, cfg.OriginalName)
+	}
+}
+
+// logOrientationReport prints how many of the files are portrait and landscape shots
+// and lists the files without EXIF orientation, which Immich may show sideways
+func logOrientationReport(files []scanner.FileInfo) {
+	if len(files) == 0 {
+		return
+	}
+
+	var portrait, landscape int
+	var missing []string
+	for _, f := range files {
+		isPortrait, ok := f.IsPortrait()
+		switch {
+		case !ok:
+			missing = append(missing, f.Name)
+		case isPortrait:
+			portrait++
+		default:
+			landscape++
+		}
+	}
+
+	logStep("Orientation report:")
+	fmt.Fprintf(logOut, "  Landscape: %d\n", landscape)
+	fmt.Fprintf(logOut, "  Portrait:  %d\n", portrait)
+	if len(missing) > 0 {
+		logError("%d files have no orientation metadata:", len(missing))
+		for _, name := range missing {
+			fmt.Fprintf(logOut, "  - %s\n", name)
+		}
+	}
+}
+
+// uploadItem is a file queued for upload together with the card file it originates from
+type uploadItem struct {
+	path   string
+	source scanner.FileInfo
+	tags   []string // Tags for this file only, added to the tags of the upload
+	keep   bool     // Existing output that must not be cleaned up
+	err    error    // Set on items returned as failed by uploadStaged
+}
+
+// albumFor returns the Immich album a card file should be uploaded into
+func albumFor(cfg *config.Config, source scanner.FileInfo) string {
+	if album := cfg.AlbumFromPath(path.Join(source.RelDir, source.Name)); album != "" {
+		return album
+	}
+	if cfg.AlbumFromFolder {
+		if folder := source.FolderAt(cfg.AlbumFolderDepth); folder != "" {
+			return folder
+		}
+	}
+	if cfg.DateAlbumFormat != "" {
+		// The capture time dates the shot; the file time can be off (e.g. after editing
+		// in camera or copying)
+		if source.Meta != nil && !source.Meta.DateTimeOriginal.IsZero() {
+			return cfg.AlbumCaptureDate(source.Meta.DateTimeOriginal).Format(cfg.DateAlbumFormat)
+		}
+		return cfg.AlbumDate(time.Unix(source.ModTime, 0)).Format(cfg.DateAlbumFormat)
+	}
+	return cfg.ImmichAlbum
+}
+
+// itemTags returns the tags of a single file: its own tags plus, with tag_from_folder,
+// the name of the card folder it is in and, with tag_time_of_day, its time of day
+func itemTags(cfg *config.Config, item uploadItem) []string {
+	tags := item.tags
+	if cfg.TagFromFolder && item.source.RelDir != "" {
+		tags = append(append([]string{}, tags...), path.Base(item.source.RelDir))
+	}
+	if cfg.TagTimeOfDay {
+		tags = append(append([]string{}, tags...), timeOfDay(cfg, item.source))
+	}
+	return tags
+}
+
+// timeOfDay returns the time-of-day tag of a file by its EXIF capture time, or its file
+// time in the configured time zone: "morning" (5-11h), "midday" (11-17h), "evening"
+// (17-21h) or "night"
+func timeOfDay(cfg *config.Config, source scanner.FileInfo) string {
+	var hour int
+	if source.Meta != nil && !source.Meta.DateTimeOriginal.IsZero() {
+		// The capture time is the camera's wall clock already
+		hour = source.Meta.DateTimeOriginal.Hour()
+	} else {
+		t := time.Unix(source.ModTime, 0).Local()
+		if cfg.Timezone != "" {
+			if loc, err := time.LoadLocation(cfg.Timezone); err == nil {
+				t = t.In(loc)
+			}
+		}
+		hour = t.Hour()
+	}
+
+	switch {
+	case hour >= 5 && hour < 11:
+		return "morning"
+	case hour >= 11 && hour < 17:
+		return "midday"
+	case hour >= 17 && hour < 21:
+		return "evening"
+	default:
+		return "night"
 	}
+}
 
-	rt, err := processor.NewRawTherapee(rtConfig)
-	if err != nil {
-		return fmt.Errorf("failed to initialize RawTherapee: %v", err)
+// uploadStaged copies the files into temp directories (one per album and set of per-file
+// tags, split further into batches bounded by upload_batch_files/upload_batch_mb) and uploads
+// each directory with a single immich-go call. Returns the time spent uploading and the items
+// that could not be uploaded.
+func uploadStaged(cfg *config.Config, im *uploader.Immich, items []uploadItem, tags []string, what, tempPattern string) (time.Duration, []uploadItem) {
+	// Bucket files by their target album and their own tags, as each immich-go call uploads
+	// into one album with one set of tags
+	groups := make(map[string][]uploadItem)
+	albums := make(map[string]bool)
+	for _, item := range items {
+		album := albumFor(cfg, item.source)
+		key := album + "\x00" + strings.Join(itemTags(cfg, item), ",")
+		groups[key] = append(groups[key], item)
+		albums[album] = true
 	}
 
-	profileName := rt.GetProfileName()
-	logSuccess("Using profile: %s", profileName)
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	// Process and upload files
-	var processedJPGs []string
-	var cameraJPGs []string
+	var totalUploadTime time.Duration
+	var failed []uploadItem
+	for _, key := range keys {
+		album := albumFor(cfg, groups[key][0].source)
+		groupTags := append(append([]string{}, tags...), itemTags(cfg, groups[key][0])...)
 
-	var totalRawProcessingTime time.Duration
-	
-	// Determine number of workers for parallel processing
-	// Default to 4 workers max to avoid memory issues (RawTherapee uses ~1-2GB per instance)
-	// Users can override with --workers flag or config for systems with more RAM
-	const defaultMaxWorkers = 4
-	numWorkers := cfg.Workers
-	if numWorkers <= 0 {
-		numWorkers = runtime.NumCPU()
-		// Cap at default max to avoid memory exhaustion
-		if numWorkers > defaultMaxWorkers {
-			numWorkers = defaultMaxWorkers
+		batches := splitUploadBatches(groups[key], cfg.UploadBatchFiles, int64(cfg.UploadBatchMB)*1024*1024)
+		for n, batch := range batches {
+			batchWhat := what
+			if len(batches) > 1 {
+				batchWhat = fmt.Sprintf("%s (batch %d/%d)", what, n+1, len(batches))
+			}
+
+			uploadTime, batchFailed := uploadBatch(cfg, im, album, batch, groupTags, batchWhat, tempPattern, len(albums) > 1)
+			totalUploadTime += uploadTime
+			failed = append(failed, batchFailed...)
 		}
 	}
-	// Don't use more workers than files
-	if numWorkers > len(newRAWFiles) {
-		numWorkers = len(newRAWFiles)
+
+	return totalUploadTime, failed
+}
+
+// stagingWorkers is the number of files copied into an upload staging directory in parallel
+const stagingWorkers = 4
+
+// uploadBatch stages a batch of files in a temp directory and uploads it into an album,
+// retrying the whole batch on failure (immich-go skips files that already made it)
+func uploadBatch(cfg *config.Config, im *uploader.Immich, album string, batch []uploadItem, tags []string, what, tempPattern string, showAlbum bool) (time.Duration, []uploadItem) {
+	var failed []uploadItem
+
+	// Create a temp directory with ONLY the files of this batch
+	tempDir, err := os.MkdirTemp("", tempPattern)
+	if err != nil {
+		logError("Failed to create temp directory for %s: %v", what, err)
+		for _, item := range batch {
+			item.err = err
+			failed = append(failed, item)
+		}
+		return 0, failed
 	}
-	
-	logInfo("Processing %d files with %d parallel workers...", len(newRAWFiles), numWorkers)
-	if cfg.ConvertToDNG {
-		logInfo("DNG conversion enabled for camera compatibility")
+	defer os.RemoveAll(tempDir)
+
+	// Names are picked up front so the files can be staged in parallel. The workers rely
+	// on every item having a destination of its own, whatever rename_on_upload says: two
+	// items with the same name (e.g. from different DCF folders) would otherwise race for
+	// one path. Names are compared case-insensitively, as the temp directory usually is.
+	destPaths := make([]string, len(batch))
+	taken := make(map[string]bool, len(batch))
+	for i, item := range batch {
+		destPath := uniquePath(filepath.Join(tempDir, uploadName(cfg, item)), taken)
+		taken[strings.ToLower(destPath)] = true
+		destPaths[i] = destPath
 	}
-	
-	// Define result structure for processed files
-	type processResult struct {
-		index      int
-		rawFile    scanner.FileInfo
-		outputPath string
-		dngPath    string // Path to intermediate DNG file (if conversion was used)
-		elapsed    time.Duration
-		err        error
+
+	copyStart := time.Now()
+	stageErrs := make([]error, len(batch))
+	indexes := make(chan int, len(batch))
+	for i := range batch {
+		indexes <- i
 	}
-	
-	// Create channels for job distribution and results
-	jobs := make(chan struct {
-		index   int
-		rawFile scanner.FileInfo
-	}, len(newRAWFiles))
-	results := make(chan processResult, len(newRAWFiles))
-	
-	// Start worker goroutines
+	close(indexes)
 	var wg sync.WaitGroup
-	for w := 0; w < numWorkers; w++ {
+	for w := 0; w < stagingWorkers && w < len(batch); w++ {
 		wg.Add(1)
-		go func(workerID int) {
+		go func() {
 			defer wg.Done()
-			for job := range jobs {
-				rtStart := time.Now()
-				var inputPath string
-				var dngPath string
-				var err error
-				
-				// Convert to DNG first if enabled
-				if dngConverter != nil {
-					dngPath, err = dngConverter.ConvertFile(job.rawFile.Path)
-					if err != nil {
-						results <- processResult{
-							index:   job.index,
-							rawFile: job.rawFile,
-							elapsed: time.Since(rtStart),
-							err:     fmt.Errorf("DNG conversion failed: %v", err),
-						}
-						continue
-					}
-					inputPath = dngPath
-				} else {
-					inputPath = job.rawFile.Path
-				}
-				
-				// Process with RawTherapee
-				outputPath, err := rt.ProcessFile(inputPath)
-				rtElapsed := time.Since(rtStart)
-				
-				results <- processResult{
-					index:      job.index,
-					rawFile:    job.rawFile,
-					outputPath: outputPath,
-					dngPath:    dngPath,
-					elapsed:    rtElapsed,
-					err:        err,
-				}
+			for i := range indexes {
+				stageErrs[i] = stageFile(cfg, batch[i].path, destPaths[i])
 			}
-		}(w)
-	}
-	
-	// Send jobs to workers
-	for i, rawFile := range newRAWFiles {
-		jobs <- struct {
-			index   int
-			rawFile scanner.FileInfo
-		}{index: i, rawFile: rawFile}
+		}()
 	}
-	close(jobs)
-	
-	// Wait for all workers to complete in a separate goroutine, then close results
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
-	
-	// Collect results
-	processedCount := 0
-	for result := range results {
-		processedCount++
-		totalRawProcessingTime += result.elapsed
-		
-		if result.err != nil {
-			logError("[%d/%d] Failed to process %s: %v", processedCount, len(newRAWFiles), result.rawFile.Name, result.err)
+	wg.Wait()
+
+	var staged []uploadItem
+	for i, item := range batch {
+		if err := stageErrs[i]; err != nil {
+			logError("Failed to copy %s: %v", filepath.Base(item.path), err)
+			item.err = err
+			failed = append(failed, item)
 			continue
 		}
+		staged = append(staged, item)
+	}
+	logTiming(fmt.Sprintf("Stage %s in temp", what), copyStart)
 
-		processedJPGs = append(processedJPGs, result.outputPath)
-		
-		// Track DNG files for cleanup
-		if result.dngPath != "" {
-			dngFilesToCleanup = append(dngFilesToCleanup, result.dngPath)
+	// Upload the temp directory at once
+	uploadStart := time.Now()
+	for attempt := 0; ; attempt++ {
+		err = im.WithAlbum(album).UploadFolder(tempDir, tags, false)
+		if err == nil || attempt >= cfg.UploadRetries {
+			break
 		}
-		
-		logSuccess("[%d/%d] Created: %s (%.1fs)", processedCount, len(newRAWFiles), filepath.Base(result.outputPath), result.elapsed.Seconds())
-
-		// Find matching camera JPG if enabled
-		if cfg.UploadCameraJPGs {
-			if matchingJPG := scanner.FindMatchingJPG(result.rawFile, scanResult.JPGFiles); matchingJPG != nil {
-				cameraJPGs = append(cameraJPGs, matchingJPG.Path)
-				if verbose {
-					logInfo("Found matching camera JPG: %s", matchingJPG.Name)
-				}
-			}
+		delay := time.Duration(attempt+1) * 5 * time.Second
+		logError("Failed to upload %s, retrying in %s (%d/%d): %v", what, delay, attempt+1, cfg.UploadRetries, err)
+		time.Sleep(delay)
+	}
+	if err != nil {
+		logError("Failed to upload %s: %v", what, err)
+		for _, item := range staged {
+			item.err = err
+			failed = append(failed, item)
 		}
-
-		// Mark as processed
-		appState.MarkProcessed(result.rawFile.Name, profileName, result.outputPath)
+		return 0, failed
 	}
 
-	// Log total processing time
-	if len(processedJPGs) > 0 {
-		if cfg.ConvertToDNG {
-			logTiming(fmt.Sprintf("DNG conversion + RawTherapee processing (%d files)", len(processedJPGs)), time.Now().Add(-totalRawProcessingTime))
-		} else {
-			logTiming(fmt.Sprintf("RawTherapee processing (%d files)", len(processedJPGs)), time.Now().Add(-totalRawProcessingTime))
-		}
+	uploadElapsed := time.Since(uploadStart)
+	summary.addToAlbum(album, len(staged))
+	if album != "" && showAlbum {
+		logSuccess("Uploaded %d %s into album '%s' (%.1fs)", len(staged), what, album, uploadElapsed.Seconds())
+	} else {
+		logSuccess("Uploaded %d %s (%.1fs)", len(staged), what, uploadElapsed.Seconds())
 	}
 
-	// Upload processed JPGs (unless skip-upload is enabled)
-	var totalUploadTime time.Duration
-	
-	if cfg.SkipUpload {
-		logInfo("Upload skipped (--skip-upload flag)")
-	} else if len(processedJPGs) > 0 {
-		logStep("Uploading %d processed JPGs to Immich (batch upload)...", len(processedJPGs))
-		
-		// Build tags for processed files
-		var tags []string
-		if cfg.TagWithProfileName {
-			tags = append(tags, fmt.Sprintf("profile:%s", profileName))
+	return uploadElapsed, failed
+}
+
+// splitUploadBatches splits files into batches of at most maxFiles files and maxBytes
+// bytes (0 = no limit). A single file larger than maxBytes gets a batch of its own.
+func splitUploadBatches(items []uploadItem, maxFiles int, maxBytes int64) [][]uploadItem {
+	var batches [][]uploadItem
+	var current []uploadItem
+	var currentBytes int64
+
+	for _, item := range items {
+		var size int64
+		if info, err := os.Stat(item.path); err == nil {
+			size = info.Size()
 		}
-		tags = append(tags, "processed")
 
-		// Create a temp directory with ONLY the newly processed files for faster upload
-		tempDir, err := os.MkdirTemp("", "processed-jpgs-*")
-		if err != nil {
-			logError("Failed to create temp directory for processed JPGs: %v", err)
-		} else {
-			defer os.RemoveAll(tempDir)
-			
-			// Copy only the newly processed JPGs to temp directory
-			copyStart := time.Now()
-			for _, jpgPath := range processedJPGs {
-				destPath := filepath.Join(tempDir, filepath.Base(jpgPath))
-				if err := copyFileSimple(jpgPath, destPath); err != nil {
-					logError("Failed to copy %s: %v", filepath.Base(jpgPath), err)
-				}
-			}
-			logTiming("Copy processed files to temp", copyStart)
-			
-			// Upload the temp directory at once
-			uploadStart := time.Now()
-			if err := im.UploadFolder(tempDir, tags, false); err != nil {
-				logError("Failed to upload processed files: %v", err)
-			} else {
-				uploadElapsed := time.Since(uploadStart)
-				totalUploadTime += uploadElapsed
-				logSuccess("Uploaded %d processed JPGs (%.1fs)", len(processedJPGs), uploadElapsed.Seconds())
-			}
+		full := maxFiles > 0 && len(current) >= maxFiles
+		tooBig := maxBytes > 0 && currentBytes+size > maxBytes
+		if len(current) > 0 && (full || tooBig) {
+			batches = append(batches, current)
+			current = nil
+			currentBytes = 0
 		}
+
+		current = append(current, item)
+		currentBytes += size
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
 	}
 
-	// Upload camera JPGs (unless skip-upload is enabled)
-	if !cfg.SkipUpload && len(cameraJPGs) > 0 && cfg.UploadCameraJPGs {
-		logStep("Uploading %d camera JPGs to Immich (batch upload)...", len(cameraJPGs))
-		
-		tags := []string{"camera-original"}
+	return batches
+}
 
-		// Create a temp directory and copy camera JPGs there for batch upload
-		tempDir, err := os.MkdirTemp("", "camera-jpgs-*")
-		if err != nil {
-			logError("Failed to create temp directory for camera JPGs: %v", err)
-		} else {
-			defer os.RemoveAll(tempDir)
-			
-			// Copy camera JPGs to temp directory
-			copyStart := time.Now()
-			for _, jpgPath := range cameraJPGs {
-				destPath := filepath.Join(tempDir, filepath.Base(jpgPath))
-				if err := copyFileSimple(jpgPath, destPath); err != nil {
-					logError("Failed to copy %s: %v", filepath.Base(jpgPath), err)
-				}
-			}
-			logTiming("Copy camera JPGs to temp", copyStart)
-			
-			// Upload the temp directory at once
-			uploadStart := time.Now()
-			if err := im.UploadFolder(tempDir, tags, false); err != nil {
-				logError("Failed to upload camera JPGs: %v", err)
-			} else {
-				uploadElapsed := time.Since(uploadStart)
-				totalUploadTime += uploadElapsed
-				logSuccess("Uploaded %d camera JPGs (%.1fs)", len(cameraJPGs), uploadElapsed.Seconds())
-			}
-		}
+// uploadProcessed uploads processed files tagged with the profile they were processed with,
+// marks them as uploaded in the state and returns the files that were uploaded
+func uploadProcessed(cfg *config.Config, im *uploader.Immich, appState *state.State, items []uploadItem, profileName string, verbose bool) ([]uploadItem, time.Duration) {
+	logStep("Uploading %d processed JPGs to Immich (batch upload)...", len(items))
+
+	// Build tags for processed files
+	var tags []string
+	if cfg.TagWithProfileName {
+		tags = append(tags, getProfileTag(cfg.ProfileTagFormat, profileName))
 	}
+	tags = append(tags, "processed")
 
-	// Cleanup processed files after successful upload (if enabled)
-	if cfg.CleanupAfterUpload && !cfg.SkipUpload && len(processedJPGs) > 0 {
-		logStep("Cleaning up processed files from output directory...")
-		cleanupCount := 0
-		for _, jpgPath := range processedJPGs {
-			if err := os.Remove(jpgPath); err != nil {
-				logError("Failed to delete %s: %v", filepath.Base(jpgPath), err)
-			} else {
-				cleanupCount++
-			}
-		}
-		logSuccess("Deleted %d processed files", cleanupCount)
+	// Upload only the newly processed files (staged in temp directories for faster upload)
+	uploadTime, failed := uploadStaged(cfg, im, items, tags, "processed JPGs", "processed-jpgs-*")
+
+	failedPaths := make(map[string]bool)
+	for _, item := range failed {
+		failedPaths[item.path] = true
+		recordFailure(cfg, appState, item.source, "upload", item.err)
 	}
 
-	// Cleanup intermediate DNG files (if conversion was used and cleanup is enabled)
-	if cfg.ConvertToDNG && cfg.CleanupDNGFiles && len(dngFilesToCleanup) > 0 {
-		logStep("Cleaning up intermediate DNG files...")
-		dngCleanupCount := 0
-		for _, dngPath := range dngFilesToCleanup {
-			if err := os.Remove(dngPath); err != nil {
-				logError("Failed to delete DNG %s: %v", filepath.Base(dngPath), err)
-			} else {
-				dngCleanupCount++
-			}
+	var uploaded []uploadItem
+	for _, item := range items {
+		if failedPaths[item.path] {
+			continue
 		}
-		logSuccess("Deleted %d intermediate DNG files", dngCleanupCount)
+		appState.MarkUploaded(item.source.StateKey())
+		uploaded = append(uploaded, item)
 	}
-
-	// Save state
-	if err := appState.Save(); err != nil {
-		return fmt.Errorf("failed to save state: %v", err)
+	summary.Uploaded += len(uploaded)
+	manifest.uploaded(items, failed, "processed")
+	for _, item := range items {
+		if entry := manifest.entry(item.source); entry.profile == "" {
+			entry.profile = profileName
+		}
 	}
 
-	logSuccess("Done! Processed %d files.", len(processedJPGs))
-	
-	return nil
+	markFavorites(cfg, uploaded, nil, tags, verbose)
+	setVisibility(cfg, uploaded, nil, config.UploadProcessed, verbose)
+	recordOriginalNames(cfg, uploaded, nil, verbose)
+
+	return uploaded, uploadTime
 }
 
-// runJPGOnlyMode handles the workflow when RAW processing is disabled (JPG upload only)
-func runJPGOnlyMode(cfg *config.Config, appState *state.State, scanResult *scanner.ScanResult, im *uploader.Immich, verbose bool) error {
-	logInfo("RAW processing disabled - uploading JPG files only")
-	
-	// Filter unprocessed JPG files
-	processedMap := appState.GetProcessedFilesMap()
-	newJPGFiles := scanner.FilterNewFiles(scanResult.JPGFiles, processedMap)
+// cleanupOutputs deletes uploaded processed files from the output directory
+// With verify_before_cleanup, only files the server confirms to have (by checksum) are deleted.
+func cleanupOutputs(cfg *config.Config, appState *state.State, items []uploadItem) {
+	logStep("Cleaning up processed files from output directory...")
 
-	if len(newJPGFiles) == 0 {
-		logSuccess("No new JPG files to upload!")
-		return nil
+	var verified map[string]bool
+	if cfg.VerifyBeforeCleanup {
+		verified = verifyUploaded(cfg, appState, items)
 	}
 
-	logInfo("%d new JPG files to upload", len(newJPGFiles))
-
-	if cfg.DryRun {
-		logInfo("DRY RUN - Would upload the following files:")
-		for _, f := range newJPGFiles {
-			fmt.Printf("  - %s\n", f.Name)
+	cleanupCount := 0
+	keptCount := 0
+	for _, item := range items {
+		if item.keep {
+			continue
+		}
+		if verified != nil && !verified[item.path] {
+			keptCount++
+			continue
+		}
+		if err := os.Remove(item.path); err != nil {
+			logError("Failed to delete %s: %v", filepath.Base(item.path), err)
+		} else {
+			cleanupCount++
+			appState.ClearOutputPath(item.source.StateKey())
 		}
-		return nil
 	}
+	logSuccess("Deleted %d processed files", cleanupCount)
+	if keptCount > 0 {
+		logInfo("Kept %d processed files that couldn't be verified on the server", keptCount)
+	}
+}
 
-	// Upload JPG files
-	logStep("Uploading %d JPG files to Immich...", len(newJPGFiles))
-	
-	tags := []string{"camera-original"}
-	uploadedCount := 0
-
-	for i, jpgFile := range newJPGFiles {
-		if verbose {
-			logStep("[%d/%d] Uploading %s...", i+1, len(newJPGFiles), jpgFile.Name)
+// verifyUploaded asks the server which of the uploaded files it has, by SHA-1 checksum
+// Returns the verified paths; if the server can't be queried, none are. Files the server
+// doesn't have are marked as not uploaded, so the next --upload-only run uploads them again.
+func verifyUploaded(cfg *config.Config, appState *state.State, items []uploadItem) map[string]bool {
+	checksums := make(map[string]string, len(items))
+	sources := make(map[string]string, len(items))
+	for _, item := range items {
+		if item.keep {
+			continue
 		}
-
-		if err := im.UploadFile(jpgFile.Path, tags); err != nil {
-			logError("Failed to upload %s: %v", jpgFile.Name, err)
+		sum, err := uploader.SHA1File(item.path)
+		if err != nil {
+			logError("Failed to checksum %s: %v", filepath.Base(item.path), err)
 			continue
 		}
+		checksums[item.path] = sum
+		sources[item.path] = item.source.StateKey()
+	}
 
-		uploadedCount++
-		if verbose {
-			logSuccess("Uploaded: %s", jpgFile.Name)
+	verified := make(map[string]bool)
+	if len(checksums) == 0 {
+		return verified
+	}
+
+	api := uploader.NewAPI(cfg.ImmichServerURL, cfg.ImmichAPIKey)
+	existing, err := api.ExistingChecksums(checksums)
+	if err != nil {
+		logError("Failed to verify uploads on the server, keeping all processed files: %v", err)
+		return verified
+	}
+
+	for path := range checksums {
+		if existing[path] {
+			verified[path] = true
+		} else {
+			logError("%s not found on the server after upload, keeping it", filepath.Base(path))
+			appState.MarkNotUploaded(sources[path])
 		}
+	}
+	return verified
+}
 
-		// Mark as processed (use "jpg-only" as profile name)
-		appState.MarkProcessed(jpgFile.Name, "jpg-only", jpgFile.Path)
+// recordFailure tracks a failed file in the state and, if configured, in the failures CSV
+func recordFailure(cfg *config.Config, appState *state.State, f scanner.FileInfo, stage string, err error) {
+	appState.MarkFailed(f.StateKey(), stage, err)
+	summary.Failed++
+	manifest.fail(f, stage, err)
+	if stage == "upload" {
+		summary.FailedUploads++
 	}
 
-	// Save state
-	if err := appState.Save(); err != nil {
-		return fmt.Errorf("failed to save state: %v", err)
+	if cfg.FailuresCSVPath == "" {
+		return
+	}
+	if csvErr := appendFailureCSV(cfg.FailuresCSVPath, f, stage, err); csvErr != nil {
+		logError("Failed to write failures CSV: %v", csvErr)
 	}
+}
 
-	logSuccess("Done! Uploaded %d JPG files.", uploadedCount)
-	
-	return nil
+// appendFailureCSV appends a failure row to the CSV file, writing a header for new files
+func appendFailureCSV(path string, f scanner.FileInfo, stage string, failure error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	isNew := false
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		isNew = true
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if isNew {
+		w.Write([]string{"time", "file", "path", "stage", "error"})
+	}
+	// Keep each failure on a single line; tool output often spans several
+	message := strings.Join(strings.Fields(failure.Error()), " ")
+	w.Write([]string{time.Now().Format(time.RFC3339), f.Name, f.Path, stage, message})
+	w.Flush()
+
+	return w.Error()
 }
 
 // Logging helpers
 func logStep(format string, args ...interface{}) {
-	fmt.Printf("\n► "+format+"\n", args...)
+	fmt.Fprintf(logOut, "\n► "+format+"\n", args...)
 }
 
 func logSuccess(format string, args ...interface{}) {
-	fmt.Printf("  ✓ "+format+"\n", args...)
+	fmt.Fprintf(logOut, "  ✓ "+format+"\n", args...)
 }
 
 func logInfo(format string, args ...interface{}) {
-	fmt.Printf("  ℹ "+format+"\n", args...)
+	fmt.Fprintf(logOut, "  ℹ "+format+"\n", args...)
 }
 
 func logError(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	fmt.Printf("  ✗ %s\n", msg)
+	fmt.Fprintf(logOut, "  ✗ %s\n", msg)
 }
 
 func logTiming(label string, start time.Time) {
 	elapsed := time.Since(start)
-	fmt.Printf("  ⏱ %s: %.2fs\n", label, elapsed.Seconds())
+	fmt.Fprintf(logOut, "  ⏱ %s: %.2fs\n", label, elapsed.Seconds())
+}
+
+// preserveFileTimes sets the modification time of the outputs of a source file ("" paths are
+// skipped) to when it was shot: its EXIF capture time, which is the camera's wall clock in
+// the configured time zone, or else its file time
+func preserveFileTimes(cfg *config.Config, source scanner.FileInfo, outputs []string) error {
+	shot := time.Unix(source.ModTime, 0)
+	if source.Meta != nil && !source.Meta.DateTimeOriginal.IsZero() {
+		loc := time.Local
+		if cfg.Timezone != "" {
+			if tz, err := time.LoadLocation(cfg.Timezone); err == nil {
+				loc = tz
+			}
+		}
+		c := source.Meta.DateTimeOriginal
+		shot = time.Date(c.Year(), c.Month(), c.Day(), c.Hour(), c.Minute(), c.Second(), c.Nanosecond(), loc)
+	}
+
+	for _, output := range outputs {
+		if output == "" {
+			continue
+		}
+		if err := os.Chtimes(output, shot, shot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadName returns the name a file is uploaded with: its own or, with rename_on_upload,
+// the template filled in from the capture time (falling back to the file time) and the
+// original name
+func uploadName(cfg *config.Config, item uploadItem) string {
+	name := filepath.Base(item.path)
+	if cfg.RenameOnUpload == "" {
+		return name
+	}
+
+	var captured time.Time
+	if meta, err := exif.ReadFile(item.path); err == nil {
+		captured = meta.DateTimeOriginal
+	}
+	if captured.IsZero() && item.source.Meta != nil {
+		captured = item.source.Meta.DateTimeOriginal
+	}
+	if captured.IsZero() {
+		captured = time.Unix(item.source.ModTime, 0)
+	}
+
+	ext := filepath.Ext(name)
+	renamed := strings.NewReplacer(
+		"{date}", captured.Format("2006-01-02"),
+		"{time}", captured.Format("150405"),
+		"{name}", strings.TrimSuffix(name, ext),
+	).Replace(cfg.RenameOnUpload)
+	return renamed + ext
+}
+
+// uniquePath returns path or, if it is taken, the first of path-2, path-3, ... that isn't
+// (e.g. for shots taken within the same second); taken holds lower-cased paths
+func uniquePath(path string, taken map[string]bool) string {
+	if !taken[strings.ToLower(path)] {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+}
+
+// stageFile puts a file into an upload staging directory, as a hardlink when enabled and
+// possible (instant and using no extra space) or as a copy otherwise
+func stageFile(cfg *config.Config, src, dst string) error {
+	// Linking fails across devices and on file systems without hardlinks (e.g. FAT cards),
+	// which is exactly when a copy is needed
+	if cfg.HardlinkStaging {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+	// The copy never replaces an existing file: if dst is a link left by another item,
+	// truncating it would truncate that item's real output
+	return copyFileNew(src, dst)
 }
 
-// copyFileSimple copies a file from src to dst
+// copyFileSimple copies a file from src to dst, replacing dst if it exists
+// Copying a file onto itself is refused, as creating dst would truncate src before it is read.
 func copyFileSimple(src, dst string) error {
+	return copyFileFlags(src, dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+// copyFileNew copies a file from src to dst, failing if dst already exists
+func copyFileNew(src, dst string) error {
+	return copyFileFlags(src, dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+}
+
+// copyFileFlags copies a file from src to dst, opening dst with the given flags
+func copyFileFlags(src, dst string, flag int) error {
+	if sameFile(src, dst) {
+		return fmt.Errorf("refusing to copy %s onto itself", src)
+	}
+
 	sourceFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(dst)
+	destFile, err := os.OpenFile(dst, flag, 0644)
 	if err != nil {
 		return err
 	}
@@ -764,12 +4417,46 @@ func copyFileSimple(src, dst string) error {
 	return err
 }
 
-// getProfileTag returns a sanitized tag from the profile name
-func getProfileTag(profilePath string) string {
+// sameFile reports whether two paths refer to the same file, comparing the resolved
+// absolute paths and, if both exist, the files themselves (catching hardlinks and
+// case-insensitive file systems)
+func sameFile(a, b string) bool {
+	if resolvedA, resolvedB := resolvePath(a), resolvePath(b); resolvedA == resolvedB {
+		return true
+	}
+
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// resolvePath returns the absolute path with symlinks resolved (as far as they exist)
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// getProfileTag returns a sanitized tag from the profile name, formatted with the
+// profile_tag_format template ("{name}", "{lower}" and "{upper}" are substituted)
+func getProfileTag(format, profilePath string) string {
 	name := filepath.Base(profilePath)
 	name = strings.TrimSuffix(name, ".pp3")
 	name = strings.TrimSuffix(name, ".PP3")
 	// Replace spaces and special characters
 	name = strings.ReplaceAll(name, " ", "-")
-	return "profile:" + name
+
+	if format == "" {
+		format = config.DefaultProfileTagFormat
+	}
+	return strings.NewReplacer(
+		"{name}", name,
+		"{lower}", strings.ToLower(name),
+		"{upper}", strings.ToUpper(name),
+	).Replace(format)
 }
\ No newline at end of file
@@ -0,0 +1,64 @@
+package cmdline
+
+import (
+	"runtime"
+	"strings"
+)
+
+// MaxLength returns the longest command line to pass to an external tool, in characters
+// Windows limits command lines to 32767 characters; other systems allow much more
+// (ARG_MAX, shared with the environment), so this stays well below their usual minimum.
+func MaxLength() int {
+	if runtime.GOOS == "windows" {
+		return 32767
+	}
+	return 128 * 1024
+}
+
+// Length returns the length of the command line running program with args, counting the
+// separators and the quotes Windows adds around arguments with spaces
+func Length(program string, args []string) int {
+	n := argLength(program)
+	for _, arg := range args {
+		n += 1 + argLength(arg)
+	}
+	return n
+}
+
+// argLength returns the length of a quoted argument
+func argLength(arg string) int {
+	n := len(arg) + strings.Count(arg, `"`) // Embedded quotes are escaped
+	if arg == "" || strings.ContainsAny(arg, " \t") {
+		n += 2
+	}
+	return n
+}
+
+// Fits reports whether the command line running program with args is within MaxLength
+func Fits(program string, args []string) bool {
+	return Length(program, args) <= MaxLength()
+}
+
+// Split splits the items appended to the command line running program with args into
+// chunks that each fit within MaxLength. Returns a single chunk when everything fits;
+// an item too long on its own still gets a chunk of its own.
+func Split(program string, args []string, items []string) [][]string {
+	base := Length(program, args)
+	var chunks [][]string
+	var current []string
+	length := base
+	for _, item := range items {
+		itemLength := 1 + argLength(item)
+		if len(current) > 0 && length+itemLength > MaxLength() {
+			chunks = append(chunks, current)
+			current = nil
+			length = base
+		}
+		current = append(current, item)
+		length += itemLength
+	}
+	if len(current) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
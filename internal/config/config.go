@@ -4,17 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/paths"
 )
 
 // Config represents the application configuration
 type Config struct {
+	// Config layering
+	Includes []string `json:"includes,omitempty"` // Config files merged on top of this one, e.g. per-machine overrides (relative to this file; missing files are skipped)
+
 	// Drive settings
-	DriveLabel string `json:"drive_label"` // Volume label to search for (default: "OM SYSTEM")
+	DriveLabel           string   `json:"drive_label"`             // Volume label to search for (default: "OM SYSTEM")
+	CardMinFreeMB        int      `json:"card_min_free_mb"`        // Warn when the card has less free space than this, a sign of an interrupted capture (0 = disabled)
+	SkipNewestWhenFull   bool     `json:"skip_newest_when_full"`   // When the card is below card_min_free_mb, skip the newest shot as it may be incomplete
+	SkipNewest           int      `json:"skip_newest"`             // Leave the newest N shots on the card for a later run, as they may still be being written mid-shoot (0 = disabled)
+	AutoCreateCardMarker bool     `json:"auto_create_card_marker"` // Write a .camera-to-immich-id file with a new UUID to cards without one, to identify them reliably
+	IgnoreDriveSerials   []string `json:"ignore_drive_serials"`    // Refuse to touch cards with one of these volume serials (as shown by -list-drives), e.g. someone else's card
+	ScanRoots            []string `json:"scan_roots"`              // More directories (or "label:NAME" drives) scanned with the card into one import, e.g. a staging folder
 
 	// File settings
-	RawExtensions []string `json:"raw_extensions"` // RAW file extensions to process (e.g., [".ORF", ".CR2", ".NEF", ".ARW"])
+	RawExtensions   []string `json:"raw_extensions"`   // RAW file extensions to process (e.g., [".ORF", ".CR2", ".NEF", ".ARW"])
+	AutoDetectRAW   bool     `json:"auto_detect_raw"`  // Also treat files with other extensions as RAW when their header looks like a RAW file
+	FollowSymlinks  bool     `json:"follow_symlinks"`  // Also scan directories reached through symlinks or junctions, e.g. a linked DCIM (each directory is scanned once)
+	IncludePatterns []string `json:"include_patterns"` // Only process files matching one of these globs or "re:" regexes (empty = all files)
+	ExcludePatterns []string `json:"exclude_patterns"` // Skip files matching one of these globs or "re:" regexes (wins over include_patterns)
 
 	// DNG Conversion settings (for cameras not natively supported by RawTherapee)
 	ConvertToDNG         bool   `json:"convert_to_dng"`          // Convert RAW to DNG before RawTherapee processing
@@ -23,35 +42,167 @@ type Config struct {
 	DNGCompressed        bool   `json:"dng_compressed"`          // Use compressed DNG format (smaller files)
 	DNGEmbedOriginal     bool   `json:"dng_embed_original"`      // Embed original raw in DNG (larger files)
 	CleanupDNGFiles      bool   `json:"cleanup_dng_files"`       // Delete intermediate DNG files after processing
+	DNGWaitTimeout       int    `json:"dng_wait_timeout"`        // Seconds to wait for the DNG file to be fully written (0 = default of 10)
+	DNGSettleTime        int    `json:"dng_settle_time"`         // Milliseconds the DNG file's size must stay unchanged before it is used (0 = default of 500)
+	DNGCameraRawVersion  string `json:"dng_camera_raw_version"`  // Camera Raw compatibility passed to DNG Converter as -crX.Y, e.g. "7.1" (empty = converter default)
+	DNGVersion           string `json:"dng_version"`             // DNG version passed to DNG Converter as -dngX.Y, e.g. "1.4" for older software (empty = converter default)
+
+	// External RAW decoder (generalizes the DNG step for formats neither RawTherapee nor DNG Converter handle)
+	RawDecoderCommand []string `json:"raw_decoder_command"` // Command producing a TIFF for RawTherapee; "{input}"/"{output}" are substituted, stdout is used without "{output}"
 
 	// RawTherapee settings
-	RawTherapeeExecutable string `json:"rawtherapee_executable"` // Path to rawtherapee-cli
-	PP3ProfilePath        string `json:"pp3_profile_path"`       // Path to the PP3 profile
-	JPEGQuality           int    `json:"jpeg_quality"`           // JPEG output quality (1-100)
-	OutputDirectory       string `json:"output_directory"`       // Directory for processed files
+	RawTherapeeExecutable string            `json:"rawtherapee_executable"` // Path to rawtherapee-cli
+	PP3ProfilePath        string            `json:"pp3_profile_path"`       // Path to the PP3 profile
+	ProfileRules          []ProfileRule     `json:"profile_rules"`          // Pick another PP3 profile for shots matching a rule (first match wins, pp3_profile_path otherwise)
+	JPEGQuality           int               `json:"jpeg_quality"`           // JPEG output quality (1-100)
+	OutputDirectory       string            `json:"output_directory"`       // Directory for processed files
+	OutputDirectories     map[string]string `json:"output_directories"`     // Directory for processed files per RAW extension (e.g. {".ARW": "..."}); other extensions use output_directory
+	OutputFormats         []string          `json:"output_formats"`         // Formats written per RAW file: "jpg" (uploaded) and optionally "tiff" (archived, not uploaded); empty = ["jpg"]
+	TIFFOutputDirectory   string            `json:"tiff_output_directory"`  // Directory for archival TIFFs (empty = next to the JPGs)
+	TIFFBitDepth          int               `json:"tiff_bit_depth"`         // Bits per channel of the archival TIFFs: 8 or 16
+	RawTherapeeBatchMode  bool              `json:"rawtherapee_batch_mode"` // Pass many files to one rawtherapee-cli call instead of one call per file
+	JPEGDPI               int               `json:"jpeg_dpi"`               // Resolution written into the output JPEG metadata (0 = keep RawTherapee's)
+	VerifyOutput          bool              `json:"verify_output"`          // Treat outputs that aren't complete, decodable JPEGs as processing failures
+	OverwriteExisting     bool              `json:"overwrite_existing"`     // Overwrite existing JPEGs in the output directory (false = keep and upload the existing file)
+	KeepPP3Sidecars       bool              `json:"keep_pp3_sidecars"`      // Keep the .out.pp3 files rawtherapee-cli may write next to the outputs (false = delete them)
+	PreserveFileTimes     bool              `json:"preserve_file_times"`    // Set the modification time of processed files to the capture time of their RAW
+	RTOverrides           map[string]string `json:"rt_overrides"`           // PP3 values applied on top of the profile by "Section/Key", e.g. {"Exposure/Compensation": "0.3"}
 
 	// Immich settings
-	ImmichExecutable string   `json:"immich_executable"` // Path to immich-go
-	ImmichServerURL  string   `json:"immich_server_url"` // Immich server URL
-	ImmichAPIKey     string   `json:"immich_api_key"`    // Immich API key
-	ImmichAlbum      string   `json:"immich_album"`      // Optional album name
-	ImmichTags       []string `json:"immich_tags"`       // Additional tags for all uploads
+	ImmichExecutable   string            `json:"immich_executable"`     // Path to immich-go
+	ImmichServerURL    string            `json:"immich_server_url"`     // Immich server URL
+	ImmichAPIKey       string            `json:"immich_api_key"`        // Immich API key
+	ImmichAlbum        string            `json:"immich_album"`          // Optional album name
+	ImmichTags         []string          `json:"immich_tags"`           // Additional tags for all uploads
+	DateAlbumFormat    string            `json:"date_album_format"`     // Go time layout for per-date albums (e.g. "2006-01-02" daily, "2006-01" monthly); overrides immich_album
+	Timezone           string            `json:"timezone"`              // IANA time zone used to date files for date albums, e.g. "Europe/Kyiv" (empty = system time zone)
+	DayBoundaryOffset  string            `json:"day_boundary_offset"`   // Start the album "day" this long after midnight, e.g. "4h" keeps a late-night shoot in one album
+	AlbumFromFolder    bool              `json:"album_from_folder"`     // Use the card folder name as the album; overrides date_album_format and immich_album
+	AlbumFolderDepth   int               `json:"album_folder_depth"`    // Folder level below DCIM used as the album (1 = "100CANON", 2 = "100CANON/2024_06_15")
+	AlbumFromPathRegex string            `json:"album_from_path_regex"` // Regex over the file path below DCIM whose first capture group is the album, e.g. "_([^/]+)/" (non-matching files use the other album settings)
+	TagFromFolder      bool              `json:"tag_from_folder"`       // Tag each file with the name of the card folder it is in (e.g. "2024_06_15_Wedding")
+	TagTimeOfDay       bool              `json:"tag_time_of_day"`       // Tag each file "morning", "midday", "evening" or "night" by its capture time
+	FavoriteIf         *FavoriteRule     `json:"favorite_if"`           // Mark uploaded files matching this rule as favorites in Immich (nil = disabled)
+	UploadVisibility   map[string]string `json:"upload_visibility"`     // Immich visibility per upload category ("processed", "camera", "jpg-only"): "timeline", "archive", "hidden" or "locked", e.g. {"camera": "archive"}
+	UploadBatchFiles   int               `json:"upload_batch_files"`    // Upload at most this many files per immich-go call (0 = no limit)
+	UploadBatchMB      int               `json:"upload_batch_mb"`       // Upload at most this many megabytes per immich-go call (0 = no limit)
+	UploadRetries      int               `json:"upload_retries"`        // Retry a failed upload batch this many times
+	UploadTimeout      int               `json:"upload_timeout"`        // Seconds after which a hanging immich-go call is killed and the upload fails (0 = no limit)
+	UploadConcurrency  int               `json:"upload_concurrency"`    // Number of files immich-go uploads in parallel (0 = immich-go default, the number of CPU cores)
+	DeviceUUID         string            `json:"device_uuid"`           // Device ID Immich records for the uploads, e.g. "studio-pc", to tell the importing machines apart (empty = immich-go default, the host name)
+	UploadAsUser       string            `json:"upload_as_user"`        // Email of the Immich user whose account receives the uploads, with their key from user_api_keys (empty = the owner of immich_api_key)
+	UserAPIKeys        map[string]string `json:"user_api_keys"`         // API keys of the users upload_as_user can name, by email, e.g. {"anna@example.com": "..."}
+	ShareWithPartner   string            `json:"share_with_partner"`    // Email of an Immich user to share the library with as a partner after uploading (empty = disabled)
+	ProfileTagFormat   string            `json:"profile_tag_format"`    // Template for the profile tag; "{name}", "{lower}" and "{upper}" are replaced by the profile name
+	RenameOnUpload     string            `json:"rename_on_upload"`      // Template for the names of uploaded files: "{date}" (2006-01-02) and "{time}" (150405) of the capture, "{name}" the original name; the extension is kept (empty = keep names)
+	OriginalName       string            `json:"original_name"`         // Record the camera file name of each upload in Immich, to find files renamed by rename_on_upload: "tag" (tagged "original-name/P1000001") or "description" (empty = disabled)
+	HardlinkStaging    bool              `json:"hardlink_staging"`      // Hardlink files into the upload staging directory when on the same volume instead of copying
 
 	// Processing options
-	ProcessRAWFiles      bool `json:"process_raw_files"`       // Process RAW files with RawTherapee (if false, only upload JPGs)
-	UploadCameraJPGs     bool `json:"upload_camera_jpgs"`      // Also upload camera-generated JPGs
-	TagWithProfileName   bool `json:"tag_with_profile_name"`   // Tag processed files with profile name
-	CleanupAfterUpload   bool `json:"cleanup_after_upload"`    // Delete processed files after successful upload
-	DryRun               bool `json:"dry_run"`                 // Don't actually process/upload, just show what would happen
-	SkipUpload           bool `json:"skip_upload"`             // Process files but skip uploading to Immich
-	Limit                int  `json:"limit"`                   // Limit number of files to process (0 = no limit)
-	Workers              int  `json:"workers"`                 // Number of parallel workers for processing (0 = auto based on CPU cores)
+	ProcessRAWFiles        bool            `json:"process_raw_files"`        // Process RAW files with RawTherapee (if false, only upload JPGs)
+	ProcessRAWOverrides    map[string]bool `json:"process_raw_overrides"`    // process_raw_files per RAW extension (".GPR") or folder below DCIM ("100GOPRO"), e.g. {".GPR": false}; folders win over extensions
+	UploadCameraJPGs       bool            `json:"upload_camera_jpgs"`       // Also upload camera-generated JPGs
+	CameraJPGs             string          `json:"camera_jpgs,omitempty"`    // Which camera JPGs to upload: "all", "orphans-only" or "none" (empty = follow upload_camera_jpgs)
+	TagWithProfileName     bool            `json:"tag_with_profile_name"`    // Tag processed files with profile name (formatted with profile_tag_format)
+	CleanupAfterUpload     bool            `json:"cleanup_after_upload"`     // Delete processed files after successful upload
+	VerifyBeforeCleanup    bool            `json:"verify_before_cleanup"`    // Only delete processed files the server confirms to have (looked up by checksum)
+	DryRun                 bool            `json:"dry_run"`                  // Don't actually process/upload, just show what would happen
+	SkipUpload             bool            `json:"skip_upload"`              // Process files but skip uploading to Immich
+	Limit                  int             `json:"limit"`                    // Limit number of files to process (0 = no limit)
+	SortOrder              string          `json:"sort_order"`               // Order files are processed in, before limit applies: "newest", "oldest", "name" or "size" (smallest first); empty = scan order
+	Workers                int             `json:"workers"`                  // Number of parallel workers for processing (0 = auto based on CPU cores)
+	ProcessRetries         int             `json:"process_retries"`          // Queue a file that failed processing again this many times before recording it as failed
+	MaxConsecutiveFailures int             `json:"max_consecutive_failures"` // Abort the run after this many files in a row failed processing (0 = never)
+	WorkerStagger          string          `json:"worker_stagger"`           // Delay between the first jobs of consecutive workers, e.g. "3s", to smooth the memory ramp at startup (empty = start all at once)
+	ThrottleCPUPercent     int             `json:"throttle_cpu_percent"`     // Hold back all workers but one while system CPU usage is above this percentage (0 = disabled)
+	ThrottleMemoryPercent  int             `json:"throttle_memory_percent"`  // Hold back all workers but one while system memory in use is above this percentage (0 = disabled)
+	ScanCache              bool            `json:"scan_cache"`               // Reuse the previous scan result when the card's directories are unchanged
+	SkipExistingOnServer   bool            `json:"skip_existing_on_server"`  // Skip files whose shot already exists on the Immich server (matched by camera JPG checksum, or by name and capture time)
+	StatePath              string          `json:"state_path"`               // State file to use, e.g. to keep separate states for separate workflows (empty = state.json in the data directory)
+	CompressState          bool            `json:"compress_state"`           // Write the state file gzip-compressed (detected automatically on load)
+	BackupState            int             `json:"backup_state"`             // Keep this many backups of the state file, each the state before one of the last runs (0 = none)
+	NewSinceWatermark      bool            `json:"new_since_watermark"`      // Only process files newer than the newest file synced from this card before
+	AutosaveInterval       int             `json:"autosave_interval"`        // Save the state after every N processed files during a run (0 = only at the end)
+	NormalizeOrientation   bool            `json:"normalize_orientation"`    // Make processed JPGs display with the same orientation as their camera JPGs
+	MinMegapixels          float64         `json:"min_megapixels"`           // Skip RAW files whose EXIF image size is below this many megapixels, e.g. low-res test shots (0 = no limit)
+	VerifyDimensions       bool            `json:"verify_dimensions"`        // Warn when a processed JPG's size is off the size expected from its RAW and the profile's resize settings
+	VerifyEXIF             bool            `json:"verify_exif"`              // Warn when a processed JPG lost or changed lens, focal length or exposure EXIF fields of its RAW (e.g. in the DNG round-trip)
+	BracketMode            string          `json:"bracket_mode"`             // Detect exposure brackets from EXIF: "tag" tags their shots, "middle" also processes only the middle exposure (empty = disabled)
+	BracketSize            int             `json:"bracket_size"`             // Number of shots in an exposure bracket
+	BurstGap               string          `json:"burst_gap"`                // Tag shots taken at most this long after the previous one as a burst, e.g. "1s" (empty = disabled)
+	UseEmbeddedPreview     bool            `json:"use_embedded_preview"`     // Upload the full-size JPEG preview embedded in each RAW instead of developing it with RawTherapee
+
+	// Reporting options
+	FailuresCSVPath      string `json:"failures_csv_path"`      // Append failed files (processing or upload) to this CSV file (empty = disabled)
+	OrientationReport    bool   `json:"orientation_report"`     // Report portrait/landscape counts from EXIF after a run and list files without orientation
+	MetricsFile          string `json:"metrics_file"`           // Write Prometheus metrics to this file after each run, for the node_exporter textfile collector (empty = disabled)
+	SaveUploadLog        bool   `json:"save_upload_log"`        // Save the full immich-go output of each run to ~/.camera-to-immich/logs/upload-<timestamp>.log
+	ManifestPath         string `json:"manifest_path"`          // Write a CSV listing every file of a run (paths, profile, status, size, duration, upload, error); "{timestamp}" is replaced by the run's start time (empty = disabled)
+	GenerateContactSheet bool   `json:"generate_contact_sheet"` // Save a thumbnail grid of the files processed in a run to the output directory
+	UploadContactSheet   bool   `json:"upload_contact_sheet"`   // Also upload the contact sheet to Immich
+
+	albumPathPattern *regexp.Regexp // album_from_path_regex, compiled by Validate
+}
+
+// dngVersionPattern matches the version numbers of dng_camera_raw_version and dng_version
+var dngVersionPattern = regexp.MustCompile(`^\d+\.\d+(\.\d+)?$`)
+
+// DefaultProfileTagFormat is the profile tag template used when none is configured
+const DefaultProfileTagFormat = "profile:{name}"
+
+// Camera JPG upload modes (camera_jpgs)
+const (
+	CameraJPGsAll         = "all"          // Upload the camera JPG of every processed RAW
+	CameraJPGsOrphansOnly = "orphans-only" // Only upload camera JPGs without a RAW file (JPG-only shots)
+	CameraJPGsNone        = "none"         // Don't upload camera JPGs
+)
+
+// Upload categories (upload_visibility)
+const (
+	UploadProcessed = "processed" // JPGs processed from RAW files
+	UploadCamera    = "camera"    // Camera JPGs of RAW files
+	UploadJPGOnly   = "jpg-only"  // Camera JPGs without a RAW file, and uploads in JPG-only mode
+)
+
+// Ways of recording the camera file name of uploads (original_name)
+const (
+	OriginalNameTag         = "tag"         // Tag the asset with its camera file name
+	OriginalNameDescription = "description" // Set the camera file name as the asset's description
+)
+
+// Processing orders (sort_order)
+const (
+	SortNewest = "newest" // Newest files first (by modification time)
+	SortOldest = "oldest" // Oldest files first
+	SortName   = "name"   // By folder and file name
+	SortSize   = "size"   // Smallest files first
+)
+
+// ProfileRule selects a PP3 profile for the shots matching all of its criteria
+type ProfileRule struct {
+	MinISO  int    `json:"min_iso"` // Shots taken at this ISO or higher (0 = any)
+	Make    string `json:"make"`    // Shots from cameras whose EXIF make contains this text, case-insensitive (empty = any)
+	Model   string `json:"model"`   // Shots from bodies whose EXIF model contains this text, case-insensitive (empty = any)
+	Profile string `json:"profile"` // Path to the PP3 profile used for matching shots
+}
+
+// Exposure bracket modes (bracket_mode)
+const (
+	BracketTag    = "tag"    // Tag the shots of each bracket
+	BracketMiddle = "middle" // Tag the shots and process only the middle exposure of each bracket
+)
+
+// FavoriteRule selects uploaded files to mark as favorites in Immich
+// A file matches if it satisfies any of the set criteria
+type FavoriteRule struct {
+	MinRating int      `json:"min_rating"` // Files rated at least this many stars in the camera (0 = ignore rating)
+	Tags      []string `json:"tags"`       // Files uploaded with any of these tags
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
-	homeDir, _ := os.UserHomeDir()
-	
+	dataDir, _ := paths.DataDir()
+
 	return &Config{
 		DriveLabel:          "OM SYSTEM",
 		RawExtensions:       []string{".ORF"}, // Olympus RAW format by default
@@ -60,44 +211,123 @@ func DefaultConfig() *Config {
 		DNGEmbedOriginal:    false,            // Don't embed original (smaller files)
 		CleanupDNGFiles:     true,             // Clean up intermediate DNG files
 		JPEGQuality:         92,
-		OutputDirectory:     filepath.Join(homeDir, ".camera-to-immich", "output"),
+		TIFFBitDepth:        16,
+		VerifyOutput:        true,
+		OverwriteExisting:   true,
+		OutputDirectory:     filepath.Join(dataDir, "output"),
 		ProcessRAWFiles:     true,
 		UploadCameraJPGs:    true,
 		TagWithProfileName:  true,
+		ProfileTagFormat:    DefaultProfileTagFormat,
 		CleanupAfterUpload:  true, // Default to cleaning up to save disk space
+		VerifyBeforeCleanup: true,
+		AlbumFolderDepth:    1,
+		AutosaveInterval:    50,
+		BracketSize:         3,
+		UploadRetries:       2,
+		HardlinkStaging:     true,
 		DryRun:              false,
 	}
 }
 
 // DefaultConfigPath returns the default path for the config file
 func DefaultConfigPath() (string, error) {
-	homeDir, err := os.UserHomeDir()
+	dataDir, err := paths.DataDir()
 	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %v", err)
+		return "", err
 	}
-	return filepath.Join(homeDir, ".camera-to-immich", "config.json"), nil
+	return filepath.Join(dataDir, "config.json"), nil
 }
 
+// maxIncludeDepth bounds nested includes, protecting against include cycles
+const maxIncludeDepth = 8
+
 // Load loads configuration from the specified file
 func Load(configPath string) (*Config, error) {
+	return LoadWithOverrides(configPath, nil)
+}
+
+// LoadWithOverrides loads configuration from the specified file, then merges the files it
+// includes and finally the given override files on top of it
+// Values set in a later file win; lists are replaced, not appended to.
+func LoadWithOverrides(configPath string, overrides []string) (*Config, error) {
 	config := DefaultConfig()
 
 	data, err := os.ReadFile(configPath)
 	if os.IsNotExist(err) {
-		// Config file doesn't exist, return defaults
-		return config, nil
-	}
-	if err != nil {
+		// Config file doesn't exist, start from defaults
+		data = nil
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %v", err)
 	}
 
-	if err := json.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	if data != nil {
+		if err := config.merge(configPath, data, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, override := range overrides {
+		data, err := os.ReadFile(override)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config override: %v", err)
+		}
+		if err := config.merge(override, data, 0); err != nil {
+			return nil, err
+		}
 	}
 
 	return config, nil
 }
 
+// merge applies a config file on top of the current values, followed by its includes
+func (c *Config) merge(path string, data []byte, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("config includes nested too deeply at %s (include cycle?)", path)
+	}
+
+	// Includes are per file, so don't let them leak into nested files
+	c.Includes = nil
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	includes := c.Includes
+	c.Includes = nil
+
+	for _, include := range includes {
+		includePath := expandHome(include)
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+
+		data, err := os.ReadFile(includePath)
+		if os.IsNotExist(err) {
+			// Machines without local overrides simply don't have the file
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read included config: %v", err)
+		}
+		if err := c.merge(includePath, data, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandHome replaces a leading "~/" with the user's home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~\\") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, path[2:])
+}
+
 // Save saves the configuration to the specified file
 func (c *Config) Save(configPath string) error {
 	// Ensure directory exists
@@ -124,8 +354,14 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("drive_label is required")
 	}
 
-	// PP3 profile is only required if RAW processing is enabled
-	if c.ProcessRAWFiles {
+	for key := range c.ProcessRAWOverrides {
+		if strings.Trim(key, "/.") == "" {
+			return fmt.Errorf("process_raw_overrides keys must be extensions like \".ORF\" or folders like \"100GOPRO\"")
+		}
+	}
+
+	// PP3 profile is only required if RAW files are developed with RawTherapee
+	if c.ProcessesAnyRAW() && !c.UseEmbeddedPreview {
 		if c.PP3ProfilePath == "" {
 			return fmt.Errorf("pp3_profile_path is required when process_raw_files is enabled")
 		}
@@ -133,6 +369,15 @@ func (c *Config) Validate() error {
 		if _, err := os.Stat(c.PP3ProfilePath); os.IsNotExist(err) {
 			return fmt.Errorf("PP3 profile not found: %s", c.PP3ProfilePath)
 		}
+
+		for i, rule := range c.ProfileRules {
+			if rule.MinISO <= 0 && rule.Make == "" && rule.Model == "" {
+				return fmt.Errorf("profile_rules[%d] needs min_iso, make or model", i)
+			}
+			if _, err := os.Stat(rule.Profile); err != nil {
+				return fmt.Errorf("profile_rules[%d]: PP3 profile not found: %s", i, rule.Profile)
+			}
+		}
 	}
 
 	// Immich settings are only required if upload is enabled
@@ -141,15 +386,223 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("immich_server_url is required (use --skip-upload to skip Immich upload)")
 		}
 
-		if c.ImmichAPIKey == "" {
+		if c.ImmichAPIKey == "" && c.UploadAsUser == "" {
 			return fmt.Errorf("immich_api_key is required (use --skip-upload to skip Immich upload)")
 		}
 	}
+	if c.UploadAsUser != "" && c.UserAPIKey(c.UploadAsUser) == "" {
+		return fmt.Errorf("upload_as_user %s has no API key in user_api_keys", c.UploadAsUser)
+	}
 
 	if c.JPEGQuality < 1 || c.JPEGQuality > 100 {
 		return fmt.Errorf("jpeg_quality must be between 1 and 100")
 	}
 
+	if c.JPEGDPI < 0 || c.JPEGDPI > 65535 {
+		return fmt.Errorf("jpeg_dpi must be between 0 and 65535")
+	}
+
+	for name, value := range c.RTOverrides {
+		section, key, ok := strings.Cut(name, "/")
+		if !ok || section == "" || key == "" || strings.ContainsAny(name, "[]=") {
+			return fmt.Errorf("rt_overrides key %q must be \"Section/Key\", e.g. \"Exposure/Compensation\"", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("rt_overrides value for %s must be a single line", name)
+		}
+	}
+
+	for name, version := range map[string]string{"dng_camera_raw_version": c.DNGCameraRawVersion, "dng_version": c.DNGVersion} {
+		if version != "" && !dngVersionPattern.MatchString(version) {
+			return fmt.Errorf("%s must be a version number like \"7.1\", not %q", name, version)
+		}
+	}
+
+	if c.ConvertToDNG && len(c.RawDecoderCommand) > 0 {
+		return fmt.Errorf("convert_to_dng and raw_decoder_command can't be used together")
+	}
+
+	if c.TagWithProfileName && c.ProfileTagFormat != "" && !strings.Contains(c.ProfileTagFormat, "{name}") &&
+		!strings.Contains(c.ProfileTagFormat, "{lower}") && !strings.Contains(c.ProfileTagFormat, "{upper}") {
+		return fmt.Errorf("profile_tag_format must contain {name}, {lower} or {upper}")
+	}
+
+	if c.RenameOnUpload != "" {
+		if !strings.Contains(c.RenameOnUpload, "{date}") && !strings.Contains(c.RenameOnUpload, "{time}") &&
+			!strings.Contains(c.RenameOnUpload, "{name}") {
+			return fmt.Errorf("rename_on_upload must contain {date}, {time} or {name}")
+		}
+		if strings.ContainsAny(c.RenameOnUpload, `/\`) {
+			return fmt.Errorf("rename_on_upload must be a file name, not a path")
+		}
+		// Server files are matched by their card file name
+		if c.SkipExistingOnServer {
+			return fmt.Errorf("skip_existing_on_server can't be used with rename_on_upload")
+		}
+	}
+
+	if c.UploadBatchFiles < 0 || c.UploadBatchMB < 0 || c.UploadRetries < 0 || c.UploadTimeout < 0 {
+		return fmt.Errorf("upload_batch_files, upload_batch_mb, upload_retries and upload_timeout must be 0 or greater")
+	}
+
+	switch c.CameraJPGs {
+	case "", CameraJPGsAll, CameraJPGsOrphansOnly, CameraJPGsNone:
+	default:
+		return fmt.Errorf("camera_jpgs must be \"all\", \"orphans-only\" or \"none\"")
+	}
+
+	switch c.BracketMode {
+	case "", BracketTag, BracketMiddle:
+	default:
+		return fmt.Errorf("bracket_mode must be \"tag\" or \"middle\"")
+	}
+	if c.BracketMode != "" && c.BracketSize < 2 {
+		return fmt.Errorf("bracket_size must be 2 or greater")
+	}
+
+	if c.ProcessRetries < 0 {
+		return fmt.Errorf("process_retries must be 0 or greater")
+	}
+	if c.MaxConsecutiveFailures < 0 {
+		return fmt.Errorf("max_consecutive_failures must be 0 or greater")
+	}
+
+	switch c.SortOrder {
+	case "", SortNewest, SortOldest, SortName, SortSize:
+	default:
+		return fmt.Errorf("sort_order must be \"newest\", \"oldest\", \"name\" or \"size\"")
+	}
+	// The watermark moves past every synced file, so files left behind by the limit
+	// would never be picked up
+	if c.NewSinceWatermark && c.Limit > 0 && c.SortOrder != "" && c.SortOrder != SortOldest {
+		return fmt.Errorf("new_since_watermark with a limit needs sort_order \"oldest\"")
+	}
+
+	hasJPG := len(c.OutputFormats) == 0
+	for _, format := range c.OutputFormats {
+		switch strings.ToLower(format) {
+		case "jpg", "jpeg":
+			hasJPG = true
+		case "tif", "tiff":
+		default:
+			return fmt.Errorf("invalid output format %q (must be \"jpg\" or \"tiff\")", format)
+		}
+	}
+	if !hasJPG {
+		return fmt.Errorf("output_formats must include \"jpg\", which is uploaded to Immich")
+	}
+	if c.TIFFBitDepth != 8 && c.TIFFBitDepth != 16 {
+		return fmt.Errorf("tiff_bit_depth must be 8 or 16")
+	}
+
+	if c.MinMegapixels < 0 {
+		return fmt.Errorf("min_megapixels must be 0 or greater")
+	}
+
+	if c.UploadConcurrency < 0 || c.UploadConcurrency > 20 {
+		return fmt.Errorf("upload_concurrency must be between 0 and 20")
+	}
+
+	if c.CardMinFreeMB < 0 {
+		return fmt.Errorf("card_min_free_mb must be 0 or greater")
+	}
+
+	if c.AutosaveInterval < 0 {
+		return fmt.Errorf("autosave_interval must be 0 or greater")
+	}
+
+	if c.AlbumFromFolder && c.AlbumFolderDepth < 1 {
+		return fmt.Errorf("album_folder_depth must be 1 or greater")
+	}
+
+	c.albumPathPattern = nil
+	if c.AlbumFromPathRegex != "" {
+		re, err := regexp.Compile(c.AlbumFromPathRegex)
+		if err != nil {
+			return fmt.Errorf("invalid album_from_path_regex: %v", err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("album_from_path_regex needs a capture group for the album name")
+		}
+		c.albumPathPattern = re
+	}
+
+	if c.FavoriteIf != nil {
+		if c.FavoriteIf.MinRating < 0 || c.FavoriteIf.MinRating > 5 {
+			return fmt.Errorf("favorite_if.min_rating must be between 0 and 5")
+		}
+		if c.FavoriteIf.MinRating == 0 && len(c.FavoriteIf.Tags) == 0 {
+			return fmt.Errorf("favorite_if needs min_rating or tags")
+		}
+	}
+
+	for category, visibility := range c.UploadVisibility {
+		switch category {
+		case UploadProcessed, UploadCamera, UploadJPGOnly:
+		default:
+			return fmt.Errorf("upload_visibility categories must be \"processed\", \"camera\" or \"jpg-only\", not %q", category)
+		}
+		switch visibility {
+		case "timeline", "archive", "hidden", "locked":
+		default:
+			return fmt.Errorf("upload_visibility of %s must be \"timeline\", \"archive\", \"hidden\" or \"locked\"", category)
+		}
+	}
+
+	switch c.OriginalName {
+	case "", OriginalNameTag, OriginalNameDescription:
+	default:
+		return fmt.Errorf("original_name must be \"tag\" or \"description\"")
+	}
+
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %v", c.Timezone, err)
+		}
+	}
+
+	if c.DayBoundaryOffset != "" {
+		offset, err := time.ParseDuration(c.DayBoundaryOffset)
+		if err != nil || offset < 0 || offset >= 24*time.Hour {
+			return fmt.Errorf("day_boundary_offset must be a duration between 0 and 24h, e.g. \"4h\"")
+		}
+	}
+
+	if c.SkipNewest < 0 {
+		return fmt.Errorf("skip_newest must be 0 or more")
+	}
+
+	if c.BackupState < 0 {
+		return fmt.Errorf("backup_state must be 0 or more")
+	}
+
+	if c.ThrottleCPUPercent < 0 || c.ThrottleCPUPercent > 100 {
+		return fmt.Errorf("throttle_cpu_percent must be between 0 and 100")
+	}
+	if c.ThrottleMemoryPercent < 0 || c.ThrottleMemoryPercent > 100 {
+		return fmt.Errorf("throttle_memory_percent must be between 0 and 100")
+	}
+
+	if c.BurstGap != "" {
+		if gap, err := time.ParseDuration(c.BurstGap); err != nil || gap <= 0 {
+			return fmt.Errorf("burst_gap must be a positive duration, e.g. \"1s\"")
+		}
+	}
+
+	if c.WorkerStagger != "" {
+		if stagger, err := time.ParseDuration(c.WorkerStagger); err != nil || stagger < 0 {
+			return fmt.Errorf("worker_stagger must be a non-negative duration, e.g. \"3s\"")
+		}
+	}
+
+	// A layout without any time tokens would put every file into the same literal album
+	if c.DateAlbumFormat != "" {
+		reference := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+		if reference.Format(c.DateAlbumFormat) == c.DateAlbumFormat {
+			return fmt.Errorf("date_album_format %q contains no Go time layout tokens (e.g. \"2006-01-02\")", c.DateAlbumFormat)
+		}
+	}
+
 	return nil
 }
 
@@ -170,9 +623,166 @@ func CreateSampleConfig(configPath string) error {
 	return config.Save(configPath)
 }
 
+// CameraJPGMode returns the camera JPG upload mode, derived from upload_camera_jpgs when
+// camera_jpgs isn't set
+func (c *Config) CameraJPGMode() string {
+	if c.CameraJPGs != "" {
+		return c.CameraJPGs
+	}
+	if c.UploadCameraJPGs {
+		return CameraJPGsAll
+	}
+	return CameraJPGsNone
+}
+
+// AlbumDate returns the date used to bucket a file with the file time t into a date album:
+// t in the configured time zone, shifted back by the day boundary offset
+func (c *Config) AlbumDate(t time.Time) time.Time {
+	t = t.Local()
+	if c.Timezone != "" {
+		if loc, err := time.LoadLocation(c.Timezone); err == nil {
+			t = t.In(loc)
+		}
+	}
+	return c.AlbumCaptureDate(t)
+}
+
+// AlbumCaptureDate returns the date used to bucket a file captured at t into a date album,
+// for an EXIF capture time (the camera's wall clock already): t shifted back by the day
+// boundary offset
+func (c *Config) AlbumCaptureDate(t time.Time) time.Time {
+	if offset, err := time.ParseDuration(c.DayBoundaryOffset); err == nil {
+		t = t.Add(-offset)
+	}
+	return t
+}
+
+// AlbumFromPath returns the album captured by album_from_path_regex from a file path below
+// DCIM (forward slashes), or "" if the regex isn't set or doesn't match
+func (c *Config) AlbumFromPath(relPath string) string {
+	if c.albumPathPattern == nil {
+		return ""
+	}
+	match := c.albumPathPattern.FindStringSubmatch(relPath)
+	if len(match) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(match[1])
+}
+
+// TIFFOutputDirectoryFor returns the directory for archival TIFFs of files whose JPGs go to
+// outputDir, or "" if output_formats doesn't include TIFF
+func (c *Config) TIFFOutputDirectoryFor(outputDir string) string {
+	for _, format := range c.OutputFormats {
+		if strings.EqualFold(format, "tif") || strings.EqualFold(format, "tiff") {
+			if c.TIFFOutputDirectory != "" {
+				return c.TIFFOutputDirectory
+			}
+			return outputDir
+		}
+	}
+	return ""
+}
+
+// UserAPIKey returns the API key of a user from user_api_keys ("" if there is none)
+// Emails are compared case-insensitively.
+func (c *Config) UserAPIKey(email string) string {
+	for user, key := range c.UserAPIKeys {
+		if strings.EqualFold(user, email) {
+			return key
+		}
+	}
+	return ""
+}
+
+// IsIgnoredDrive reports whether a volume serial is listed in ignore_drive_serials
+// Case and dashes are ignored, so "1a2b3c4d" matches "1A2B-3C4D".
+func (c *Config) IsIgnoredDrive(serial string) bool {
+	normalize := func(s string) string {
+		return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	}
+	if normalize(serial) == "" {
+		return false
+	}
+	for _, ignored := range c.IgnoreDriveSerials {
+		if normalize(ignored) == normalize(serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// BurstMaxGap returns the longest time between two shots of a burst (0 = burst detection
+// disabled)
+func (c *Config) BurstMaxGap() time.Duration {
+	gap, err := time.ParseDuration(c.BurstGap)
+	if err != nil || gap < 0 {
+		return 0
+	}
+	return gap
+}
+
+// WorkerStaggerDelay returns the delay between the starts of consecutive workers
+func (c *Config) WorkerStaggerDelay() time.Duration {
+	stagger, err := time.ParseDuration(c.WorkerStagger)
+	if err != nil || stagger < 0 {
+		return 0
+	}
+	return stagger
+}
+
+// OutputDirectoryFor returns the output directory for processed files from RAW files with
+// the given extension
+func (c *Config) OutputDirectoryFor(ext string) string {
+	for key, dir := range c.OutputDirectories {
+		normalized := strings.ToUpper(key)
+		if !strings.HasPrefix(normalized, ".") {
+			normalized = "." + normalized
+		}
+		if normalized == strings.ToUpper(ext) && dir != "" {
+			return dir
+		}
+	}
+	return c.OutputDirectory
+}
+
+// ProcessesRAW reports whether RAW files with the extension in the folder (relative to DCIM,
+// with forward slashes) are processed: the override of the folder or its closest parent
+// folder, then the override of the extension, then process_raw_files
+func (c *Config) ProcessesRAW(ext, relDir string) bool {
+	for dir := relDir; dir != "" && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		for key, process := range c.ProcessRAWOverrides {
+			if !strings.HasPrefix(key, ".") && strings.EqualFold(strings.Trim(key, "/"), dir) {
+				return process
+			}
+		}
+	}
+	for key, process := range c.ProcessRAWOverrides {
+		if strings.HasPrefix(key, ".") && strings.EqualFold(key, ext) {
+			return process
+		}
+	}
+	return c.ProcessRAWFiles
+}
+
+// ProcessesAnyRAW reports whether RAW files are processed at all, globally or for some
+// extension or folder
+func (c *Config) ProcessesAnyRAW() bool {
+	if c.ProcessRAWFiles {
+		return true
+	}
+	for _, process := range c.ProcessRAWOverrides {
+		if process {
+			return true
+		}
+	}
+	return false
+}
+
 // GetRawExtensionsMap returns a map for O(1) extension lookup
 func (c *Config) GetRawExtensionsMap() map[string]bool {
-	extMap := make(map[string]bool)
+	// RawTherapee reads DNG natively, so DNG files from DNG-native cameras are always RAW
+	extMap := map[string]bool{DNGExtension: true}
 	for _, ext := range c.RawExtensions {
 		// Normalize to uppercase with leading dot
 		normalized := strings.ToUpper(ext)
@@ -182,4 +792,19 @@ func (c *Config) GetRawExtensionsMap() map[string]bool {
 		extMap[normalized] = true
 	}
 	return extMap
+}
+
+// DNGExtension is the extension of DNG files, which are RAW files even when raw_extensions
+// doesn't list it
+const DNGExtension = ".DNG"
+
+// RawExtensionsList returns the normalized RAW extensions, including DNG, sorted
+func (c *Config) RawExtensionsList() []string {
+	extMap := c.GetRawExtensionsMap()
+	exts := make([]string, 0, len(extMap))
+	for ext := range extMap {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
 }
\ No newline at end of file
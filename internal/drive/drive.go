@@ -5,6 +5,8 @@ type DriveInfo struct {
 	Path        string
 	VolumeLabel string
 	Letter      string // Windows only (e.g., "E:")
+	ReadOnly    bool   // Mounted read-only (e.g. the card's lock switch is on)
+	Serial      string // Volume serial number (Windows, e.g. "1A2B-3C4D") or volume UUID (macOS), empty if unknown
 }
 
 // FindDriveByLabel searches for a drive with the specified volume label
@@ -17,4 +19,10 @@ func FindDriveByLabel(label string) (*DriveInfo, error) {
 // Implementation is in platform-specific files (drive_windows.go, drive_darwin.go)
 func ListAllDrives() ([]DriveInfo, error) {
 	return listAllDrivesImpl()
-}
\ No newline at end of file
+}
+
+// FreeSpace returns the free and total space in bytes of the volume containing path
+// Implementation is in platform-specific files (drive_windows.go, drive_darwin.go)
+func FreeSpace(path string) (free, total uint64, err error) {
+	return freeSpaceImpl(path)
+}
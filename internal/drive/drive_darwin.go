@@ -5,12 +5,17 @@ package drive
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 const volumesPath = "/Volumes"
 
+// mntReadOnly is MNT_RDONLY from <sys/mount.h>, which the syscall package doesn't export on macOS
+const mntReadOnly = 0x1
+
 // findDriveByLabelImpl searches for a drive with the specified volume label on macOS
 func findDriveByLabelImpl(label string) (*DriveInfo, error) {
 	drives, err := listAllDrivesImpl()
@@ -54,8 +59,44 @@ func listAllDrivesImpl() ([]DriveInfo, error) {
 			Path:        volumePath,
 			VolumeLabel: volumeName,
 			Letter:      "", // Not applicable on macOS
+			ReadOnly:    isReadOnly(volumePath),
+			Serial:      volumeUUID(volumePath),
 		})
 	}
 
 	return drives, nil
+}
+
+// isReadOnly reports whether the volume is mounted read-only
+func isReadOnly(volumePath string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &stat); err != nil {
+		return false
+	}
+	return stat.Flags&mntReadOnly != 0
+}
+
+// volumeUUID returns the volume UUID reported by diskutil ("" if unknown)
+// FAT and exFAT cards have no UUID of their own; macOS derives a stable one from the
+// volume serial number.
+func volumeUUID(volumePath string) string {
+	output, err := exec.Command("diskutil", "info", volumePath).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(key) == "Volume UUID" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// freeSpaceImpl returns the free and total space of the volume containing path on macOS
+func freeSpaceImpl(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("statfs %s failed: %v", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
 }
\ No newline at end of file
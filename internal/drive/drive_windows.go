@@ -14,6 +14,7 @@ var (
 	getLogicalDriveStrings = kernel32.NewProc("GetLogicalDriveStringsW")
 	getVolumeInformation   = kernel32.NewProc("GetVolumeInformationW")
 	getDriveType           = kernel32.NewProc("GetDriveTypeW")
+	getDiskFreeSpaceEx     = kernel32.NewProc("GetDiskFreeSpaceExW")
 )
 
 const (
@@ -21,6 +22,8 @@ const (
 	DRIVE_FIXED     = 3
 	DRIVE_REMOTE    = 4
 	DRIVE_CDROM     = 5
+
+	FILE_READ_ONLY_VOLUME = 0x00080000
 )
 
 // findDriveByLabelImpl searches for a drive with the specified volume label on Windows
@@ -69,7 +72,7 @@ func listAllDrivesImpl() ([]DriveInfo, error) {
 			drivePath := syscall.UTF16ToString(buffer[i:j])
 			
 			// Get volume information
-			volumeLabel := getVolumeLabel(drivePath)
+			volumeLabel, serial, readOnly := getVolumeInfo(drivePath)
 			
 			// Extract drive letter (e.g., "C:" from "C:\")
 			driveLetter := ""
@@ -81,6 +84,8 @@ func listAllDrivesImpl() ([]DriveInfo, error) {
 				Path:        drivePath,
 				VolumeLabel: volumeLabel,
 				Letter:      driveLetter,
+				ReadOnly:    readOnly,
+				Serial:      serial,
 			})
 		}
 
@@ -90,8 +95,8 @@ func listAllDrivesImpl() ([]DriveInfo, error) {
 	return drives, nil
 }
 
-// getVolumeLabel retrieves the volume label for a given drive path
-func getVolumeLabel(drivePath string) string {
+// getVolumeInfo retrieves the volume label, serial number and read-only status for a given drive path
+func getVolumeInfo(drivePath string) (string, string, bool) {
 	volumeNameBuffer := make([]uint16, 256)
 	fileSystemNameBuffer := make([]uint16, 256)
 	var serialNumber uint32
@@ -100,7 +105,7 @@ func getVolumeLabel(drivePath string) string {
 
 	drivePathPtr, err := syscall.UTF16PtrFromString(drivePath)
 	if err != nil {
-		return ""
+		return "", "", false
 	}
 
 	ret, _, _ := getVolumeInformation.Call(
@@ -115,10 +120,12 @@ func getVolumeLabel(drivePath string) string {
 	)
 
 	if ret == 0 {
-		return ""
+		return "", "", false
 	}
 
-	return syscall.UTF16ToString(volumeNameBuffer)
+	// Formatted the way "vol" and "dir" show it
+	serial := fmt.Sprintf("%04X-%04X", serialNumber>>16, serialNumber&0xFFFF)
+	return syscall.UTF16ToString(volumeNameBuffer), serial, fileSystemFlags&FILE_READ_ONLY_VOLUME != 0
 }
 
 // GetDriveType returns the type of the specified drive
@@ -130,4 +137,25 @@ func GetDriveType(drivePath string) (uint32, error) {
 
 	ret, _, _ := getDriveType.Call(uintptr(unsafe.Pointer(drivePathPtr)))
 	return uint32(ret), nil
-}
\ No newline at end of file
+}
+
+// freeSpaceImpl returns the free and total space of the volume containing path on Windows
+func freeSpaceImpl(path string) (uint64, uint64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var freeAvailable, total, totalFree uint64
+	ret, _, callErr := getDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&freeAvailable)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&totalFree)),
+	)
+	if ret == 0 {
+		return 0, 0, fmt.Errorf("GetDiskFreeSpaceEx failed: %v", callErr)
+	}
+
+	return freeAvailable, total, nil
+}
@@ -0,0 +1,47 @@
+package drive
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CardMarkerFile is the name of the file at the card root holding the card's ID
+const CardMarkerFile = ".camera-to-immich-id"
+
+// ReadCardMarker returns the card ID stored in the marker file at the card root
+// Returns "" if the card has no (or an empty) marker file.
+func ReadCardMarker(drivePath string) string {
+	data, err := os.ReadFile(filepath.Join(drivePath, CardMarkerFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// CreateCardMarker writes a marker file with a new random UUID to the card root and
+// returns the UUID
+func CreateCardMarker(drivePath string) (string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(drivePath, CardMarkerFile), []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write card marker: %v", err)
+	}
+	return id, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate card ID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
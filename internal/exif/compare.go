@@ -0,0 +1,54 @@
+package exif
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// LostFields compares the shooting metadata of a processed copy with its original and
+// describes every field that is missing or different in the copy
+// Fields the original doesn't have are not checked.
+func LostFields(original, processed *Metadata) []string {
+	var lost []string
+
+	compareString := func(name, want, got string) {
+		if want == "" || strings.EqualFold(strings.TrimSpace(want), strings.TrimSpace(got)) {
+			return
+		}
+		if got == "" {
+			lost = append(lost, fmt.Sprintf("%s (%q missing)", name, want))
+		} else {
+			lost = append(lost, fmt.Sprintf("%s (%q -> %q)", name, want, got))
+		}
+	}
+	// Values are rationals that may be re-encoded with other denominators, so allow 1%
+	compareNumber := func(name string, want, got float64) {
+		if want == 0 || math.Abs(want-got) <= want*0.01 {
+			return
+		}
+		if got == 0 {
+			lost = append(lost, fmt.Sprintf("%s (%g missing)", name, want))
+		} else {
+			lost = append(lost, fmt.Sprintf("%s (%g -> %g)", name, want, got))
+		}
+	}
+
+	compareString("make", original.Make, processed.Make)
+	compareString("model", original.Model, processed.Model)
+	compareString("lens", original.LensModel, processed.LensModel)
+	compareNumber("focal length", original.FocalLength, processed.FocalLength)
+	compareNumber("f-number", original.FNumber, processed.FNumber)
+	compareNumber("exposure time", original.ExposureTime, processed.ExposureTime)
+	compareNumber("ISO", float64(original.ISO), float64(processed.ISO))
+
+	if !original.DateTimeOriginal.IsZero() && !original.DateTimeOriginal.Equal(processed.DateTimeOriginal) {
+		if processed.DateTimeOriginal.IsZero() {
+			lost = append(lost, "capture time (missing)")
+		} else {
+			lost = append(lost, fmt.Sprintf("capture time (%s -> %s)", original.DateTimeOriginal.Format("2006-01-02 15:04:05"), processed.DateTimeOriginal.Format("2006-01-02 15:04:05")))
+		}
+	}
+
+	return lost
+}
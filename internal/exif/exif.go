@@ -0,0 +1,445 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata contains the EXIF fields used by this tool
+// Fields missing from the file are left at their zero value
+type Metadata struct {
+	Make             string
+	Model            string
+	Orientation      int       // EXIF orientation (1-8), 0 if missing
+	DateTimeOriginal time.Time // Capture time as recorded by the camera (wall clock, no time zone), with SubSecTimeOriginal if present
+	Width            int       // Largest image width found in the file
+	Height           int       // Largest image height found in the file
+	Rating           int       // Star rating (0-5) from EXIF or XMP, 0 if unrated
+	ExposureBias     float64   // Exposure compensation in EV, 0 if missing
+	ISO              int       // ISO sensitivity, 0 if missing
+	ExposureTime     float64   // Exposure time in seconds, 0 if missing
+	FNumber          float64   // Aperture as an f-number, 0 if missing
+	FocalLength      float64   // Focal length in mm, 0 if missing
+	LensModel        string    // Lens name from EXIF or the Olympus maker note, empty if missing
+}
+
+// EXIF tags read by this package
+const (
+	tagImageWidth       = 0x0100
+	tagImageLength      = 0x0101
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSubIFDs          = 0x014A
+	tagXMP              = 0x02BC
+	tagRating           = 0x4746
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagExifIFD          = 0x8769
+	tagISOSpeedRatings  = 0x8827
+	tagRecommendedEI    = 0x8832
+	tagDateTimeOriginal = 0x9003
+	tagExposureBias     = 0x9204
+	tagFocalLength      = 0x920A
+	tagMakerNote        = 0x927C
+	tagSubSecOriginal   = 0x9291
+	tagPixelXDimension  = 0xA002
+	tagPixelYDimension  = 0xA003
+	tagLensModel        = 0xA434
+
+	// Olympus maker note
+	tagOlympusEquipment = 0x2010
+	tagOlympusLensModel = 0x0203 // In the Equipment IFD
+)
+
+// maxIFDs bounds the number of IFDs followed, protecting against loops in corrupt files
+const maxIFDs = 32
+
+// ReadFile reads the EXIF metadata of a JPEG or TIFF-based RAW file (ORF, CR2, NEF, ARW,
+// DNG, RW2, PEF, ...) or a Fujifilm RAF file
+func ReadFile(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
+
+// Read reads EXIF metadata from a JPEG, TIFF-based RAW or RAF file
+func Read(r io.ReaderAt) (*Metadata, error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		return readJPEG(r, 0)
+	case string(header[:2]) == "II" || string(header[:2]) == "MM":
+		return readTIFF(r, 0)
+	case string(header[:15]) == "FUJIFILMCCD-RAW":
+		// RAF files embed a JPEG preview carrying the EXIF data
+		buf := make([]byte, 4)
+		if _, err := r.ReadAt(buf, 84); err != nil {
+			return nil, err
+		}
+		return readJPEG(r, int64(binary.BigEndian.Uint32(buf)))
+	}
+
+	return nil, fmt.Errorf("unsupported file format")
+}
+
+// xmpIdent is the identifier of an XMP APP1 segment
+const xmpIdent = "http://ns.adobe.com/xap/1.0/\x00"
+
+// readJPEG finds the EXIF and XMP APP1 segments of a JPEG starting at base and parses them
+func readJPEG(r io.ReaderAt, base int64) (*Metadata, error) {
+	var meta *Metadata
+	var xmp []byte
+
+	offset := base + 2
+	marker := make([]byte, 4)
+	for {
+		if _, err := r.ReadAt(marker, offset); err != nil {
+			break
+		}
+		if marker[0] != 0xFF || marker[1] == 0xDA {
+			break
+		}
+		length := int64(binary.BigEndian.Uint16(marker[2:]))
+
+		if marker[1] == 0xE1 && length > 8 {
+			segment := make([]byte, length-2)
+			if _, err := r.ReadAt(segment, offset+4); err == nil {
+				switch {
+				case meta == nil && string(segment[:6]) == "Exif\x00\x00":
+					meta, _ = readTIFF(r, offset+10)
+				case bytes.HasPrefix(segment, []byte(xmpIdent)):
+					xmp = segment[len(xmpIdent):]
+				}
+			}
+		}
+		offset += 2 + length
+	}
+
+	if meta == nil {
+		return nil, fmt.Errorf("no EXIF data found")
+	}
+	if meta.Rating == 0 {
+		meta.Rating = parseXMPRating(xmp)
+	}
+	return meta, nil
+}
+
+// tiff reads values from a TIFF structure starting at base within r
+type tiff struct {
+	r     io.ReaderAt
+	base  int64
+	order binary.ByteOrder
+}
+
+// entry is a raw IFD entry
+type entry struct {
+	typ   uint16
+	count uint32
+	value []byte // Value bytes (read from the offset for values larger than 4 bytes, nil above 1 MB)
+	pos   int64  // Position of the value bytes in r
+}
+
+// ifd maps tags to entries
+type ifd map[uint16]entry
+
+// openTIFF reads the TIFF header at base and returns the offset of the first IFD
+func openTIFF(r io.ReaderAt, base int64) (*tiff, uint32, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, base); err != nil {
+		return nil, 0, err
+	}
+
+	t := &tiff{r: r, base: base, order: byteOrder(header[:2])}
+	if t.order == nil {
+		return nil, 0, fmt.Errorf("invalid TIFF header")
+	}
+
+	// The magic number differs between RAW formats (42 for TIFF, "RO" for ORF, "U" for
+	// RW2), so only the byte order and the first IFD offset are relied on
+	return t, t.order.Uint32(header[4:]), nil
+}
+
+// readTIFF parses the TIFF structure at base and extracts the metadata
+func readTIFF(r io.ReaderAt, base int64) (*Metadata, error) {
+	t, first, err := openTIFF(r, base)
+	if err != nil {
+		return nil, err
+	}
+
+	ifds, err := t.readIFDChain(first)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{}
+	var all []ifd
+	for _, dir := range ifds {
+		all = append(all, dir)
+		if e, ok := dir[tagSubIFDs]; ok {
+			for _, off := range t.uints(e) {
+				if sub, err := t.readIFD(off); err == nil {
+					all = append(all, sub)
+				}
+			}
+		}
+	}
+
+	ifd0 := ifds[0]
+	meta.Make = t.str(ifd0[tagMake])
+	meta.Model = t.str(ifd0[tagModel])
+	meta.Orientation = t.uint(ifd0[tagOrientation])
+	meta.Rating = t.uint(ifd0[tagRating])
+	if meta.Rating == 0 {
+		meta.Rating = parseXMPRating(ifd0[tagXMP].value)
+	}
+
+	for _, dir := range all {
+		meta.setSize(t.uint(dir[tagImageWidth]), t.uint(dir[tagImageLength]))
+	}
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if exifIFD, err := t.readIFD(uint32(t.uint(e))); err == nil {
+			meta.DateTimeOriginal = parseDateTime(t.str(exifIFD[tagDateTimeOriginal]))
+			if !meta.DateTimeOriginal.IsZero() {
+				meta.DateTimeOriginal = meta.DateTimeOriginal.Add(parseSubSec(t.str(exifIFD[tagSubSecOriginal])))
+			}
+			meta.setSize(t.uint(exifIFD[tagPixelXDimension]), t.uint(exifIFD[tagPixelYDimension]))
+			meta.ExposureBias = t.rational(exifIFD[tagExposureBias])
+			meta.ExposureTime = t.rational(exifIFD[tagExposureTime])
+			meta.FNumber = t.rational(exifIFD[tagFNumber])
+			meta.FocalLength = t.rational(exifIFD[tagFocalLength])
+			meta.LensModel = t.str(exifIFD[tagLensModel])
+
+			// 65535 means the ISO didn't fit; newer cameras record it as RecommendedExposureIndex
+			meta.ISO = t.uint(exifIFD[tagISOSpeedRatings])
+			if meta.ISO == 0 || meta.ISO == 65535 {
+				if ei := t.uint(exifIFD[tagRecommendedEI]); ei > 0 {
+					meta.ISO = ei
+				}
+			}
+
+			// Olympus RAW files keep the lens name in the maker note only
+			if note, ok := exifIFD[tagMakerNote]; ok && meta.LensModel == "" {
+				if mn, dir := t.olympusMakerNote(note); dir != nil {
+					if equipment := mn.subIFD(dir[tagOlympusEquipment]); equipment != nil {
+						meta.LensModel = mn.str(equipment[tagOlympusLensModel])
+					}
+				}
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// setSize keeps the largest image size seen
+func (m *Metadata) setSize(width, height int) {
+	if width*height > m.Width*m.Height {
+		m.Width = width
+		m.Height = height
+	}
+}
+
+// readIFDChain reads the IFD at offset and all IFDs linked from it
+func (t *tiff) readIFDChain(offset uint32) ([]ifd, error) {
+	var ifds []ifd
+	seen := make(map[uint32]bool)
+
+	for offset != 0 && !seen[offset] && len(ifds) < maxIFDs {
+		seen[offset] = true
+		dir, next, err := t.readIFDWithNext(offset)
+		if err != nil {
+			if len(ifds) > 0 {
+				break
+			}
+			return nil, err
+		}
+		ifds = append(ifds, dir)
+		offset = next
+	}
+
+	if len(ifds) == 0 {
+		return nil, fmt.Errorf("no IFD found")
+	}
+	return ifds, nil
+}
+
+// readIFD reads a single IFD
+func (t *tiff) readIFD(offset uint32) (ifd, error) {
+	dir, _, err := t.readIFDWithNext(offset)
+	return dir, err
+}
+
+// readIFDWithNext reads a single IFD and returns the offset of the next one
+func (t *tiff) readIFDWithNext(offset uint32) (ifd, uint32, error) {
+	buf := make([]byte, 2)
+	if _, err := t.r.ReadAt(buf, t.base+int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	count := int(t.order.Uint16(buf))
+	if count == 0 || count > 1000 {
+		return nil, 0, fmt.Errorf("invalid IFD at offset %d", offset)
+	}
+
+	data := make([]byte, count*12+4)
+	if _, err := t.r.ReadAt(data, t.base+int64(offset)+2); err != nil {
+		return nil, 0, err
+	}
+
+	dir := make(ifd, count)
+	for i := 0; i < count; i++ {
+		raw := data[i*12 : i*12+12]
+		e := entry{
+			typ:   t.order.Uint16(raw[2:]),
+			count: t.order.Uint32(raw[4:]),
+		}
+
+		size := int64(typeSize(e.typ)) * int64(e.count)
+		if size == 0 {
+			continue
+		}
+		switch {
+		case size <= 4:
+			e.value = raw[8 : 8+size]
+			e.pos = t.base + int64(offset) + 2 + int64(i*12) + 8
+		case size > 1<<20:
+			// Large values are embedded images, located by their position only
+			e.pos = t.base + int64(t.order.Uint32(raw[8:]))
+		default:
+			e.pos = t.base + int64(t.order.Uint32(raw[8:]))
+			e.value = make([]byte, size)
+			if _, err := t.r.ReadAt(e.value, e.pos); err != nil {
+				continue
+			}
+		}
+		dir[t.order.Uint16(raw)] = e
+	}
+
+	return dir, t.order.Uint32(data[count*12:]), nil
+}
+
+// typeSize returns the size in bytes of a TIFF value type
+func typeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1
+	case 3, 8: // SHORT, SSHORT
+		return 2
+	case 4, 9, 11, 13: // LONG, SLONG, FLOAT, IFD
+		return 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		return 8
+	}
+	return 0
+}
+
+// uints returns the integer values of a SHORT or LONG entry
+func (t *tiff) uints(e entry) []uint32 {
+	var values []uint32
+	switch e.typ {
+	case 3, 8:
+		for i := 0; i+2 <= len(e.value); i += 2 {
+			values = append(values, uint32(t.order.Uint16(e.value[i:])))
+		}
+	case 4, 9, 13:
+		for i := 0; i+4 <= len(e.value); i += 4 {
+			values = append(values, t.order.Uint32(e.value[i:]))
+		}
+	}
+	return values
+}
+
+// uint returns the first integer value of an entry (0 if missing)
+func (t *tiff) uint(e entry) int {
+	values := t.uints(e)
+	if len(values) == 0 {
+		return 0
+	}
+	return int(values[0])
+}
+
+// rational returns the first value of a RATIONAL or SRATIONAL entry (0 if missing)
+func (t *tiff) rational(e entry) float64 {
+	if len(e.value) < 8 {
+		return 0
+	}
+	switch e.typ {
+	case 5:
+		num, den := t.order.Uint32(e.value), t.order.Uint32(e.value[4:])
+		if den != 0 {
+			return float64(num) / float64(den)
+		}
+	case 10:
+		num, den := int32(t.order.Uint32(e.value)), int32(t.order.Uint32(e.value[4:]))
+		if den != 0 {
+			return float64(num) / float64(den)
+		}
+	}
+	return 0
+}
+
+// str returns the value of an ASCII entry
+func (t *tiff) str(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.TrimRight(e.value, "\x00")))
+}
+
+// parseDateTime parses an EXIF date/time ("2006:01:02 15:04:05")
+func parseDateTime(value string) time.Time {
+	parsed, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// parseSubSec parses an EXIF SubSecTime value, the digits of the fraction of a second
+// ("25" = 0.25s); 0 if missing or invalid
+func parseSubSec(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0
+	}
+	frac, err := strconv.ParseFloat("0."+value, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(frac * float64(time.Second))
+}
+
+// xmpRatingPattern matches the rating in both XMP attribute and element form
+var xmpRatingPattern = regexp.MustCompile(`xmp:Rating(?:="|>)\s*(-?\d+)`)
+
+// parseXMPRating extracts the star rating from an XMP packet (0 if missing or rejected)
+func parseXMPRating(xmp []byte) int {
+	match := xmpRatingPattern.FindSubmatch(xmp)
+	if match == nil {
+		return 0
+	}
+	rating, err := strconv.Atoi(string(match[1]))
+	if err != nil || rating < 0 {
+		return 0
+	}
+	if rating > 5 {
+		rating = 5
+	}
+	return rating
+}
@@ -0,0 +1,233 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"os"
+)
+
+// Tags locating embedded JPEG previews
+const (
+	tagCompression         = 0x0103
+	tagStripOffsets        = 0x0111
+	tagStripByteCounts     = 0x0117
+	tagJPEGInterchange     = 0x0201
+	tagJPEGInterchangeLen  = 0x0202
+	tagPanasonicJpgFromRaw = 0x002E
+
+	// Olympus maker notes
+	tagOlympusPreviewStart    = 0x0088 // Older cameras, in the maker note IFD
+	tagOlympusPreviewLength   = 0x0089
+	tagOlympusCameraSettings  = 0x2020
+	tagOlympusCSPreviewStart  = 0x0101 // Newer cameras, in the CameraSettings IFD
+	tagOlympusCSPreviewLength = 0x0102
+)
+
+// maxPreviewSize bounds the size of an embedded preview, protecting against corrupt lengths
+const maxPreviewSize = 64 << 20
+
+// span is the location of an embedded image within a file
+type span struct {
+	offset int64
+	length int64
+}
+
+// ReadPreview returns the largest embedded JPEG preview of a RAW file along with its size
+// Previews are looked up in the TIFF IFDs (JPEGInterchangeFormat, JPEG-compressed strips),
+// the Olympus/OM System maker note, the Panasonic JpgFromRaw tag and the RAF header.
+func ReadPreview(path string) ([]byte, int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	var best span
+	bestWidth, bestHeight := 0, 0
+	for _, s := range previewSpans(f) {
+		if s.length <= 2 || s.length > maxPreviewSize {
+			continue
+		}
+		magic := make([]byte, 2)
+		if _, err := f.ReadAt(magic, s.offset); err != nil || magic[0] != 0xFF || magic[1] != 0xD8 {
+			continue
+		}
+		// Only the header is read here; lossless JPEG (the raw data of DNG and CR2 files)
+		// isn't supported by the decoder and is skipped
+		cfg, err := jpeg.DecodeConfig(io.NewSectionReader(f, s.offset, s.length))
+		if err != nil {
+			continue
+		}
+		if cfg.Width*cfg.Height > bestWidth*bestHeight {
+			best, bestWidth, bestHeight = s, cfg.Width, cfg.Height
+		}
+	}
+
+	if bestWidth == 0 {
+		return nil, 0, 0, fmt.Errorf("no embedded JPEG preview found")
+	}
+
+	data := make([]byte, best.length)
+	if _, err := f.ReadAt(data, best.offset); err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to read embedded preview: %v", err)
+	}
+	return data, bestWidth, bestHeight, nil
+}
+
+// previewSpans returns the locations of all embedded JPEG candidates of a RAW file
+func previewSpans(r io.ReaderAt) []span {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil
+	}
+
+	switch {
+	case string(header[:2]) == "II" || string(header[:2]) == "MM":
+		return tiffPreviewSpans(r, 0)
+	case string(header[:15]) == "FUJIFILMCCD-RAW":
+		// The RAF header holds the offset and length of the JPEG preview
+		buf := make([]byte, 8)
+		if _, err := r.ReadAt(buf, 84); err != nil {
+			return nil
+		}
+		return []span{{int64(binary.BigEndian.Uint32(buf)), int64(binary.BigEndian.Uint32(buf[4:]))}}
+	}
+	return nil
+}
+
+// tiffPreviewSpans collects the embedded JPEG candidates of a TIFF-based RAW file
+func tiffPreviewSpans(r io.ReaderAt, base int64) []span {
+	t, first, err := openTIFF(r, base)
+	if err != nil {
+		return nil
+	}
+	ifds, err := t.readIFDChain(first)
+	if err != nil {
+		return nil
+	}
+
+	var all []ifd
+	for _, dir := range ifds {
+		all = append(all, dir)
+		if e, ok := dir[tagSubIFDs]; ok {
+			for _, off := range t.uints(e) {
+				if sub, err := t.readIFD(off); err == nil {
+					all = append(all, sub)
+				}
+			}
+		}
+	}
+
+	var spans []span
+	for _, dir := range all {
+		if _, ok := dir[tagJPEGInterchange]; ok {
+			spans = append(spans, span{base + int64(t.uint(dir[tagJPEGInterchange])), int64(t.uint(dir[tagJPEGInterchangeLen]))})
+		}
+		// JPEG-compressed images stored as a single strip (CR2, DNG previews)
+		if c := t.uint(dir[tagCompression]); c == 6 || c == 7 {
+			offsets, counts := t.uints(dir[tagStripOffsets]), t.uints(dir[tagStripByteCounts])
+			if len(offsets) == 1 && len(counts) == 1 {
+				spans = append(spans, span{base + int64(offsets[0]), int64(counts[0])})
+			}
+		}
+		if e, ok := dir[tagPanasonicJpgFromRaw]; ok && e.typ == 7 {
+			spans = append(spans, span{e.pos, int64(e.count)})
+		}
+	}
+
+	if e, ok := ifds[0][tagExifIFD]; ok {
+		if exifIFD, err := t.readIFD(uint32(t.uint(e))); err == nil {
+			if note, ok := exifIFD[tagMakerNote]; ok {
+				spans = append(spans, t.olympusPreviewSpans(note)...)
+			}
+		}
+	}
+
+	return spans
+}
+
+// olympusPreviewSpans locates the preview in an Olympus or OM System maker note
+func (t *tiff) olympusPreviewSpans(note entry) []span {
+	mn, dir := t.olympusMakerNote(note)
+	if dir == nil {
+		return nil
+	}
+
+	var spans []span
+	if _, ok := dir[tagOlympusPreviewStart]; ok {
+		spans = append(spans, span{mn.base + int64(mn.uint(dir[tagOlympusPreviewStart])), int64(mn.uint(dir[tagOlympusPreviewLength]))})
+	}
+	if settings := mn.subIFD(dir[tagOlympusCameraSettings]); settings != nil {
+		if _, ok := settings[tagOlympusCSPreviewStart]; ok {
+			spans = append(spans, span{mn.base + int64(mn.uint(settings[tagOlympusCSPreviewStart])), int64(mn.uint(settings[tagOlympusCSPreviewLength]))})
+		}
+	}
+
+	return spans
+}
+
+// olympusMakerNote reads the IFD of an Olympus or OM System maker note (nil for other makers)
+// Newer maker notes have their own byte order and offsets relative to the maker note;
+// older ones ("OLYMP") use the offsets and byte order of the enclosing TIFF structure.
+func (t *tiff) olympusMakerNote(note entry) (*tiff, ifd) {
+	header := make([]byte, 16)
+	if _, err := t.r.ReadAt(header, note.pos); err != nil {
+		return nil, nil
+	}
+
+	mn := &tiff{r: t.r, base: t.base, order: t.order}
+	var ifdOffset uint32
+	switch {
+	case bytes.HasPrefix(header, []byte("OM SYSTEM\x00\x00\x00")):
+		mn.base = note.pos
+		mn.order = byteOrder(header[12:14])
+		ifdOffset = 16
+	case bytes.HasPrefix(header, []byte("OLYMPUS\x00")):
+		mn.base = note.pos
+		mn.order = byteOrder(header[8:10])
+		ifdOffset = 12
+	case bytes.HasPrefix(header, []byte("OLYMP\x00")):
+		ifdOffset = uint32(note.pos - t.base + 8)
+	default:
+		return nil, nil
+	}
+	if mn.order == nil {
+		return nil, nil
+	}
+
+	dir, err := mn.readIFD(ifdOffset)
+	if err != nil {
+		return nil, nil
+	}
+	return mn, dir
+}
+
+// subIFD reads a maker note sub-IFD, stored either as a pointer or as the entry's value
+func (t *tiff) subIFD(e entry) ifd {
+	if e.typ == 0 {
+		return nil
+	}
+	offset := uint32(e.pos - t.base)
+	if e.typ == 4 || e.typ == 13 {
+		offset = uint32(t.uint(e))
+	}
+	dir, err := t.readIFD(offset)
+	if err != nil {
+		return nil
+	}
+	return dir
+}
+
+// byteOrder returns the byte order for a TIFF byte order mark (nil if invalid)
+func byteOrder(mark []byte) binary.ByteOrder {
+	switch string(mark) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
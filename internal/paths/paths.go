@@ -0,0 +1,37 @@
+package paths
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HomeEnv is the environment variable that sets the data directory
+const HomeEnv = "C2I_HOME"
+
+// dataDirOverride is the data directory set with --data-dir
+var dataDirOverride string
+
+// SetDataDir overrides the data directory (--data-dir)
+func SetDataDir(dir string) {
+	dataDirOverride = dir
+}
+
+// DataDir returns the directory for the config, state, caches and default output:
+// the --data-dir override, $C2I_HOME, or ~/.camera-to-immich
+// The explicit settings also make the tool usable where no home directory is available
+// (e.g. some services and containers).
+func DataDir() (string, error) {
+	if dataDirOverride != "" {
+		return dataDirOverride, nil
+	}
+	if dir := os.Getenv(HomeEnv); dir != "" {
+		return dir, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory (set %s or use --data-dir): %v", HomeEnv, err)
+	}
+	return filepath.Join(homeDir, ".camera-to-immich"), nil
+}
@@ -0,0 +1,216 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/exif"
+)
+
+// Contact sheet layout
+const (
+	contactSheetColumns = 8   // Thumbnails per row
+	contactSheetRows    = 25  // Rows per page, keeping each page far below the 65535 px JPEG limit
+	contactSheetCell    = 240 // Size of the square cell each thumbnail is fitted into
+	contactSheetPadding = 8   // Space around and between thumbnails
+	contactSheetQuality = 85  // JPEG quality of the contact sheet
+)
+
+// contactSheetBackground is the color behind the thumbnails
+var contactSheetBackground = color.RGBA{R: 32, G: 32, B: 32, A: 255}
+
+// GenerateContactSheet composites thumbnails of the given JPEGs into a grid and writes it
+// to outputPath as a JPEG, returning the paths of the pages written and the number of
+// images on them
+// A grid of more than contactSheetRows rows is split into pages named like outputPath with
+// "-1", "-2", ... before the extension. Thumbnails keep their aspect ratio and are shown
+// upright (EXIF orientation is applied). Files that can't be decoded are left out; it fails
+// only if none can be.
+func GenerateContactSheet(jpegPaths []string, outputPath string) ([]string, int, error) {
+	perPage := contactSheetColumns * contactSheetRows
+	pagePath := func(page int) string {
+		if len(jpegPaths) <= perPage {
+			return outputPath
+		}
+		ext := filepath.Ext(outputPath)
+		return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(outputPath, ext), page, ext)
+	}
+
+	// Thumbnails are decoded one page at a time so a large import doesn't hold them all
+	var pages []string
+	var thumbs []image.Image
+	count := 0
+	writePage := func() error {
+		path := pagePath(len(pages) + 1)
+		if err := writeContactSheetPage(thumbs, path); err != nil {
+			return err
+		}
+		pages = append(pages, path)
+		count += len(thumbs)
+		thumbs = thumbs[:0]
+		return nil
+	}
+
+	for _, path := range jpegPaths {
+		thumb, err := contactSheetThumbnail(path)
+		if err != nil {
+			continue
+		}
+		thumbs = append(thumbs, thumb)
+		if len(thumbs) == perPage {
+			if err := writePage(); err != nil {
+				return pages, count, err
+			}
+		}
+	}
+	if len(thumbs) > 0 {
+		if err := writePage(); err != nil {
+			return pages, count, err
+		}
+	}
+	if count == 0 {
+		return nil, 0, fmt.Errorf("no images could be read")
+	}
+
+	return pages, count, nil
+}
+
+// writeContactSheetPage writes one page of thumbnails as a JPEG grid
+func writeContactSheetPage(thumbs []image.Image, outputPath string) error {
+	columns := contactSheetColumns
+	if len(thumbs) < columns {
+		columns = len(thumbs)
+	}
+	rows := (len(thumbs) + columns - 1) / columns
+	step := contactSheetCell + contactSheetPadding
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*step+contactSheetPadding, rows*step+contactSheetPadding))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{C: contactSheetBackground}, image.Point{}, draw.Src)
+
+	for i, thumb := range thumbs {
+		// Center the thumbnail in its cell
+		size := thumb.Bounds().Size()
+		x := contactSheetPadding + (i%columns)*step + (contactSheetCell-size.X)/2
+		y := contactSheetPadding + (i/columns)*step + (contactSheetCell-size.Y)/2
+		draw.Draw(sheet, image.Rect(x, y, x+size.X, y+size.Y), thumb, thumb.Bounds().Min, draw.Src)
+	}
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create contact sheet: %v", err)
+	}
+	if err := jpeg.Encode(f, sheet, &jpeg.Options{Quality: contactSheetQuality}); err != nil {
+		f.Close()
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to encode contact sheet: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write contact sheet: %v", err)
+	}
+	return nil
+}
+
+// contactSheetThumbnail decodes a JPEG and scales it down to fit a contact sheet cell
+func contactSheetThumbnail(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", filepath.Base(path), err)
+	}
+
+	orientation := 1
+	if _, err := f.Seek(0, io.SeekStart); err == nil {
+		if meta, err := exif.Read(f); err == nil && meta.Orientation >= 1 && meta.Orientation <= 8 {
+			orientation = meta.Orientation
+		}
+	}
+
+	return scaleToFit(img, orientation, contactSheetCell), nil
+}
+
+// scaleToFit returns img rotated/flipped upright for the EXIF orientation and scaled down
+// so its longer side is at most size pixels
+// Each thumbnail pixel averages a small grid of samples from the source area it covers,
+// which is fast on large photos and avoids most of the aliasing of plain sampling.
+func scaleToFit(img image.Image, orientation, size int) image.Image {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap width and height once applied
+	dispW, dispH := srcW, srcH
+	if orientation >= 5 {
+		dispW, dispH = srcH, srcW
+	}
+
+	w, h := dispW, dispH
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, dispH*size/dispW
+		} else {
+			w, h = dispW*size/dispH, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	const samples = 3 // Samples per axis averaged into each thumbnail pixel
+
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	for ty := 0; ty < h; ty++ {
+		for tx := 0; tx < w; tx++ {
+			var r, g, bl uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					// Position in the upright image, then mapped back to stored pixels
+					dx := (tx*samples + sx) * dispW / (w * samples)
+					dy := (ty*samples + sy) * dispH / (h * samples)
+					px, py := orientedSource(dx, dy, srcW, srcH, orientation)
+					cr, cg, cb, _ := img.At(b.Min.X+px, b.Min.Y+py).RGBA()
+					r, g, bl = r+cr, g+cg, bl+cb
+				}
+			}
+			n := uint32(samples * samples)
+			thumb.SetRGBA(tx, ty, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: 255})
+		}
+	}
+	return thumb
+}
+
+// orientedSource maps a pixel of the upright (displayed) image to the stored pixel for an
+// EXIF orientation
+func orientedSource(x, y, w, h, orientation int) (int, int) {
+	switch orientation {
+	case 2: // Mirrored horizontally
+		return w - 1 - x, y
+	case 3: // Rotated 180
+		return w - 1 - x, h - 1 - y
+	case 4: // Mirrored vertically
+		return x, h - 1 - y
+	case 5: // Mirrored horizontally and rotated 270 CW
+		return y, x
+	case 6: // Rotated 90 CW
+		return y, h - 1 - x
+	case 7: // Mirrored horizontally and rotated 90 CW
+		return w - 1 - y, h - 1 - x
+	case 8: // Rotated 270 CW
+		return w - 1 - y, x
+	default:
+		return x, y
+	}
+}
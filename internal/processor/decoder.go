@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Decoder converts a RAW file into an intermediate file that RawTherapee can read
+// It is the optional front-end step for cameras RawTherapee doesn't support natively
+type Decoder interface {
+	// ConvertFile converts a single RAW file and returns the path of the intermediate file
+	ConvertFile(inputPath string) (string, error)
+}
+
+// Placeholders substituted in the arguments of a decoder command
+const (
+	placeholderInput  = "{input}"
+	placeholderOutput = "{output}"
+)
+
+// CommandDecoderConfig contains configuration for an external RAW decoder command
+type CommandDecoderConfig struct {
+	Command   []string // Executable and arguments; "{input}" and "{output}" are substituted
+	OutputDir string   // Directory for the intermediate TIFF files
+}
+
+// CommandDecoder decodes RAW files to TIFF with an external tool such as dcraw or LibRaw's
+// dcraw_emu. Without an "{output}" argument the command's stdout is written to the TIFF.
+type CommandDecoder struct {
+	config CommandDecoderConfig
+}
+
+// NewCommandDecoder creates a new external command decoder
+func NewCommandDecoder(config CommandDecoderConfig) (*CommandDecoder, error) {
+	if len(config.Command) == 0 || config.Command[0] == "" {
+		return nil, fmt.Errorf("raw decoder command is empty")
+	}
+
+	if _, err := exec.LookPath(config.Command[0]); err != nil {
+		return nil, fmt.Errorf("raw decoder '%s' not found: %v", config.Command[0], err)
+	}
+
+	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create decoder output directory: %v", err)
+	}
+
+	return &CommandDecoder{config: config}, nil
+}
+
+// ConvertFile decodes a single RAW file and returns the path to the output TIFF
+func (cd *CommandDecoder) ConvertFile(inputPath string) (string, error) {
+	outputPath := outputPathIn(cd.config.OutputDir, inputPath, ".tif")
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	writesOutput := false
+	args := make([]string, 0, len(cd.config.Command)-1)
+	for _, arg := range cd.config.Command[1:] {
+		if strings.Contains(arg, placeholderOutput) {
+			writesOutput = true
+		}
+		arg = strings.ReplaceAll(arg, placeholderInput, inputPath)
+		arg = strings.ReplaceAll(arg, placeholderOutput, outputPath)
+		args = append(args, arg)
+	}
+
+	cmd := exec.Command(cd.config.Command[0], args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if writesOutput {
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("raw decoder failed: %v\nOutput: %s%s", err, stdout.String(), stderr.String())
+		}
+	} else {
+		out, err := os.Create(outputPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to create %s: %v", outputPath, err)
+		}
+		cmd.Stdout = out
+		runErr := cmd.Run()
+		closeErr := out.Close()
+		if runErr != nil {
+			os.Remove(outputPath)
+			return "", fmt.Errorf("raw decoder failed: %v\nOutput: %s", runErr, stderr.String())
+		}
+		if closeErr != nil {
+			os.Remove(outputPath)
+			return "", fmt.Errorf("failed to write %s: %v", outputPath, closeErr)
+		}
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil || info.Size() == 0 {
+		return "", fmt.Errorf("raw decoder produced no output at %s\nOutput: %s", outputPath, stderr.String())
+	}
+
+	return outputPath, nil
+}
@@ -12,10 +12,14 @@ import (
 
 // DNGConverterConfig contains configuration for Adobe DNG Converter
 type DNGConverterConfig struct {
-	ExecutablePath string // Path to Adobe DNG Converter executable
-	OutputDir      string // Directory for converted DNG files
-	Compressed     bool   // Use compressed DNG format
-	EmbedOriginal  bool   // Embed original raw file in DNG
+	ExecutablePath   string        // Path to Adobe DNG Converter executable
+	OutputDir        string        // Directory for converted DNG files
+	Compressed       bool          // Use compressed DNG format
+	EmbedOriginal    bool          // Embed original raw file in DNG
+	CameraRawVersion string        // Camera Raw compatibility, e.g. "7.1" (empty = converter default)
+	DNGVersion       string        // DNG version, e.g. "1.4" (empty = converter default)
+	WaitTimeout      time.Duration // How long to wait for the output file to be fully written
+	SettleTime       time.Duration // How long the output file must stay unchanged to count as fully written
 }
 
 // DNGConverter handles converting RAW files to DNG format using Adobe DNG Converter
@@ -39,6 +43,13 @@ func NewDNGConverter(config DNGConverterConfig) (*DNGConverter, error) {
 		return nil, fmt.Errorf("Adobe DNG Converter not found at '%s'", config.ExecutablePath)
 	}
 
+	if config.WaitTimeout <= 0 {
+		config.WaitTimeout = 10 * time.Second
+	}
+	if config.SettleTime <= 0 {
+		config.SettleTime = 500 * time.Millisecond
+	}
+
 	// Ensure output directory exists
 	if config.OutputDir != "" {
 		if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
@@ -53,15 +64,19 @@ func NewDNGConverter(config DNGConverterConfig) (*DNGConverter, error) {
 func (dc *DNGConverter) ConvertFile(inputPath string) (string, error) {
 	// Determine output path
 	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-	outputPath := filepath.Join(dc.config.OutputDir, baseName+".dng")
+	outputPath := outputPathIn(dc.config.OutputDir, inputPath, ".dng")
+	outputDir := filepath.Dir(outputPath)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create DNG output directory: %v", err)
+	}
 
 	// Build command arguments
 	// Adobe DNG Converter CLI arguments:
 	// -c : Convert to DNG
 	// -d : Output directory
 	// -o : Output filename pattern
-	// -cr7.1 : Camera Raw 7.1 compatibility
-	// -dng1.4 : DNG version 1.4
+	// -cr7.1 : Camera Raw 7.1 compatibility (CameraRawVersion)
+	// -dng1.4 : DNG version 1.4 (DNGVersion)
 	// -p0 : No preview (faster)
 	// -fl : Fast load
 	// -lossy : Use lossy compression (optional, smaller files)
@@ -69,7 +84,7 @@ func (dc *DNGConverter) ConvertFile(inputPath string) (string, error) {
 	
 	args := []string{
 		"-c",                          // Convert
-		"-d", dc.config.OutputDir,     // Output directory
+		"-d", outputDir,               // Output directory
 		"-o", baseName + ".dng",       // Output filename
 	}
 
@@ -83,6 +98,14 @@ func (dc *DNGConverter) ConvertFile(inputPath string) (string, error) {
 		args = append(args, "-e") // Embed original raw
 	}
 
+	// Add compatibility options
+	if dc.config.CameraRawVersion != "" {
+		args = append(args, "-cr"+dc.config.CameraRawVersion)
+	}
+	if dc.config.DNGVersion != "" {
+		args = append(args, "-dng"+dc.config.DNGVersion)
+	}
+
 	// Add input file
 	args = append(args, inputPath)
 
@@ -95,20 +118,54 @@ func (dc *DNGConverter) ConvertFile(inputPath string) (string, error) {
 		return "", fmt.Errorf("Adobe DNG Converter failed: %v\nOutput: %s", err, string(output))
 	}
 
-	// Wait a bit for file to be fully written (DNG Converter can exit before file is complete)
-	time.Sleep(500 * time.Millisecond)
+	// DNG Converter can exit before the file is complete, so wait until the output
+	// exists and its size stops changing
+	alternateOutputPath := filepath.Join(outputDir, baseName+".DNG")
+	path, err := waitForStableFile([]string{outputPath, alternateOutputPath}, dc.config.SettleTime, dc.config.WaitTimeout)
+	if err != nil {
+		return "", fmt.Errorf("%v\nCommand output: %s", err, string(output))
+	}
+
+	return path, nil
+}
 
-	// Verify output file was created
-	if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-		// Try alternate output path patterns
-		alternateOutputPath := filepath.Join(dc.config.OutputDir, baseName+".DNG")
-		if _, err := os.Stat(alternateOutputPath); err == nil {
-			return alternateOutputPath, nil
+// waitForStableFile polls until one of the candidate paths exists with a non-zero size
+// and modification time that stayed unchanged for the settle time, and returns that path
+// A single unchanged poll isn't enough: the converter can pause between writes for longer
+// than a poll interval.
+func waitForStableFile(candidates []string, settle, timeout time.Duration) (string, error) {
+	const pollInterval = 50 * time.Millisecond
+
+	deadline := time.Now().Add(timeout)
+	lastPath := ""
+	lastSize := int64(-1)
+	var lastModTime, stableSince time.Time
+
+	for {
+		for _, path := range candidates {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if path != lastPath || info.Size() != lastSize || !info.ModTime().Equal(lastModTime) {
+				lastPath = path
+				lastSize = info.Size()
+				lastModTime = info.ModTime()
+				stableSince = time.Now()
+			} else if info.Size() > 0 && time.Since(stableSince) >= settle {
+				return path, nil
+			}
+			break
 		}
-		return "", fmt.Errorf("DNG output file was not created: %s\nCommand output: %s", outputPath, string(output))
-	}
 
-	return outputPath, nil
+		if time.Now().After(deadline) {
+			if lastPath == "" {
+				return "", fmt.Errorf("DNG output file was not created: %s", candidates[0])
+			}
+			return "", fmt.Errorf("DNG output file was still being written after %v: %s", timeout, lastPath)
+		}
+		time.Sleep(pollInterval)
+	}
 }
 
 // GetOutputDir returns the output directory
@@ -0,0 +1,338 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/exif"
+)
+
+// JPEG markers used when editing metadata
+const (
+	markerSOI  = 0xD8
+	markerSOS  = 0xDA
+	markerAPP0 = 0xE0
+	markerAPP1 = 0xE1
+	markerEOI  = 0xD9
+)
+
+// ValidateJPEG checks that a file is a complete JPEG: non-empty, starting with the JPEG
+// magic bytes, ending with an end-of-image marker, and with a decodable header
+func ValidateJPEG(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", filepath.Base(path))
+	}
+
+	magic := make([]byte, 3)
+	if _, err := io.ReadFull(f, magic); err != nil || magic[0] != 0xFF || magic[1] != markerSOI || magic[2] != 0xFF {
+		return fmt.Errorf("%s is not a JPEG file", filepath.Base(path))
+	}
+
+	// Encoders may pad after the end-of-image marker, so look for it near the end
+	tailSize := int64(64)
+	if info.Size() < tailSize {
+		tailSize = info.Size()
+	}
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, info.Size()-tailSize); err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(path), err)
+	}
+	if !bytes.Contains(tail, []byte{0xFF, markerEOI}) {
+		return fmt.Errorf("%s is truncated (no end-of-image marker)", filepath.Base(path))
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s has an invalid JPEG header: %v", filepath.Base(path), err)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return fmt.Errorf("%s has no image dimensions", filepath.Base(path))
+	}
+
+	return nil
+}
+
+// JPEGSize returns the width and height of a JPEG file
+func JPEGSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s has an invalid JPEG header: %v", filepath.Base(path), err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// SetJPEGDPI sets the resolution metadata of a JPEG file to the given DPI
+// It updates the JFIF density (adding a JFIF header if there is none) and the EXIF
+// XResolution/YResolution tags if present. Image data is left untouched.
+func SetJPEGDPI(path string, dpi int) error {
+	if dpi < 1 || dpi > 65535 {
+		return fmt.Errorf("invalid DPI: %d", dpi)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read JPEG: %v", err)
+	}
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return fmt.Errorf("not a JPEG file: %s", path)
+	}
+
+	hasJFIF := false
+
+	// Walk the metadata segments up to the start of the image data
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return fmt.Errorf("corrupt JPEG marker at offset %d", i)
+		}
+		marker := data[i+1]
+		if marker == markerSOS {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return fmt.Errorf("corrupt JPEG segment at offset %d", i)
+		}
+		segment := data[i+4 : end]
+
+		switch {
+		case marker == markerAPP0 && len(segment) >= 12 && string(segment[:5]) == "JFIF\x00":
+			// Layout: "JFIF\0", version (2), units (1), Xdensity (2), Ydensity (2)
+			segment[7] = 1 // Dots per inch
+			binary.BigEndian.PutUint16(segment[8:], uint16(dpi))
+			binary.BigEndian.PutUint16(segment[10:], uint16(dpi))
+			hasJFIF = true
+		case marker == markerAPP1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00":
+			setExifResolution(segment[6:], dpi)
+		}
+
+		i = end
+	}
+
+	if !hasJFIF {
+		jfif := []byte{
+			0xFF, markerAPP0, 0x00, 0x10,
+			'J', 'F', 'I', 'F', 0x00,
+			0x01, 0x01, // Version 1.1
+			0x01,                      // Dots per inch
+			byte(dpi >> 8), byte(dpi), // Xdensity
+			byte(dpi >> 8), byte(dpi), // Ydensity
+			0x00, 0x00, // No thumbnail
+		}
+		withJFIF := make([]byte, 0, len(data)+len(jfif))
+		withJFIF = append(withJFIF, data[:2]...)
+		withJFIF = append(withJFIF, jfif...)
+		data = append(withJFIF, data[2:]...)
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// setExifResolution updates the resolution tags of IFD0 in a TIFF/EXIF block in place
+func setExifResolution(tiff []byte, dpi int) {
+	if len(tiff) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return
+		}
+		tag := order.Uint16(tiff[entry:])
+		switch tag {
+		case 0x011A, 0x011B: // XResolution, YResolution (RATIONAL, stored at an offset)
+			offset := int(order.Uint32(tiff[entry+8:]))
+			if offset+8 <= len(tiff) {
+				order.PutUint32(tiff[offset:], uint32(dpi))
+				order.PutUint32(tiff[offset+4:], 1)
+			}
+		case 0x0128: // ResolutionUnit (SHORT, stored inline)
+			order.PutUint16(tiff[entry+8:], 2) // Inches
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place,
+// so an interrupted write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// JPEGOrientation is the stored pixel size and EXIF orientation of a JPEG
+type JPEGOrientation struct {
+	Width       int // Stored pixel width
+	Height      int // Stored pixel height
+	Orientation int // EXIF orientation (1-8), 0 if missing
+}
+
+// Portrait reports whether the image is displayed as portrait once the orientation is applied
+func (o JPEGOrientation) Portrait() bool {
+	// Orientations 5-8 rotate the image by 90 degrees, swapping width and height
+	return (o.Orientation >= 5) != (o.Height > o.Width)
+}
+
+// ReadJPEGOrientation reads the pixel size and EXIF orientation of a JPEG file
+func ReadJPEGOrientation(path string) (JPEGOrientation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return JPEGOrientation{}, err
+	}
+	defer f.Close()
+
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		return JPEGOrientation{}, fmt.Errorf("failed to read JPEG header: %v", err)
+	}
+
+	result := JPEGOrientation{Width: cfg.Width, Height: cfg.Height}
+	if meta, err := exif.Read(f); err == nil {
+		result.Orientation = meta.Orientation
+	}
+	return result, nil
+}
+
+// SetJPEGOrientation sets the EXIF orientation tag of a JPEG file in place
+// The file must already have an EXIF orientation tag; image data is left untouched.
+func SetJPEGOrientation(path string, orientation int) error {
+	if orientation < 1 || orientation > 8 {
+		return fmt.Errorf("invalid orientation: %d", orientation)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read JPEG: %v", err)
+	}
+
+	tiff := findExifTIFF(data)
+	if tiff == nil {
+		return fmt.Errorf("%s has no EXIF data", filepath.Base(path))
+	}
+	if !setExifShort(tiff, 0x0112, uint16(orientation)) {
+		return fmt.Errorf("%s has no EXIF orientation tag", filepath.Base(path))
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// findExifTIFF returns the TIFF block of the EXIF APP1 segment of a JPEG (nil if missing)
+// The returned slice aliases data, so changes to it edit the JPEG in place.
+func findExifTIFF(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF || data[i+1] == markerSOS {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[i+4 : end]
+		if data[i+1] == markerAPP1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+// setExifShort sets an inline SHORT tag of IFD0 in a TIFF/EXIF block in place
+// Returns false if the tag isn't present.
+func setExifShort(tiff []byte, tag uint16, value uint16) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return false
+		}
+		if order.Uint16(tiff[entry:]) == tag && order.Uint16(tiff[entry+2:]) == 3 {
+			order.PutUint16(tiff[entry+8:], value)
+			return true
+		}
+	}
+	return false
+}
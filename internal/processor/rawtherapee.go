@@ -1,25 +1,55 @@
 package processor
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/cmdline"
 )
 
 // RawTherapeeConfig contains configuration for RawTherapee processing
 type RawTherapeeConfig struct {
-	ExecutablePath string // Path to rawtherapee-cli executable
-	ProfilePath    string // Path to the PP3 profile file
-	OutputDir      string // Directory for processed JPEGs
-	Quality        int    // JPEG quality (1-100)
+	ExecutablePath string            // Path to rawtherapee-cli executable
+	ProfilePath    string            // Path to the PP3 profile file
+	OutputDir      string            // Directory for processed JPEGs
+	TIFFOutputDir  string            // Also write a TIFF of each file to this directory (empty = JPEG only)
+	TIFFBitDepth   int               // Bits per channel of the TIFFs: 8 or 16 (0 = 16)
+	Quality        int               // JPEG quality (1-100)
+	DPI            int               // Resolution written into the output metadata (0 = RawTherapee default)
+	VerifyOutput   bool              // Reject outputs that aren't complete, decodable JPEGs
+	Overwrite      bool              // Overwrite existing outputs (otherwise they are kept and returned with ErrOutputExists)
+	KeepSidecars   bool              // Keep the .pp3 sidecars rawtherapee-cli may write next to outputs (otherwise they are deleted)
+	Overrides      map[string]string // PP3 values replacing those of the profile, by "Section/Key" (e.g. "Exposure/Compensation")
+	Progress       ProgressFunc      // Receives progress parsed from rawtherapee-cli output (nil = output is only captured)
 }
 
+// ProgressFunc receives progress parsed from rawtherapee-cli output: the file being
+// processed and its completion percentage (0 when it starts, 100 when it is done)
+// It may be called from several workers at once.
+type ProgressFunc func(inputPath string, percent int)
+
+// ErrOutputExists is returned together with the output path when the output already
+// exists and overwriting is disabled
+var ErrOutputExists = errors.New("output already exists")
+
 // RawTherapee handles processing ORF files with RawTherapee CLI
 type RawTherapee struct {
-	config RawTherapeeConfig
+	config      RawTherapeeConfig
+	profilePath string // Profile passed to rawtherapee-cli: ProfilePath, or a copy with Overrides merged in
+	mergedDir   string // Temp directory of the merged profile (removed by Close)
 }
 
 // NewRawTherapee creates a new RawTherapee processor
@@ -51,52 +81,626 @@ func NewRawTherapee(config RawTherapeeConfig) (*RawTherapee, error) {
 			return nil, fmt.Errorf("failed to create output directory: %v", err)
 		}
 	}
+	if config.TIFFOutputDir != "" {
+		if err := os.MkdirAll(config.TIFFOutputDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create TIFF output directory: %v", err)
+		}
+	}
+
+	rt := &RawTherapee{config: config, profilePath: config.ProfilePath}
+	if len(config.Overrides) > 0 {
+		if err := rt.writeMergedProfile(); err != nil {
+			return nil, err
+		}
+	}
+	return rt, nil
+}
 
-	return &RawTherapee{config: config}, nil
+// Close removes the merged profile written for Overrides
+func (rt *RawTherapee) Close() {
+	if rt.mergedDir != "" {
+		os.RemoveAll(rt.mergedDir)
+	}
 }
 
-// ProcessFile processes a single ORF file and returns the path to the output JPEG
-func (rt *RawTherapee) ProcessFile(inputPath string) (string, error) {
+// writeMergedProfile writes a copy of the profile with the overrides applied to a temp
+// directory and uses it instead of the profile
+func (rt *RawTherapee) writeMergedProfile() error {
+	var base []byte
+	if rt.config.ProfilePath != "" {
+		var err error
+		if base, err = os.ReadFile(rt.config.ProfilePath); err != nil {
+			return fmt.Errorf("failed to read profile: %v", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "camera-to-immich-pp3-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory for the merged profile: %v", err)
+	}
+	path := filepath.Join(dir, ProfileName(rt.config.ProfilePath)+".pp3")
+	if err := os.WriteFile(path, mergeProfile(base, rt.config.Overrides), 0644); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to write the merged profile: %v", err)
+	}
+
+	rt.profilePath = path
+	rt.mergedDir = dir
+	return nil
+}
+
+// mergeProfile applies overrides ("Section/Key" -> value) to the content of a PP3 profile
+// Keys the profile doesn't have are added at the end of their section, which is created
+// if needed.
+func mergeProfile(base []byte, overrides map[string]string) []byte {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(base), "\r\n", "\n"), "\n"), "\n")
+	applied := make(map[string]bool)
+	lastLine := make(map[string]int) // Section -> index of its last non-empty line
+
+	section := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = trimmed[1 : len(trimmed)-1]
+			lastLine[section] = i
+			continue
+		}
+		if trimmed != "" && section != "" {
+			lastLine[section] = i
+		}
+		key, _, ok := strings.Cut(trimmed, "=")
+		if !ok || section == "" {
+			continue
+		}
+		name := section + "/" + strings.TrimSpace(key)
+		if value, ok := overrides[name]; ok {
+			lines[i] = strings.TrimSpace(key) + "=" + value
+			applied[name] = true
+		}
+	}
+
+	// Missing keys by section, in a stable order
+	missing := make(map[string][]string)
+	var names []string
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var newSections []string
+	for _, name := range names {
+		if applied[name] {
+			continue
+		}
+		section, key, _ := strings.Cut(name, "/")
+		if _, ok := lastLine[section]; !ok && len(missing[section]) == 0 {
+			newSections = append(newSections, section)
+		}
+		missing[section] = append(missing[section], key+"="+overrides[name])
+	}
+
+	var out []string
+	for i, line := range lines {
+		out = append(out, line)
+		for section, last := range lastLine {
+			if last == i {
+				out = append(out, missing[section]...)
+			}
+		}
+	}
+	for _, section := range newSections {
+		out = append(out, "", "["+section+"]")
+		out = append(out, missing[section]...)
+	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// ProcessFile processes a single ORF file and returns the path to the output JPEG along
+// with the warnings rawtherapee-cli printed for it
+func (rt *RawTherapee) ProcessFile(inputPath string) (string, []string, error) {
 	// Determine output path
-	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-	outputPath := filepath.Join(rt.config.OutputDir, baseName+".jpg")
+	outputPath := rt.outputPathFor(inputPath)
+
+	if !rt.config.Overwrite {
+		if _, err := os.Stat(outputPath); err == nil {
+			return outputPath, nil, ErrOutputExists
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
 
 	// Build command arguments
 	args := []string{
 		"-o", outputPath,
 		"-j" + fmt.Sprintf("%d", rt.config.Quality), // JPEG quality
-		"-Y", // Overwrite output if exists
+		"-Y", // Overwrite output if exists (existing outputs were handled above)
 	}
 
 	// Add profile if specified
-	if rt.config.ProfilePath != "" {
-		args = append(args, "-p", rt.config.ProfilePath)
+	if rt.profilePath != "" {
+		args = append(args, "-p", rt.profilePath)
 	}
 
 	// Add input file
 	args = append(args, "-c", inputPath)
 
 	// Execute rawtherapee-cli
-	cmd := exec.Command(rt.config.ExecutablePath, args...)
-	output, err := cmd.CombinedOutput()
+	output, err := rt.run(args, []string{inputPath})
 	if err != nil {
-		return "", fmt.Errorf("rawtherapee-cli failed: %v\nOutput: %s", err, string(output))
+		return "", nil, fmt.Errorf("rawtherapee-cli failed: %v\nOutput: %s", err, string(output))
 	}
 
 	// Verify output file was created
 	if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("output file was not created: %s", outputPath)
+		return "", nil, fmt.Errorf("output file was not created: %s", outputPath)
+	}
+
+	if err := rt.finishOutput(outputPath); err != nil {
+		return "", nil, err
+	}
+
+	if rt.config.TIFFOutputDir != "" {
+		if errs := rt.writeTIFFs([]string{inputPath}); errs[0] != nil {
+			return "", nil, errs[0]
+		}
+	}
+
+	return outputPath, parseWarnings(output, []string{inputPath})[inputPath], nil
+}
+
+// writeTIFFs writes the archival TIFF of each input with one rawtherapee-cli call and
+// returns an error per input (nil if its TIFF was written)
+// rawtherapee-cli writes a single output format per call, so this is a second pass.
+func (rt *RawTherapee) writeTIFFs(inputPaths []string) []error {
+	errs := make([]error, len(inputPaths))
+
+	// Like ProcessBatch, one call per output directory
+	if groups := groupByOutputDir(rt.config.TIFFOutputDir, inputPaths, ".tif"); len(groups) > 1 {
+		for _, group := range groups {
+			paths := make([]string, len(group))
+			for n, k := range group {
+				paths[n] = inputPaths[k]
+			}
+			for n, err := range rt.writeTIFFs(paths) {
+				errs[group[n]] = err
+			}
+		}
+		return errs
+	}
+	outputDir := filepath.Dir(rt.TIFFPath(inputPaths[0]))
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("failed to create TIFF output directory: %v", err)
+		}
+		return errs
+	}
+
+	bitDepth := rt.config.TIFFBitDepth
+	if bitDepth == 0 {
+		bitDepth = 16
+	}
+	args := []string{
+		"-o", outputDir,
+		"-t", fmt.Sprintf("-b%d", bitDepth),
+		"-Y",
+	}
+	if rt.profilePath != "" {
+		args = append(args, "-p", rt.profilePath)
+	}
+	args = append(args, "-c")
+
+	// Too many files for one command line are written with several calls
+	if chunks := cmdline.Split(rt.config.ExecutablePath, args, inputPaths); len(chunks) > 1 {
+		errs = errs[:0]
+		for _, chunk := range chunks {
+			errs = append(errs, rt.writeTIFFs(chunk)...)
+		}
+		return errs
+	}
+	args = append(args, inputPaths...)
+
+	start := time.Now()
+	output, runErr := exec.Command(rt.config.ExecutablePath, args...).CombinedOutput()
+
+	for i, inputPath := range inputPaths {
+		tiffPath := rt.TIFFPath(inputPath)
+
+		info, err := os.Stat(tiffPath)
+		switch {
+		case err == nil && !info.ModTime().Before(start.Add(-time.Second)):
+			rt.removeSidecars(tiffPath)
+			continue
+		case runErr != nil:
+			errs[i] = fmt.Errorf("rawtherapee-cli failed writing TIFF: %v\nOutput: %s", runErr, string(output))
+		default:
+			errs[i] = fmt.Errorf("TIFF file was not created: %s", tiffPath)
+		}
+	}
+
+	return errs
+}
+
+// TIFFPath returns the path of the archival TIFF written for an input file, or "" if no
+// TIFFs are written
+func (rt *RawTherapee) TIFFPath(inputPath string) string {
+	if rt.config.TIFFOutputDir == "" {
+		return ""
+	}
+	return outputPathIn(rt.config.TIFFOutputDir, inputPath, ".tif")
+}
+
+// finishOutput verifies and applies post-processing to a freshly written output file
+func (rt *RawTherapee) finishOutput(outputPath string) error {
+	rt.removeSidecars(outputPath)
+
+	// An interrupted run can leave an empty or truncated file; never accept it as output
+	if rt.config.VerifyOutput {
+		if err := ValidateJPEG(outputPath); err != nil {
+			os.Remove(outputPath)
+			return fmt.Errorf("invalid output: %v", err)
+		}
+	}
+
+	// rawtherapee-cli has no option for the output resolution, so patch the metadata
+	if rt.config.DPI > 0 {
+		if err := SetJPEGDPI(outputPath, rt.config.DPI); err != nil {
+			return fmt.Errorf("failed to set output DPI: %v", err)
+		}
+	}
+	return nil
+}
+
+// removeSidecars deletes the processing profiles rawtherapee-cli writes next to an output
+// when the profile or its preferences ask for it ("<output>.out.pp3", "<output>.pp3"),
+// unless they are to be kept
+func (rt *RawTherapee) removeSidecars(outputPath string) {
+	if rt.config.KeepSidecars {
+		return
+	}
+	for _, sidecar := range []string{outputPath + ".out.pp3", outputPath + ".pp3"} {
+		os.Remove(sidecar)
+	}
+}
+
+// BatchResult contains the outcome for a single file of a batch run
+type BatchResult struct {
+	InputPath  string
+	OutputPath string
+	Warnings   []string // Warnings rawtherapee-cli printed for the file
+	Err        error
+}
+
+// ProcessBatch processes several files with a single rawtherapee-cli call, avoiding the
+// per-process startup cost. Results are returned in the same order as inputPaths.
+func (rt *RawTherapee) ProcessBatch(inputPaths []string) []BatchResult {
+	results := make([]BatchResult, len(inputPaths))
+
+	// Keep existing outputs out of the batch unless overwriting is enabled
+	var batchIndexes []int
+	var batchPaths []string
+	for i, inputPath := range inputPaths {
+		results[i].InputPath = inputPath
+		if !rt.config.Overwrite {
+			outputPath := rt.outputPathFor(inputPath)
+			if _, err := os.Stat(outputPath); err == nil {
+				results[i].OutputPath = outputPath
+				results[i].Err = ErrOutputExists
+				continue
+			}
+		}
+		batchIndexes = append(batchIndexes, i)
+		batchPaths = append(batchPaths, inputPath)
+	}
+	if len(batchPaths) == 0 {
+		return results
+	}
+
+	// RawTherapee writes the outputs of a call into one directory, so files of different
+	// DCF directories (whose names may repeat) are processed with a call each
+	if groups := groupByOutputDir(rt.config.OutputDir, batchPaths, ".jpg"); len(groups) > 1 {
+		for _, group := range groups {
+			paths := make([]string, len(group))
+			for n, k := range group {
+				paths[n] = batchPaths[k]
+			}
+			for n, result := range rt.ProcessBatch(paths) {
+				results[batchIndexes[group[n]]] = result
+			}
+		}
+		return results
+	}
+	outputDir := filepath.Dir(rt.outputPathFor(batchPaths[0]))
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		for _, i := range batchIndexes {
+			results[i].Err = fmt.Errorf("failed to create output directory: %v", err)
+		}
+		return results
+	}
+
+	// Build command arguments; with an output directory RawTherapee names each
+	// output after its input file
+	args := []string{
+		"-o", outputDir,
+		"-j" + fmt.Sprintf("%d", rt.config.Quality), // JPEG quality
+		"-Y", // Overwrite output if exists
+	}
+
+	// Add profile if specified
+	if rt.profilePath != "" {
+		args = append(args, "-p", rt.profilePath)
 	}
 
-	return outputPath, nil
+	// Add input files (-c must be the last option)
+	args = append(args, "-c")
+
+	// A batch too long for one command line (e.g. on Windows) is split into several calls
+	if chunks := cmdline.Split(rt.config.ExecutablePath, args, batchPaths); len(chunks) > 1 {
+		n := 0
+		for _, chunk := range chunks {
+			for _, result := range rt.ProcessBatch(chunk) {
+				results[batchIndexes[n]] = result
+				n++
+			}
+		}
+		return results
+	}
+	args = append(args, batchPaths...)
+
+	// Execute rawtherapee-cli
+	start := time.Now()
+	output, runErr := rt.run(args, batchPaths)
+	warnings := parseWarnings(output, batchPaths)
+
+	// Check every expected output; anything older than this run is a leftover
+	// from a previous run and doesn't count as a result of this batch
+	for n, i := range batchIndexes {
+		outputPath := rt.outputPathFor(batchPaths[n])
+
+		info, err := os.Stat(outputPath)
+		if err == nil && !info.ModTime().Before(start.Add(-time.Second)) {
+			if err := rt.finishOutput(outputPath); err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].OutputPath = outputPath
+			results[i].Warnings = warnings[batchPaths[n]]
+			continue
+		}
+
+		if runErr != nil {
+			results[i].Err = fmt.Errorf("rawtherapee-cli failed: %v\nOutput: %s", runErr, string(output))
+		} else {
+			results[i].Err = fmt.Errorf("output file was not created: %s", outputPath)
+		}
+	}
+
+	// Archival TIFFs of the files processed by this batch
+	if rt.config.TIFFOutputDir != "" {
+		var tiffIndexes []int
+		var tiffPaths []string
+		for n, i := range batchIndexes {
+			if results[i].Err == nil {
+				tiffIndexes = append(tiffIndexes, i)
+				tiffPaths = append(tiffPaths, batchPaths[n])
+			}
+		}
+		if len(tiffPaths) > 0 {
+			for n, err := range rt.writeTIFFs(tiffPaths) {
+				if err != nil {
+					results[tiffIndexes[n]].OutputPath = ""
+					results[tiffIndexes[n]].Err = err
+				}
+			}
+		}
+	}
+
+	return results
+}
+
+// groupByOutputDir groups the indexes of inputPaths by the directory below dir their
+// outputs with the given extension go to, in order of first appearance
+func groupByOutputDir(dir string, inputPaths []string, ext string) [][]int {
+	var groups [][]int
+	byDir := make(map[string]int)
+	for i, inputPath := range inputPaths {
+		outputDir := filepath.Dir(outputPathIn(dir, inputPath, ext))
+		n, ok := byDir[outputDir]
+		if !ok {
+			n = len(groups)
+			byDir[outputDir] = n
+			groups = append(groups, nil)
+		}
+		groups[n] = append(groups[n], i)
+	}
+	return groups
+}
+
+// Patterns for the progress lines printed by rawtherapee-cli
+var (
+	processingPattern = regexp.MustCompile(`^Processing:?\s+(.+?)\s*$`)
+	percentPattern    = regexp.MustCompile(`(\d{1,3})\s*%`)
+)
+
+// warningPattern matches the lines of rawtherapee-cli output worth reporting for a file that
+// was processed anyway, e.g. clipped highlights or a partly decoded RAW
+var warningPattern = regexp.MustCompile(`(?i)\b(warning|clipped|clipping|corrupt(ed)?|truncated|cannot|can't|unsupported|error)\b`)
+
+// parseWarnings returns the warning lines of rawtherapee-cli output per input path
+// Lines are attributed to the file named by the last "Processing" line (in a single-file
+// run, to that file); lines before the first of them are dropped.
+func parseWarnings(output []byte, inputPaths []string) map[string][]string {
+	warnings := make(map[string][]string)
+	current := ""
+	if len(inputPaths) == 1 {
+		current = inputPaths[0]
+	}
+
+	for _, line := range strings.FieldsFunc(string(output), func(r rune) bool { return r == '\n' || r == '\r' }) {
+		line = strings.TrimSpace(line)
+		if match := processingPattern.FindStringSubmatch(line); match != nil {
+			if path := matchInput(match[1], inputPaths); path != "" {
+				current = path
+			}
+			continue
+		}
+		if current == "" || !warningPattern.MatchString(line) {
+			continue
+		}
+		seen := false
+		for _, w := range warnings[current] {
+			seen = seen || w == line
+		}
+		if !seen {
+			warnings[current] = append(warnings[current], line)
+		}
+	}
+	return warnings
+}
+
+// run executes rawtherapee-cli and returns its combined output
+// With a progress callback the output is parsed while it is produced: a "Processing: <file>"
+// line starts a file (finishing the previous one) and percentages update the current file.
+func (rt *RawTherapee) run(args []string, inputPaths []string) ([]byte, error) {
+	cmd := exec.Command(rt.config.ExecutablePath, args...)
+	if rt.config.Progress == nil {
+		return cmd.CombinedOutput()
+	}
+
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		writer.Close()
+		waitErr <- err
+	}()
+
+	// A single-file run has no "Processing" line worth waiting for
+	current := ""
+	if len(inputPaths) == 1 {
+		current = inputPaths[0]
+		rt.config.Progress(current, 0)
+	}
+
+	var output bytes.Buffer
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		output.WriteString(line + "\n")
+
+		if match := processingPattern.FindStringSubmatch(line); match != nil {
+			if path := matchInput(match[1], inputPaths); path != "" && path != current {
+				if current != "" {
+					rt.config.Progress(current, 100)
+				}
+				current = path
+				rt.config.Progress(current, 0)
+			}
+			continue
+		}
+		if match := percentPattern.FindStringSubmatch(line); match != nil && current != "" {
+			if percent, err := strconv.Atoi(match[1]); err == nil && percent > 0 && percent < 100 {
+				rt.config.Progress(current, percent)
+			}
+		}
+	}
+	// Drain anything left if scanning stopped early, so the process can exit
+	io.Copy(io.Discard, reader)
+
+	err := <-waitErr
+	if err == nil && current != "" {
+		rt.config.Progress(current, 100)
+	}
+	return output.Bytes(), err
+}
+
+// matchInput returns the input path a progress line refers to ("" if none)
+// rawtherapee-cli may print a path that differs from the input (e.g. relative or with other
+// separators), so inputs are also matched by name and, for inputs of the same name in
+// different DCF directories, by their folder
+func matchInput(reported string, inputPaths []string) string {
+	var matches []string
+	for _, path := range inputPaths {
+		if reported == path {
+			return path
+		}
+		if filepath.Base(reported) == filepath.Base(path) {
+			matches = append(matches, path)
+		}
+	}
+	if len(matches) <= 1 {
+		return strings.Join(matches, "")
+	}
+	for _, path := range matches {
+		if filepath.Base(filepath.Dir(reported)) == filepath.Base(filepath.Dir(path)) {
+			return path
+		}
+	}
+	return ""
+}
+
+// scanProgressLines splits output into lines ending in "\n" or "\r", since progress
+// indicators are often redrawn in place with a carriage return
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, bytes.TrimRight(data[:i], "\r"), nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// outputPathFor returns the output JPEG path for an input file
+func (rt *RawTherapee) outputPathFor(inputPath string) string {
+	return outputPathIn(rt.config.OutputDir, inputPath, ".jpg")
+}
+
+// outputPathIn returns the path below dir of the output (or intermediate) file with the
+// given extension for an input file, see dcfSubdir
+func outputPathIn(dir, inputPath, ext string) string {
+	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+	return filepath.Join(dir, dcfSubdir(inputPath), baseName+ext)
+}
+
+// dcfSubdir returns the folder that outputs of an input file in a DCF directory go to, the
+// name of that directory (e.g. "100CANON"), or "" for files outside DCF directories
+// Cameras restart file names in each DCF directory, so 100CANON/IMG_0001.CR2 and
+// 101CANON/IMG_0001.CR2 would otherwise overwrite each other's output. Intermediate files
+// keep the folder, so their outputs land in it too.
+func dcfSubdir(inputPath string) string {
+	name := filepath.Base(filepath.Dir(inputPath))
+	if len(name) != 8 || name[:3] < "100" {
+		return ""
+	}
+	for i, r := range name {
+		digit := r >= '0' && r <= '9'
+		alphanumeric := digit || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '_'
+		if i < 3 && !digit || !alphanumeric {
+			return ""
+		}
+	}
+	return name
 }
 
 // GetProfileName returns the name of the PP3 profile being used
 func (rt *RawTherapee) GetProfileName() string {
-	if rt.config.ProfilePath == "" {
+	return ProfileName(rt.config.ProfilePath)
+}
+
+// ProfileName returns the name of a PP3 profile as recorded in the state and tags
+func ProfileName(profilePath string) string {
+	if profilePath == "" {
 		return "default"
 	}
-	return strings.TrimSuffix(filepath.Base(rt.config.ProfilePath), ".pp3")
+	return strings.TrimSuffix(filepath.Base(profilePath), ".pp3")
 }
 
 // GetOutputDir returns the output directory
@@ -111,7 +715,7 @@ func findRawTherapeeExecutable() string {
 
 	switch runtime.GOOS {
 	case "windows":
-		names = append(names, 
+		names = append(names,
 			"rawtherapee-cli.exe",
 			`C:\Program Files\RawTherapee\rawtherapee-cli.exe`,
 			`C:\Program Files (x86)\RawTherapee\rawtherapee-cli.exe`,
@@ -150,4 +754,79 @@ func ValidateProfile(profilePath string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// ExpectedSize returns the size of the output of an image of width x height pixels (as
+// displayed, after rotation) with the resize settings of the PP3 profile
+// It returns false when the output size can't be predicted, i.e. when the profile crops.
+func (rt *RawTherapee) ExpectedSize(width, height int) (int, int, bool) {
+	if rt.profilePath == "" {
+		return width, height, true
+	}
+	sections, err := readPP3(rt.profilePath)
+	if err != nil || sections["Crop"]["Enabled"] == "true" {
+		return 0, 0, false
+	}
+
+	resize := sections["Resize"]
+	if resize["Enabled"] != "true" {
+		return width, height, true
+	}
+	number := func(key string) float64 {
+		v, _ := strconv.ParseFloat(resize[key], 64)
+		return v
+	}
+
+	long, short := float64(width), float64(height)
+	if short > long {
+		long, short = short, long
+	}
+	scale := 1.0
+	switch resize["DataSpecified"] {
+	case "0":
+		scale = number("Scale")
+	case "1":
+		scale = number("Width") / float64(width)
+	case "2":
+		scale = number("Height") / float64(height)
+	case "3": // Bounding box
+		scale = math.Min(number("Width")/float64(width), number("Height")/float64(height))
+	case "4":
+		scale = number("LongEdge") / long
+	case "5":
+		scale = number("ShortEdge") / short
+	default:
+		return 0, 0, false
+	}
+	if scale <= 0 {
+		return 0, 0, false
+	}
+	if scale > 1 && resize["AllowUpscaling"] == "false" {
+		scale = 1
+	}
+
+	return int(math.Round(float64(width) * scale)), int(math.Round(float64(height) * scale)), true
+}
+
+// readPP3 reads the key/value pairs of a PP3 profile by section
+func readPP3(profilePath string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(profilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make(map[string]map[string]string)
+	var current map[string]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = make(map[string]string)
+			sections[line[1:len(line)-1]] = current
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && current != nil {
+			current[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return sections, nil
+}
@@ -0,0 +1,104 @@
+package scanner
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bracketMaxGap is the longest time between two consecutive shots of the same bracket
+const bracketMaxGap = 2 * time.Second
+
+// Bracket is a set of consecutive shots taken at different exposure compensations
+type Bracket struct {
+	Files []FileInfo // Shots in capture order
+}
+
+// Name identifies the bracket by the shot key of its first file, e.g. "100-P6150042"
+// The folder separator is replaced, as Immich reads "/" in a tag as a tag hierarchy.
+func (b Bracket) Name() string {
+	return tagSafe(b.Files[0].ShotKey())
+}
+
+// Middle returns the shot with the median exposure compensation (the "normal" exposure)
+func (b Bracket) Middle() FileInfo {
+	byBias := make([]FileInfo, len(b.Files))
+	copy(byBias, b.Files)
+	sort.SliceStable(byBias, func(i, j int) bool {
+		return byBias[i].Meta.ExposureBias < byBias[j].Meta.ExposureBias
+	})
+	return byBias[(len(byBias)-1)/2]
+}
+
+// FindBrackets groups consecutive files into exposure brackets of the given size
+// A bracket is size shots taken at most bracketMaxGap apart, each with a different exposure
+// compensation. Files need their metadata loaded (see LoadMetadata); files without it are
+// never part of a bracket.
+func FindBrackets(files []FileInfo, size int) []Bracket {
+	if size < 2 {
+		return nil
+	}
+
+	sorted := make([]FileInfo, len(files))
+	copy(sorted, files)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, tj := captureTime(sorted[i]), captureTime(sorted[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return sorted[i].Sequence() < sorted[j].Sequence()
+	})
+
+	var brackets []Bracket
+	for i := 0; i+size <= len(sorted); {
+		if window := sorted[i : i+size]; isBracket(window) {
+			brackets = append(brackets, Bracket{Files: append([]FileInfo(nil), window...)})
+			i += size
+		} else {
+			i++
+		}
+	}
+	return brackets
+}
+
+// isBracket reports whether the files were shot in quick succession at distinct exposure
+// compensations
+func isBracket(files []FileInfo) bool {
+	biases := make(map[int]bool)
+	bracketed := false
+
+	for i, f := range files {
+		if f.Meta == nil || f.Meta.DateTimeOriginal.IsZero() {
+			return false
+		}
+		if i > 0 && captureTime(f).Sub(captureTime(files[i-1])) > bracketMaxGap {
+			return false
+		}
+
+		// Compare in hundredths of an EV to avoid rounding differences between rationals
+		bias := int(math.Round(f.Meta.ExposureBias * 100))
+		if biases[bias] {
+			return false
+		}
+		biases[bias] = true
+		if bias != 0 {
+			bracketed = true
+		}
+	}
+	return bracketed
+}
+
+// tagSafe makes a shot key usable in an Immich tag ("100/P6150042" -> "100-P6150042")
+func tagSafe(key string) string {
+	return strings.Trim(strings.ReplaceAll(key, "/", "-"), "-")
+}
+
+// captureTime returns when a file was shot: the EXIF capture time if known, otherwise its
+// modification time
+func captureTime(f FileInfo) time.Time {
+	if f.Meta != nil && !f.Meta.DateTimeOriginal.IsZero() {
+		return f.Meta.DateTimeOriginal
+	}
+	return time.Unix(f.ModTime, 0)
+}
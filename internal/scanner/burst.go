@@ -0,0 +1,49 @@
+package scanner
+
+import (
+	"sort"
+	"time"
+)
+
+// Burst is a run of shots taken in quick succession, e.g. in sequential shooting mode
+type Burst struct {
+	Files []FileInfo // Shots in capture order
+}
+
+// Name identifies the burst by the shot key of its first file, made usable in a tag like
+// Bracket.Name
+func (b Burst) Name() string {
+	return tagSafe(b.Files[0].ShotKey())
+}
+
+// FindBursts groups files shot at most maxGap after the previous one into bursts of at
+// least two shots. Files need their metadata loaded (see LoadMetadata); files without a
+// capture time are never part of a burst.
+func FindBursts(files []FileInfo, maxGap time.Duration) []Burst {
+	var timed []FileInfo
+	for _, f := range files {
+		if f.Meta != nil && !f.Meta.DateTimeOriginal.IsZero() {
+			timed = append(timed, f)
+		}
+	}
+	sort.SliceStable(timed, func(i, j int) bool {
+		ti, tj := captureTime(timed[i]), captureTime(timed[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return timed[i].Sequence() < timed[j].Sequence()
+	})
+
+	var bursts []Burst
+	start := 0
+	for i := 1; i <= len(timed); i++ {
+		if i < len(timed) && captureTime(timed[i]).Sub(captureTime(timed[i-1])) <= maxGap {
+			continue
+		}
+		if i-start >= 2 {
+			bursts = append(bursts, Burst{Files: append([]FileInfo(nil), timed[start:i]...)})
+		}
+		start = i
+	}
+	return bursts
+}
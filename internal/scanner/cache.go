@@ -0,0 +1,136 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/paths"
+)
+
+// ScanCache stores scan results per card so an unchanged card can skip the full walk
+// A cached result is valid as long as none of the card's directories changed their mtime
+type ScanCache struct {
+	Entries map[string]scanCacheEntry `json:"entries"`
+
+	path string
+}
+
+// scanCacheEntry is the cached scan of a single card
+type scanCacheEntry struct {
+	DirModTimes map[string]int64 `json:"dir_mod_times"` // Directory path -> mtime (UnixNano)
+	Result      ScanResult       `json:"result"`
+}
+
+// DefaultScanCachePath returns the default path for the scan cache file
+func DefaultScanCachePath() (string, error) {
+	dataDir, err := paths.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "scan-cache.json"), nil
+}
+
+// LoadScanCache loads the scan cache from the specified path
+// A missing or unreadable cache file results in an empty cache
+func LoadScanCache(path string) *ScanCache {
+	cache := &ScanCache{
+		Entries: make(map[string]scanCacheEntry),
+		path:    path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+
+	if err := json.Unmarshal(data, cache); err != nil || cache.Entries == nil {
+		cache.Entries = make(map[string]scanCacheEntry)
+	}
+
+	return cache
+}
+
+// scanCacheVersion is part of every cache key; bump it when FileInfo gains fields so
+// results cached by older versions are rescanned
+const scanCacheVersion = "2"
+
+// CacheKey builds the cache key for a card and the settings used to classify its files
+func CacheKey(cardID string, rawExtensions map[string]bool, autoDetectRAW, followSymlinks bool) string {
+	exts := make([]string, 0, len(rawExtensions))
+	for ext, enabled := range rawExtensions {
+		if enabled {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Strings(exts)
+	if autoDetectRAW {
+		exts = append(exts, "auto")
+	}
+	if followSymlinks {
+		exts = append(exts, "symlinks")
+	}
+	return scanCacheVersion + "|" + cardID + "|" + strings.Join(exts, ",")
+}
+
+// Get returns the cached scan result for the key if none of the card's directories changed
+func (c *ScanCache) Get(key string) (*ScanResult, bool) {
+	entry, ok := c.Entries[key]
+	if !ok || len(entry.DirModTimes) == 0 {
+		return nil, false
+	}
+
+	for dir, modTime := range entry.DirModTimes {
+		info, err := os.Stat(dir)
+		if err != nil || info.ModTime().UnixNano() != modTime {
+			return nil, false
+		}
+	}
+
+	result := entry.Result
+	return &result, true
+}
+
+// Put stores a scan result, recording the mtimes of all directories it was scanned from
+func (c *ScanCache) Put(key string, result *ScanResult) {
+	dirModTimes := make(map[string]int64)
+
+	visited := make(map[string]bool)
+	for _, searchPath := range searchPathsFor(result.BasePath) {
+		walkTree(searchPath, result.FollowSymlinks, visited, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				dirModTimes[path] = info.ModTime().UnixNano()
+			}
+			return nil
+		})
+	}
+
+	c.Entries[key] = scanCacheEntry{
+		DirModTimes: dirModTimes,
+		Result:      *result,
+	}
+}
+
+// Save writes the scan cache to disk
+func (c *ScanCache) Save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create scan cache directory: %v", err)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scan cache: %v", err)
+	}
+
+	if err := os.WriteFile(c.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write scan cache: %v", err)
+	}
+
+	return nil
+}
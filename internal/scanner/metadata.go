@@ -0,0 +1,50 @@
+package scanner
+
+import (
+	"sync"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/exif"
+)
+
+// metadataWorkers is the number of files read in parallel by LoadMetadata
+const metadataWorkers = 4
+
+// LoadMetadata reads the EXIF metadata of the given files into their Meta field
+// Files whose metadata can't be read keep a nil Meta
+func LoadMetadata(files []FileInfo) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < metadataWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if meta, err := exif.ReadFile(files[i].Path); err == nil {
+					files[i].Meta = meta
+				}
+			}
+		}()
+	}
+
+	for i := range files {
+		if files[i].Meta == nil {
+			indexes <- i
+		}
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// IsPortrait reports whether the file shows a portrait image once its EXIF orientation is
+// applied; ok is false when the file has no orientation metadata
+func (f FileInfo) IsPortrait() (portrait bool, ok bool) {
+	if f.Meta == nil || f.Meta.Orientation < 1 || f.Meta.Orientation > 8 {
+		return false, false
+	}
+
+	// Orientations 5-8 rotate the image by 90 degrees, swapping width and height
+	rotated := f.Meta.Orientation >= 5
+	tall := f.Meta.Height > f.Meta.Width
+	return rotated != tall, true
+}
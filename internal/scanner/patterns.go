@@ -0,0 +1,109 @@
+package scanner
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a pattern as a regular expression instead of a glob
+const regexPrefix = "re:"
+
+// PatternFilter selects files by include and exclude patterns
+// Patterns are globs (e.g. "P615*.ORF") or, with a "re:" prefix, regular expressions.
+// Both kinds are matched case-insensitively against the file name and against the path
+// relative to DCIM (e.g. "100OMSYS/P6150001.ORF").
+type PatternFilter struct {
+	include []matcher
+	exclude []matcher
+}
+
+// matcher matches a single pattern
+type matcher func(name string) bool
+
+// NewPatternFilter compiles the include and exclude patterns
+func NewPatternFilter(include, exclude []string) (*PatternFilter, error) {
+	filter := &PatternFilter{}
+
+	for _, pattern := range include {
+		m, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, m)
+	}
+	for _, pattern := range exclude {
+		m, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, m)
+	}
+
+	return filter, nil
+}
+
+// compilePattern compiles a glob or "re:" regular expression pattern
+func compilePattern(pattern string) (matcher, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(pattern, regexPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+		}
+		return re.MatchString, nil
+	}
+
+	glob := strings.ToUpper(pattern)
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob pattern %q: %v", pattern, err)
+	}
+	return func(name string) bool {
+		matched, _ := path.Match(glob, strings.ToUpper(name))
+		return matched
+	}, nil
+}
+
+// IsEmpty reports whether the filter has no patterns
+func (p *PatternFilter) IsEmpty() bool {
+	return len(p.include) == 0 && len(p.exclude) == 0
+}
+
+// Allows reports whether the file passes the filter
+// With include patterns only matching files pass; excludes win over includes
+func (p *PatternFilter) Allows(f FileInfo) bool {
+	if len(p.include) > 0 && !matchesAny(p.include, f) {
+		return false
+	}
+	return !matchesAny(p.exclude, f)
+}
+
+// Filter returns the files that pass the filter
+func (p *PatternFilter) Filter(files []FileInfo) []FileInfo {
+	if p.IsEmpty() {
+		return files
+	}
+
+	var allowed []FileInfo
+	for _, f := range files {
+		if p.Allows(f) {
+			allowed = append(allowed, f)
+		}
+	}
+	return allowed
+}
+
+// matchesAny reports whether any matcher matches the file name or relative path
+func matchesAny(matchers []matcher, f FileInfo) bool {
+	relPath := f.Name
+	if f.RelDir != "" {
+		relPath = f.RelDir + "/" + f.Name
+	}
+
+	for _, m := range matchers {
+		if m(f.Name) || m(relPath) {
+			return true
+		}
+	}
+	return false
+}
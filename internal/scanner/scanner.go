@@ -3,8 +3,12 @@ package scanner
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/exif"
 )
 
 // FileInfo represents information about a found file
@@ -17,6 +21,12 @@ type FileInfo struct {
 	IsJPG     bool
 	BaseName  string // Filename without extension
 	Extension string // File extension (uppercase, with leading dot)
+	RelDir    string // Directory relative to DCIM (or the card root), with forward slashes
+	DCFDir    int    // DCF directory number (e.g. 100 for "100CANON"), 0 if not a DCF directory
+	DCFNumber int    // DCF file number (e.g. 1 for "PICT0001"), 0 if not a DCF file name
+	Root      string // Scanned directory the file was found in (the card, or one of the other scan roots)
+
+	Meta *exif.Metadata `json:"-"` // EXIF metadata, only set after LoadMetadata
 }
 
 // ScanResult contains the results of scanning a drive
@@ -24,35 +34,47 @@ type ScanResult struct {
 	RAWFiles []FileInfo
 	JPGFiles []FileInfo
 	BasePath string
+
+	DetectedRAWExtensions []string // Extensions classified as RAW by content rather than configuration
+	FollowSymlinks        bool     // Symlinked directories (and junctions) were scanned too
 }
 
 // ScanForImages scans a directory for RAW and JPG files
 // It looks in common camera directory structures like DCIM/
 // rawExtensions is a map of uppercase extensions (with dot) that should be treated as RAW
-func ScanForImages(basePath string, rawExtensions map[string]bool) (*ScanResult, error) {
+// With autoDetectRAW, files with other extensions are treated as RAW if their content looks
+// like a RAW file
+// With followSymlinks, symlinked directories are scanned as well (each directory only once,
+// so link cycles end); otherwise they are skipped like filepath.Walk does.
+func ScanForImages(basePath string, rawExtensions map[string]bool, autoDetectRAW, followSymlinks bool) (*ScanResult, error) {
 	result := &ScanResult{
-		BasePath: basePath,
-		RAWFiles: make([]FileInfo, 0),
-		JPGFiles: make([]FileInfo, 0),
-	}
-
-	// Common camera image directories
-	searchPaths := []string{
-		filepath.Join(basePath, "DCIM"),
-		basePath,
+		BasePath:       basePath,
+		RAWFiles:       make([]FileInfo, 0),
+		JPGFiles:       make([]FileInfo, 0),
+		FollowSymlinks: followSymlinks,
 	}
 
+	detected := make(map[string]bool)
+	visited := make(map[string]bool)
+	searchPaths := searchPathsFor(basePath)
 	for _, searchPath := range searchPaths {
 		if _, err := os.Stat(searchPath); os.IsNotExist(err) {
 			continue
 		}
 
-		err := filepath.Walk(searchPath, func(path string, info os.FileInfo, err error) error {
+		err := walkTree(searchPath, followSymlinks, visited, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return nil // Skip files we can't access
 			}
 
 			if info.IsDir() {
+				// DCIM is scanned on its own, don't walk it again from the card root
+				if path != searchPath && path == searchPaths[0] {
+					return filepath.SkipDir
+				}
+				if hasIgnoreMarker(path) {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 
@@ -71,7 +93,13 @@ func ScanForImages(basePath string, rawExtensions map[string]bool) (*ScanResult,
 				ModTime:   info.ModTime().Unix(),
 				BaseName:  baseName,
 				Extension: ext,
+				Root:      basePath,
+			}
+			if relDir, err := filepath.Rel(searchPath, filepath.Dir(path)); err == nil && relDir != "." {
+				fileInfo.RelDir = filepath.ToSlash(relDir)
 			}
+			fileInfo.DCFDir = parseDCFDir(fileInfo.FolderAt(1))
+			fileInfo.DCFNumber = parseDCFNumber(baseName)
 
 			// Check if it's a configured RAW extension
 			if rawExtensions[ext] {
@@ -80,6 +108,13 @@ func ScanForImages(basePath string, rawExtensions map[string]bool) (*ScanResult,
 			} else if ext == ".JPG" || ext == ".JPEG" {
 				fileInfo.IsJPG = true
 				result.JPGFiles = append(result.JPGFiles, fileInfo)
+			} else if autoDetectRAW && looksLikeRAW(path, ext) {
+				fileInfo.IsRAW = true
+				result.RAWFiles = append(result.RAWFiles, fileInfo)
+				if !detected[ext] {
+					detected[ext] = true
+					result.DetectedRAWExtensions = append(result.DetectedRAWExtensions, ext)
+				}
 			}
 
 			return nil
@@ -93,10 +128,260 @@ func ScanForImages(basePath string, rawExtensions map[string]bool) (*ScanResult,
 	return result, nil
 }
 
+// walkTree walks a directory tree like filepath.Walk; with followSymlinks, symlinks to
+// directories are walked into as well, reporting paths below the link
+// Directories are identified by their resolved path in visited, which is shared across
+// calls so a directory reachable both directly and through a link is walked only once.
+func walkTree(root string, followSymlinks bool, visited map[string]bool, fn filepath.WalkFunc) error {
+	if !followSymlinks {
+		return filepath.Walk(root, fn)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	err = walkFollowing(root, info, visited, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkFollowing walks path (whose link target is described by info) for walkTree
+func walkFollowing(path string, info os.FileInfo, visited map[string]bool, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	if visited[resolved] {
+		return nil
+	}
+	visited[resolved] = true
+
+	if err := fn(path, info, nil); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		childInfo, err := os.Stat(child) // Follows links
+		if err != nil {
+			if err := fn(child, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := walkFollowing(child, childInfo, visited, fn); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// ignoreMarkers are files that exclude the directory containing them (and its
+// subdirectories) from scanning
+var ignoreMarkers = []string{".nomedia", ".c2i-ignore"}
+
+// hasIgnoreMarker reports whether a directory contains one of the ignoreMarkers
+func hasIgnoreMarker(dir string) bool {
+	for _, marker := range ignoreMarkers {
+		if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// nonRAWExtensions are TIFF-based formats that must not be mistaken for RAW files
+var nonRAWExtensions = map[string]bool{
+	".TIF":  true,
+	".TIFF": true,
+}
+
+// looksLikeRAW reports whether a file's header matches a RAW format: TIFF-based RAWs
+// (including the ORF and RW2 variants), Fujifilm RAF and Canon CR3
+func looksLikeRAW(path, ext string) bool {
+	if nonRAWExtensions[ext] {
+		return false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 16)
+	if n, _ := f.Read(header); n < len(header) {
+		return false
+	}
+
+	switch {
+	case string(header[:4]) == "II*\x00" || string(header[:4]) == "MM\x00*":
+		return true
+	case string(header[:4]) == "IIRO" || string(header[:4]) == "IIRS" || string(header[:4]) == "MMOR": // Olympus ORF
+		return true
+	case string(header[:4]) == "IIU\x00": // Panasonic RW2
+		return true
+	case string(header[:15]) == "FUJIFILMCCD-RAW":
+		return true
+	case string(header[4:12]) == "ftypcrx ": // Canon CR3
+		return true
+	}
+	return false
+}
+
+// Merge adds the files of another scan (e.g. of a staging folder scanned along with the
+// card) to the result. Files are tracked by their path below the scanned root (StateKey),
+// so a file whose path is already in the result is left out; the left out files are
+// returned.
+func (r *ScanResult) Merge(other *ScanResult) []FileInfo {
+	keys := make(map[string]bool, len(r.RAWFiles)+len(r.JPGFiles))
+	for _, files := range [][]FileInfo{r.RAWFiles, r.JPGFiles} {
+		for i := range files {
+			keys[files[i].StateKey()] = true
+			if files[i].Root == "" { // Cached scans predate Root
+				files[i].Root = r.BasePath
+			}
+		}
+	}
+
+	var duplicates []FileInfo
+	add := func(dst []FileInfo, files []FileInfo) []FileInfo {
+		for _, f := range files {
+			if f.Root == "" {
+				f.Root = other.BasePath
+			}
+			if keys[f.StateKey()] {
+				duplicates = append(duplicates, f)
+				continue
+			}
+			keys[f.StateKey()] = true
+			dst = append(dst, f)
+		}
+		return dst
+	}
+	r.RAWFiles = add(r.RAWFiles, other.RAWFiles)
+	r.JPGFiles = add(r.JPGFiles, other.JPGFiles)
+
+	for _, ext := range other.DetectedRAWExtensions {
+		known := false
+		for _, e := range r.DetectedRAWExtensions {
+			known = known || e == ext
+		}
+		if !known {
+			r.DetectedRAWExtensions = append(r.DetectedRAWExtensions, ext)
+		}
+	}
+	return duplicates
+}
+
+// searchPathsFor returns the directories scanned for images on a card
+func searchPathsFor(basePath string) []string {
+	// Common camera image directories
+	return []string{
+		filepath.Join(basePath, "DCIM"),
+		basePath,
+	}
+}
+
+// FolderAt returns the folder at the given depth below DCIM (1 = e.g. "100CANON")
+// Files in shallower folders return their deepest folder; files directly in DCIM return ""
+func (f FileInfo) FolderAt(depth int) string {
+	if f.RelDir == "" || depth < 1 {
+		return ""
+	}
+	parts := strings.Split(f.RelDir, "/")
+	if depth > len(parts) {
+		depth = len(parts)
+	}
+	return parts[depth-1]
+}
+
+// ShotKey identifies the shot a file belongs to, so RAW and JPG siblings share a key
+// Per the DCF standard a shot is identified by its directory number and file name, so
+// PICT0001 in 100CANON and PICT0001 in 101CANON are different shots. Files outside DCF
+// directories are keyed by their folder instead.
+func (f FileInfo) ShotKey() string {
+	name := strings.ToUpper(f.BaseName)
+	if f.DCFDir != 0 {
+		return fmt.Sprintf("%03d/%s", f.DCFDir, name)
+	}
+	return f.RelDir + "/" + name
+}
+
+// StateKey identifies the file in the state: its path below DCIM (or the scanned root) with
+// forward slashes, e.g. "100CANON/IMG_0001.CR2". Cameras reuse file names across folders,
+// so the name alone doesn't identify a file.
+func (f FileInfo) StateKey() string {
+	return path.Join(f.RelDir, f.Name)
+}
+
+// Sequence returns the DCF sequence of the file (directory number * 10000 + file number),
+// which increases with every shot, or 0 if the file isn't DCF-named
+func (f FileInfo) Sequence() int {
+	if f.DCFDir == 0 || f.DCFNumber == 0 {
+		return 0
+	}
+	return f.DCFDir*10000 + f.DCFNumber
+}
+
+// parseDCFDir returns the directory number of a DCF directory name ("100CANON" -> 100)
+// DCF directory names are 3 digits (100-999) followed by 5 alphanumeric characters
+func parseDCFDir(name string) int {
+	if len(name) != 8 || !isDigits(name[:3]) || !isAlphanumeric(name[3:]) {
+		return 0
+	}
+	number, _ := strconv.Atoi(name[:3])
+	if number < 100 {
+		return 0
+	}
+	return number
+}
+
+// parseDCFNumber returns the file number of a DCF file name ("PICT0001" -> 1)
+// DCF file names are 4 alphanumeric characters followed by 4 digits (0001-9999)
+func parseDCFNumber(baseName string) int {
+	if len(baseName) != 8 || !isAlphanumeric(baseName[:4]) || !isDigits(baseName[4:]) {
+		return 0
+	}
+	number, _ := strconv.Atoi(baseName[4:])
+	return number
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isAlphanumeric(s string) bool {
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '_') {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // FindMatchingJPG finds the camera-generated JPG that matches a RAW file
+// The JPG must belong to the same shot (see ShotKey), not just share the file name
 func FindMatchingJPG(rawFile FileInfo, jpgFiles []FileInfo) *FileInfo {
+	key := rawFile.ShotKey()
 	for i, jpg := range jpgFiles {
-		if jpg.BaseName == rawFile.BaseName {
+		if jpg.ShotKey() == key {
 			return &jpgFiles[i]
 		}
 	}
@@ -104,10 +389,12 @@ func FindMatchingJPG(rawFile FileInfo, jpgFiles []FileInfo) *FileInfo {
 }
 
 // FilterNewFiles returns only files that haven't been processed yet
+// processedFiles is keyed by StateKey; a bare file name matches too, as state entries from
+// before files were keyed by folder can't be told apart
 func FilterNewFiles(files []FileInfo, processedFiles map[string]bool) []FileInfo {
 	var newFiles []FileInfo
 	for _, f := range files {
-		if !processedFiles[f.Name] {
+		if !processedFiles[f.StateKey()] && !processedFiles[f.Name] {
 			newFiles = append(newFiles, f)
 		}
 	}
@@ -1,18 +1,71 @@
 package state
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"time"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/paths"
+)
+
+// CurrentVersion is the version of the state file format written by this build
+const CurrentVersion = 5
+
+// Phases of a processed file; each run (or --skip-upload, --upload-only and --cleanup-only)
+// advances files through them
+const (
+	PhaseProcessed = "processed" // Output written, waiting for upload
+	PhaseUploaded  = "uploaded"  // Uploaded; the output (if any) is still on disk
+	PhaseCleaned   = "cleaned"   // Uploaded and the output deleted (or never kept)
 )
 
 // ProcessedFile represents a file that has been processed
 type ProcessedFile struct {
-	Filename    string    `json:"filename"`
-	ProcessedAt time.Time `json:"processed_at"`
-	ProfileUsed string    `json:"profile_used,omitempty"`
+	Filename          string    `json:"filename"` // Path of the source below DCIM, e.g. "100CANON/IMG_0001.CR2" (just the name for older entries)
+	ProcessedAt       time.Time `json:"processed_at"`
+	ProfileUsed       string    `json:"profile_used,omitempty"`
+	OutputPath        string    `json:"output_path,omitempty"`        // Processed output, while it is kept on disk
+	Uploaded          bool      `json:"uploaded"`                     // False while the output still has to be uploaded
+	Phase             string    `json:"phase,omitempty"`              // PhaseProcessed, PhaseUploaded or PhaseCleaned
+	SourceDir         string    `json:"source_dir,omitempty"`         // Card folder of the source file (relative to DCIM)
+	SourceModTime     int64     `json:"source_mod_time,omitempty"`    // Modification time of the source file (Unix timestamp)
+	KeptOutput        bool      `json:"kept_output,omitempty"`        // Output existed before and must not be deleted after upload
+	OutputSHA256      string    `json:"output_sha256,omitempty"`      // Checksum of the output when it was written, for --verify-outputs
+	ProcessingSeconds float64   `json:"processing_seconds,omitempty"` // Time it took to process the file
+	SourceRating      int       `json:"source_rating,omitempty"`      // Star rating of the source file, for favorite_if in --upload-only runs
+}
+
+// FailedFile represents a file that failed to process or upload
+type FailedFile struct {
+	Filename string    `json:"filename"`
+	Stage    string    `json:"stage"` // "process" or "upload"
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+	Attempts int       `json:"attempts"`
+}
+
+// CardWatermark records the newest file seen on a card
+type CardWatermark struct {
+	MaxModTime  int64     `json:"max_mod_time"`           // Latest file modification time (Unix timestamp)
+	MaxSequence int       `json:"max_sequence,omitempty"` // Highest DCF sequence (directory number * 10000 + file number)
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ProfileTiming is the processing time history of a profile
+type ProfileTiming struct {
+	Files        int     `json:"files"`
+	TotalSeconds float64 `json:"total_seconds"`
+	MaxSeconds   float64 `json:"max_seconds"` // Slowest file processed with the profile
+	MaxFile      string  `json:"max_file"`
 }
 
 // LegacyState represents the old state format (for migration)
@@ -37,16 +90,64 @@ type State struct {
 	// ProcessedFiles tracks files that have been processed from the current card
 	ProcessedFiles map[string]ProcessedFile `json:"processed_files"`
 
-	statePath string
+	// FailedFiles tracks files whose last processing or upload attempt failed
+	FailedFiles map[string]FailedFile `json:"failed_files,omitempty"`
+
+	// Watermarks tracks the newest file synced per card; unlike ProcessedFiles it
+	// survives Clear and SyncWithCard
+	Watermarks map[string]CardWatermark `json:"watermarks,omitempty"`
+
+	// Bookmarks records per card the last file (folder/name below DCIM) of the chunks
+	// processed with --resume-chunk
+	Bookmarks map[string]string `json:"bookmarks,omitempty"`
+
+	// AvgProcessingSeconds is a rolling average of the per-file processing time
+	AvgProcessingSeconds float64 `json:"avg_processing_seconds,omitempty"`
+
+	// ProfileTimings accumulates processing times per profile; like Watermarks it survives
+	// Clear and SyncWithCard, so it covers all cards ever processed
+	ProfileTimings map[string]ProfileTiming `json:"profile_timings,omitempty"`
+
+	// OutputSizeRatios is a rolling average of the output size divided by the RAW size,
+	// per RAW extension
+	OutputSizeRatios map[string]float64 `json:"output_size_ratios,omitempty"`
+
+	statePath     string
+	compress      bool     // Write the state file gzip-compressed
+	loadedVersion int      // Format version of the file as loaded (1 = legacy format)
+	migrations    []string // Changes made by migrating the loaded file to CurrentVersion
+	backedUp      bool     // The file as it was before this run has been backed up
+}
+
+// statePathOverride is the state file set with --state or state_path
+var statePathOverride string
+
+// SetStatePath overrides the path of the state file (--state, state_path)
+func SetStatePath(path string) {
+	statePathOverride = path
+}
+
+// backupCount is the number of backups of the state file kept (backup_state)
+var backupCount int
+
+// SetBackups sets how many backups of the state file are kept (backup_state)
+// The backups are rotated on the first save of each loaded state, so they hold the state
+// as it was before each of the last runs: "state.json.bak" (newest), "state.json.bak.2", ...
+func SetBackups(n int) {
+	backupCount = n
 }
 
-// DefaultStatePath returns the default path for the state file
+// DefaultStatePath returns the path for the state file: the --state/state_path override,
+// or state.json in the data directory
 func DefaultStatePath() (string, error) {
-	homeDir, err := os.UserHomeDir()
+	if statePathOverride != "" {
+		return statePathOverride, nil
+	}
+	dataDir, err := paths.DataDir()
 	if err != nil {
-		return "", fmt.Errorf("failed to get home directory: %v", err)
+		return "", err
 	}
-	return filepath.Join(homeDir, ".camera-to-immich", "state.json"), nil
+	return filepath.Join(dataDir, "state.json"), nil
 }
 
 // Load loads the state from the specified path
@@ -54,7 +155,10 @@ func Load(statePath string) (*State, error) {
 	state := &State{
 		statePath:      statePath,
 		ProcessedFiles: make(map[string]ProcessedFile),
-		Version:        2,
+		FailedFiles:    make(map[string]FailedFile),
+		Watermarks:     make(map[string]CardWatermark),
+		Version:        CurrentVersion,
+		loadedVersion:  CurrentVersion,
 	}
 
 	// Ensure the directory exists
@@ -72,6 +176,16 @@ func Load(statePath string) (*State, error) {
 		return nil, fmt.Errorf("failed to read state file: %v", err)
 	}
 
+	// Compressed state files are detected by the gzip magic bytes, and stay compressed
+	// unless SetCompression says otherwise
+	if isGzip(data) {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state file: %v", err)
+		}
+		state.compress = true
+	}
+
 	// Try to parse as new format first
 	if err := json.Unmarshal(data, state); err != nil {
 		// Try legacy format
@@ -84,12 +198,11 @@ func Load(statePath string) (*State, error) {
 			}
 			state.LastRun = legacy.LastProcessedTimestamp
 			state.Version = 2
-			// Save in new format
+			migrate(state)
+			state.loadedVersion = 1
+			state.migrations = append([]string{fmt.Sprintf("version 2: converted the legacy file list (%d files)", len(state.ProcessedFiles))}, state.migrations...)
+			// Written in the new format by the next Save
 			state.statePath = statePath
-			if saveErr := state.Save(); saveErr != nil {
-				// Non-fatal: just log that we couldn't save
-				fmt.Printf("Warning: could not save migrated state: %v\n", saveErr)
-			}
 			return state, nil
 		}
 		return nil, fmt.Errorf("failed to parse state file: %v", err)
@@ -98,11 +211,83 @@ func Load(statePath string) (*State, error) {
 	if state.ProcessedFiles == nil {
 		state.ProcessedFiles = make(map[string]ProcessedFile)
 	}
+	migrate(state)
+	if state.FailedFiles == nil {
+		state.FailedFiles = make(map[string]FailedFile)
+	}
+	if state.Watermarks == nil {
+		state.Watermarks = make(map[string]CardWatermark)
+	}
 
 	state.statePath = statePath
 	return state, nil
 }
 
+// migrate upgrades a state loaded from an older format version to CurrentVersion,
+// recording what changed
+func migrate(s *State) {
+	s.loadedVersion = s.Version
+	if s.Version < 3 {
+		// Before version 3 every processed file was uploaded in the same run
+		for name, pf := range s.ProcessedFiles {
+			pf.Uploaded = true
+			s.ProcessedFiles[name] = pf
+		}
+		s.Version = 3
+		s.migrations = append(s.migrations, fmt.Sprintf("version 3: marked %d processed files as uploaded", len(s.ProcessedFiles)))
+	}
+	if s.Version < 4 {
+		for name, pf := range s.ProcessedFiles {
+			pf.Phase = phaseOf(pf)
+			s.ProcessedFiles[name] = pf
+		}
+		s.Version = 4
+		s.migrations = append(s.migrations, fmt.Sprintf("version 4: recorded the processed/uploaded/cleaned phase of %d files", len(s.ProcessedFiles)))
+	}
+	if s.Version < 5 {
+		// Before version 5 files were keyed by name alone, so 100CANON/IMG_0001.CR2 and
+		// 101CANON/IMG_0001.CR2 shared an entry. Entries with a recorded source folder move
+		// to their path; the others keep the name, which still matches files by name.
+		rekeyed := 0
+		files := make(map[string]ProcessedFile, len(s.ProcessedFiles))
+		for name, pf := range s.ProcessedFiles {
+			if pf.SourceDir != "" {
+				name = path.Join(pf.SourceDir, name)
+				pf.Filename = name
+				rekeyed++
+			}
+			files[name] = pf
+		}
+		s.ProcessedFiles = files
+		s.Version = 5
+		s.migrations = append(s.migrations, fmt.Sprintf("version 5: keyed %d processed files by their folder and name", rekeyed))
+	}
+}
+
+// LoadedVersion returns the format version of the state file as it was loaded
+// (1 for the legacy format, CurrentVersion for new or up-to-date files)
+func (s *State) LoadedVersion() int {
+	return s.loadedVersion
+}
+
+// Migrations describes the changes made by migrating the loaded file to CurrentVersion,
+// one step per version
+func (s *State) Migrations() []string {
+	return s.migrations
+}
+
+// phaseOf derives the phase of an entry from its upload flag and output path
+func phaseOf(pf ProcessedFile) string {
+	switch {
+	case !pf.Uploaded:
+		return PhaseProcessed
+	case pf.OutputPath != "" && !pf.KeptOutput:
+		return PhaseUploaded
+	default:
+		return PhaseCleaned
+	}
+}
+
 // Save saves the current state to disk
 func (s *State) Save() error {
 	data, err := json.MarshalIndent(s, "", "  ")
@@ -110,13 +295,101 @@ func (s *State) Save() error {
 		return fmt.Errorf("failed to marshal state: %v", err)
 	}
 
-	if err := os.WriteFile(s.statePath, data, 0644); err != nil {
+	if s.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return fmt.Errorf("failed to compress state: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress state: %v", err)
+		}
+		data = buf.Bytes()
+	}
+
+	if backupCount > 0 && !s.backedUp {
+		if err := s.backup(); err != nil {
+			return fmt.Errorf("failed to back up state file: %v", err)
+		}
+		s.backedUp = true
+	}
+
+	// Write to a temp file and rename it into place, so a crash mid-write can't
+	// leave a truncated state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(s.statePath), filepath.Base(s.statePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, s.statePath); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to write state file: %v", err)
 	}
 
 	return nil
 }
 
+// backup rotates the backups of the state file and copies the current file to the newest
+// one. The file is copied rather than moved, so it stays in place should the save fail.
+func (s *State) backup() error {
+	data, err := os.ReadFile(s.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	name := func(n int) string {
+		if n == 1 {
+			return s.statePath + ".bak"
+		}
+		return fmt.Sprintf("%s.bak.%d", s.statePath, n)
+	}
+	os.Remove(name(backupCount))
+	for n := backupCount - 1; n >= 1; n-- {
+		if err := os.Rename(name(n), name(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.WriteFile(name(1), data, 0644)
+}
+
+// SetCompression sets whether the state file is written gzip-compressed
+func (s *State) SetCompression(compress bool) {
+	s.compress = compress
+}
+
+// isGzip reports whether data starts with the gzip magic bytes
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// gunzip decompresses gzip data
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
 // IsProcessed checks if a file has already been processed
 func (s *State) IsProcessed(filename string) bool {
 	_, exists := s.ProcessedFiles[filename]
@@ -129,10 +402,337 @@ func (s *State) MarkProcessed(filename, profileUsed, outputPath string) {
 		Filename:    filename,
 		ProcessedAt: time.Now(),
 		ProfileUsed: profileUsed,
+		OutputPath:  outputPath,
+		Phase:       PhaseProcessed,
 	}
+	delete(s.FailedFiles, filename)
 	s.LastRun = time.Now()
 }
 
+// RecordSource stores where a processed file came from on the card, so its output can be
+// uploaded with the same album routing after the card has been removed
+func (s *State) RecordSource(filename, sourceDir string, sourceModTime int64) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.SourceDir = sourceDir
+		pf.SourceModTime = sourceModTime
+		s.ProcessedFiles[filename] = pf
+	}
+}
+
+// RecordRating stores the star rating of a processed file's source
+func (s *State) RecordRating(filename string, rating int) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.SourceRating = rating
+		s.ProcessedFiles[filename] = pf
+	}
+}
+
+// MarkOutputKept records that a processed file's output existed before processing, so
+// cleanup after upload leaves it alone
+func (s *State) MarkOutputKept(filename string) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.KeptOutput = true
+		pf.Phase = phaseOf(pf)
+		s.ProcessedFiles[filename] = pf
+	}
+}
+
+// RecordOutputChecksum stores the checksum of a processed file's output
+func (s *State) RecordOutputChecksum(filename, checksum string) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.OutputSHA256 = checksum
+		s.ProcessedFiles[filename] = pf
+	}
+}
+
+// MarkUploaded marks a processed file's output as uploaded
+func (s *State) MarkUploaded(filename string) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.Uploaded = true
+		pf.Phase = phaseOf(pf)
+		s.ProcessedFiles[filename] = pf
+		delete(s.FailedFiles, filename)
+	}
+}
+
+// MarkNotUploaded marks a processed file's output as waiting for upload again, e.g. when
+// the server doesn't have it after all
+func (s *State) MarkNotUploaded(filename string) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.Uploaded = false
+		pf.Phase = PhaseProcessed
+		s.ProcessedFiles[filename] = pf
+	}
+}
+
+// ClearOutputPath forgets the output path of a processed file once the output was deleted
+func (s *State) ClearOutputPath(filename string) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.OutputPath = ""
+		pf.OutputSHA256 = ""
+		pf.Phase = phaseOf(pf)
+		s.ProcessedFiles[filename] = pf
+	}
+}
+
+// GetPendingUploads returns processed files whose output hasn't been uploaded yet
+func (s *State) GetPendingUploads() []ProcessedFile {
+	var pending []ProcessedFile
+	for _, pf := range s.ProcessedFiles {
+		if !pf.Uploaded && pf.OutputPath != "" {
+			pending = append(pending, pf)
+		}
+	}
+	return pending
+}
+
+// GetPendingCleanup returns the uploaded files whose output is still on disk and may be deleted
+func (s *State) GetPendingCleanup() []ProcessedFile {
+	var pending []ProcessedFile
+	for _, pf := range s.ProcessedFiles {
+		if pf.Phase == PhaseUploaded {
+			pending = append(pending, pf)
+		}
+	}
+	return pending
+}
+
+// PhaseCounts returns the number of processed files in each phase
+func (s *State) PhaseCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, pf := range s.ProcessedFiles {
+		counts[pf.Phase]++
+	}
+	return counts
+}
+
+// PruneMissingOutputs finds processed files whose recorded output no longer exists on disk
+// Entries still waiting for upload are removed, so the file is processed again on the next
+// run; uploaded entries only forget the output path. With dryRun nothing is changed.
+func (s *State) PruneMissingOutputs(dryRun bool) []ProcessedFile {
+	var missing []ProcessedFile
+	for name, pf := range s.ProcessedFiles {
+		if pf.OutputPath == "" {
+			continue
+		}
+		if _, err := os.Stat(pf.OutputPath); !os.IsNotExist(err) {
+			continue
+		}
+
+		missing = append(missing, pf)
+		if dryRun {
+			continue
+		}
+		if pf.Uploaded {
+			pf.OutputPath = ""
+			pf.OutputSHA256 = ""
+			pf.Phase = PhaseCleaned
+			s.ProcessedFiles[name] = pf
+		} else {
+			delete(s.ProcessedFiles, name)
+		}
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Filename < missing[j].Filename
+	})
+	return missing
+}
+
+// Output verification results
+const (
+	OutputOK         = "ok"
+	OutputChanged    = "changed"
+	OutputMissing    = "missing"
+	OutputUnverified = "no checksum" // Output recorded before checksums were stored
+)
+
+// OutputCheck is the result of verifying a kept output against its recorded checksum
+type OutputCheck struct {
+	File   ProcessedFile
+	Status string
+	Err    error // Set when the output exists but couldn't be read
+}
+
+// VerifyOutputs re-checksums every recorded output on disk and compares it with the
+// checksum stored when it was written
+func (s *State) VerifyOutputs() []OutputCheck {
+	var checks []OutputCheck
+	for _, pf := range s.ProcessedFiles {
+		if pf.OutputPath == "" {
+			continue
+		}
+
+		check := OutputCheck{File: pf, Status: OutputOK}
+		sum, err := ChecksumFile(pf.OutputPath)
+		switch {
+		case os.IsNotExist(err):
+			check.Status = OutputMissing
+		case err != nil:
+			check.Status = OutputChanged
+			check.Err = err
+		case pf.OutputSHA256 == "":
+			check.Status = OutputUnverified
+		case sum != pf.OutputSHA256:
+			check.Status = OutputChanged
+		}
+		checks = append(checks, check)
+	}
+
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].File.Filename < checks[j].File.Filename
+	})
+	return checks
+}
+
+// ChecksumFile returns the hex-encoded SHA-256 of a file
+func ChecksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// MarkFailed records a failed processing or upload attempt for a file
+func (s *State) MarkFailed(filename, stage string, err error) {
+	failed := s.FailedFiles[filename]
+	failed.Filename = filename
+	failed.Stage = stage
+	failed.Error = err.Error()
+	failed.FailedAt = time.Now()
+	failed.Attempts++
+	s.FailedFiles[filename] = failed
+}
+
+// UpdateWatermark raises the card's watermark to include a synced file
+func (s *State) UpdateWatermark(cardID string, modTime int64, sequence int) {
+	if cardID == "" {
+		return
+	}
+	wm := s.Watermarks[cardID]
+	if modTime > wm.MaxModTime {
+		wm.MaxModTime = modTime
+	}
+	if sequence > wm.MaxSequence {
+		wm.MaxSequence = sequence
+	}
+	wm.UpdatedAt = time.Now()
+	s.Watermarks[cardID] = wm
+}
+
+// SetBookmark records the last file of a chunk processed from a card ("" removes the bookmark)
+func (s *State) SetBookmark(cardID, file string) {
+	if cardID == "" {
+		return
+	}
+	if file == "" {
+		delete(s.Bookmarks, cardID)
+		return
+	}
+	if s.Bookmarks == nil {
+		s.Bookmarks = make(map[string]string)
+	}
+	s.Bookmarks[cardID] = file
+}
+
+// GetBookmark returns the last file of the chunks processed from a card ("" if none)
+func (s *State) GetBookmark(cardID string) string {
+	return s.Bookmarks[cardID]
+}
+
+// GetWatermark returns the watermark recorded for a card
+func (s *State) GetWatermark(cardID string) (CardWatermark, bool) {
+	wm, ok := s.Watermarks[cardID]
+	return wm, ok
+}
+
+// GetFailedFiles returns the files whose last attempt failed
+func (s *State) GetFailedFiles() []FailedFile {
+	failed := make([]FailedFile, 0, len(s.FailedFiles))
+	for _, f := range s.FailedFiles {
+		failed = append(failed, f)
+	}
+	return failed
+}
+
+// RecordProcessingTime stores the processing time of a file and updates the rolling average
+// processing time with it
+func (s *State) RecordProcessingTime(filename string, elapsed time.Duration) {
+	if pf, ok := s.ProcessedFiles[filename]; ok {
+		pf.ProcessingSeconds = elapsed.Seconds()
+		s.ProcessedFiles[filename] = pf
+
+		if s.ProfileTimings == nil {
+			s.ProfileTimings = make(map[string]ProfileTiming)
+		}
+		timing := s.ProfileTimings[pf.ProfileUsed]
+		timing.Files++
+		timing.TotalSeconds += elapsed.Seconds()
+		if elapsed.Seconds() > timing.MaxSeconds {
+			timing.MaxSeconds = elapsed.Seconds()
+			timing.MaxFile = filename
+		}
+		s.ProfileTimings[pf.ProfileUsed] = timing
+	}
+
+	// Exponential moving average: recent runs weigh more, so hardware or profile
+	// changes are reflected after a few files
+	const weight = 0.1
+
+	seconds := elapsed.Seconds()
+	if s.AvgProcessingSeconds <= 0 {
+		s.AvgProcessingSeconds = seconds
+		return
+	}
+	s.AvgProcessingSeconds = s.AvgProcessingSeconds*(1-weight) + seconds*weight
+}
+
+// GetAverageProcessingTime returns the rolling average processing time (0 if unknown)
+func (s *State) GetAverageProcessingTime() time.Duration {
+	return time.Duration(s.AvgProcessingSeconds * float64(time.Second))
+}
+
+// RecordOutputSize updates the rolling average output/RAW size ratio of an extension
+func (s *State) RecordOutputSize(ext string, rawSize, outputSize int64) {
+	if rawSize <= 0 || outputSize <= 0 {
+		return
+	}
+	if s.OutputSizeRatios == nil {
+		s.OutputSizeRatios = make(map[string]float64)
+	}
+
+	const weight = 0.1
+
+	ratio := float64(outputSize) / float64(rawSize)
+	if avg, ok := s.OutputSizeRatios[ext]; ok {
+		ratio = avg*(1-weight) + ratio*weight
+	}
+	s.OutputSizeRatios[ext] = ratio
+}
+
+// EstimateOutputSize estimates the output size of a RAW file from the ratios recorded for
+// its extension, or for all extensions if there are none yet; ok is false without any data
+func (s *State) EstimateOutputSize(ext string, rawSize int64) (size int64, ok bool) {
+	ratio, ok := s.OutputSizeRatios[ext]
+	if !ok {
+		if len(s.OutputSizeRatios) == 0 {
+			return 0, false
+		}
+		for _, r := range s.OutputSizeRatios {
+			ratio += r
+		}
+		ratio /= float64(len(s.OutputSizeRatios))
+	}
+	return int64(float64(rawSize) * ratio), true
+}
+
 // GetProcessedFilesMap returns a map for quick lookup of processed files
 func (s *State) GetProcessedFilesMap() map[string]bool {
 	result := make(map[string]bool)
@@ -149,14 +749,24 @@ func (s *State) GetProcessedCount() int {
 
 // SyncWithCard removes entries for files no longer on the card
 // This keeps the state file clean and prevents stale entries
+// Entries whose output is still waiting to be uploaded are kept
 func (s *State) SyncWithCard(filesOnCard map[string]bool) int {
 	removed := 0
-	for filename := range s.ProcessedFiles {
+	for filename, pf := range s.ProcessedFiles {
+		// Keep outputs waiting for upload, they no longer need the card
+		if !pf.Uploaded && pf.OutputPath != "" {
+			continue
+		}
 		if !filesOnCard[filename] {
 			delete(s.ProcessedFiles, filename)
 			removed++
 		}
 	}
+	for filename := range s.FailedFiles {
+		if !filesOnCard[filename] {
+			delete(s.FailedFiles, filename)
+		}
+	}
 	return removed
 }
 
@@ -169,6 +779,8 @@ func (s *State) SetCardID(id string) {
 func (s *State) Clear() int {
 	count := len(s.ProcessedFiles)
 	s.ProcessedFiles = make(map[string]ProcessedFile)
+	s.FailedFiles = make(map[string]FailedFile)
+	s.Bookmarks = nil
 	s.CardID = ""
 	s.LastRun = time.Time{}
 	return count
@@ -177,6 +789,8 @@ func (s *State) Clear() int {
 // Stats returns statistics about the state
 type Stats struct {
 	ProcessedCount int
+	PendingUploads int
+	FailedCount    int
 	LastRun        time.Time
 	CardID         string
 	FileSizeBytes  int64
@@ -186,6 +800,8 @@ type Stats struct {
 func (s *State) GetStats() Stats {
 	stats := Stats{
 		ProcessedCount: len(s.ProcessedFiles),
+		PendingUploads: len(s.GetPendingUploads()),
+		FailedCount:    len(s.FailedFiles),
 		LastRun:        s.LastRun,
 		CardID:         s.CardID,
 	}
@@ -0,0 +1,25 @@
+package sysload
+
+// Usage is a snapshot of how busy the system is
+type Usage struct {
+	CPUPercent    float64 // CPU in use across all cores (on macOS, the 1-minute load average per core)
+	MemoryPercent float64 // Physical memory in use
+}
+
+// Monitor samples the system usage; CPU usage is measured between consecutive samples
+type Monitor struct {
+	prev cpuTimes
+}
+
+// NewMonitor creates a monitor and takes its first CPU sample
+func NewMonitor() *Monitor {
+	m := &Monitor{}
+	m.prev, _ = readCPUTimes()
+	return m
+}
+
+// Sample returns the current system usage
+// Implementation is in platform-specific files (sysload_windows.go, sysload_darwin.go)
+func (m *Monitor) Sample() (Usage, error) {
+	return m.sampleImpl()
+}
@@ -0,0 +1,49 @@
+//go:build darwin
+
+package sysload
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuTimes is unused on macOS, where CPU usage comes from the load average
+type cpuTimes struct{}
+
+// readCPUTimes is a no-op on macOS
+func readCPUTimes() (cpuTimes, error) {
+	return cpuTimes{}, nil
+}
+
+// sampleImpl reads the 1-minute load average and the memory pressure level
+// The syscall package can't read the binary vm.loadavg struct, so sysctl is used for it.
+func (m *Monitor) sampleImpl() (Usage, error) {
+	var usage Usage
+
+	output, err := exec.Command("sysctl", "-n", "vm.loadavg").Output()
+	if err != nil {
+		return usage, fmt.Errorf("failed to read load average: %v", err)
+	}
+	fields := strings.Fields(strings.Trim(strings.TrimSpace(string(output)), "{}"))
+	if len(fields) == 0 {
+		return usage, fmt.Errorf("unexpected load average %q", string(output))
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return usage, fmt.Errorf("unexpected load average %q", string(output))
+	}
+	usage.CPUPercent = min(100, 100*load/float64(runtime.NumCPU()))
+
+	// kern.memorystatus_level is the percentage of memory available
+	level, err := syscall.SysctlUint32("kern.memorystatus_level")
+	if err != nil {
+		return usage, fmt.Errorf("failed to read memory pressure: %v", err)
+	}
+	usage.MemoryPercent = 100 - float64(level)
+
+	return usage, nil
+}
@@ -0,0 +1,74 @@
+//go:build windows
+
+package sysload
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32             = syscall.NewLazyDLL("kernel32.dll")
+	getSystemTimes       = kernel32.NewProc("GetSystemTimes")
+	globalMemoryStatusEx = kernel32.NewProc("GlobalMemoryStatusEx")
+)
+
+// memoryStatusEx is MEMORYSTATUSEX from <sysinfoapi.h>
+type memoryStatusEx struct {
+	length               uint32
+	memoryLoad           uint32
+	totalPhys            uint64
+	availPhys            uint64
+	totalPageFile        uint64
+	availPageFile        uint64
+	totalVirtual         uint64
+	availVirtual         uint64
+	availExtendedVirtual uint64
+}
+
+// cpuTimes are the system-wide idle and busy times in 100ns units
+type cpuTimes struct {
+	idle, total uint64
+}
+
+// readCPUTimes reads the system times; kernel time includes the idle time
+func readCPUTimes() (cpuTimes, error) {
+	var idle, kernel, user syscall.Filetime
+	ret, _, err := getSystemTimes.Call(
+		uintptr(unsafe.Pointer(&idle)),
+		uintptr(unsafe.Pointer(&kernel)),
+		uintptr(unsafe.Pointer(&user)),
+	)
+	if ret == 0 {
+		return cpuTimes{}, fmt.Errorf("GetSystemTimes failed: %v", err)
+	}
+
+	ticks := func(ft syscall.Filetime) uint64 {
+		return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+	}
+	return cpuTimes{idle: ticks(idle), total: ticks(kernel) + ticks(user)}, nil
+}
+
+// sampleImpl measures CPU usage since the previous sample and reads the memory load
+func (m *Monitor) sampleImpl() (Usage, error) {
+	var usage Usage
+
+	times, err := readCPUTimes()
+	if err != nil {
+		return usage, err
+	}
+	if total := times.total - m.prev.total; total > 0 {
+		usage.CPUPercent = 100 * float64(total-(times.idle-m.prev.idle)) / float64(total)
+	}
+	m.prev = times
+
+	status := memoryStatusEx{length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	ret, _, err := globalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
+		return usage, fmt.Errorf("GlobalMemoryStatusEx failed: %v", err)
+	}
+	usage.MemoryPercent = float64(status.memoryLoad)
+
+	return usage, nil
+}
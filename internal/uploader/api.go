@@ -0,0 +1,331 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// API is a minimal client for the Immich REST API
+// It covers the lookups immich-go doesn't expose; uploads still go through immich-go
+type API struct {
+	serverURL string
+	apiKey    string
+	client    *http.Client
+}
+
+// Asset is the subset of an Immich asset used by this tool
+type Asset struct {
+	ID               string    `json:"id"`
+	OriginalFileName string    `json:"originalFileName"`
+	LocalDateTime    time.Time `json:"localDateTime"` // Capture time as wall clock, in UTC
+}
+
+// NewAPI creates a new Immich API client
+func NewAPI(serverURL, apiKey string) *API {
+	return &API{
+		serverURL: strings.TrimSuffix(serverURL, "/"),
+		apiKey:    apiKey,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				// Same as the --skip-verify-ssl flag passed to immich-go
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+// do sends a request to the Immich API and decodes the JSON response into out (if not nil)
+func (a *API) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, a.serverURL+"/api"+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("x-api-key", a.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s failed: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %v", method, path, err)
+	}
+
+	return nil
+}
+
+// FindAssetsByBaseName returns the assets whose original file name, without extension,
+// matches baseName (case-insensitive). This finds both processed and camera JPGs of a shot.
+func (a *API) FindAssetsByBaseName(baseName string) ([]Asset, error) {
+	request := map[string]interface{}{
+		"originalFileName": baseName,
+		"size":             100,
+	}
+
+	var response struct {
+		Assets struct {
+			Items []Asset `json:"items"`
+		} `json:"assets"`
+	}
+	if err := a.do(http.MethodPost, "/search/metadata", request, &response); err != nil {
+		return nil, err
+	}
+
+	// The server matches substrings, so keep exact base name matches only
+	var matches []Asset
+	for _, asset := range response.Assets.Items {
+		name := strings.TrimSuffix(asset.OriginalFileName, filepath.Ext(asset.OriginalFileName))
+		if strings.EqualFold(name, baseName) {
+			matches = append(matches, asset)
+		}
+	}
+
+	return matches, nil
+}
+
+// checkBatchSize is the number of checksums sent per bulk upload check request
+const checkBatchSize = 500
+
+// ExistingChecksums returns which of the given SHA-1 checksums (hex, keyed by an id of the
+// caller's choosing) belong to an asset on the server; assets in the trash don't count
+func (a *API) ExistingChecksums(checksums map[string]string) (map[string]bool, error) {
+	assetIDs, err := a.AssetIDsByChecksum(checksums)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(assetIDs))
+	for id := range assetIDs {
+		existing[id] = true
+	}
+	return existing, nil
+}
+
+// AssetIDsByChecksum returns the IDs of the server assets with the given SHA-1 checksums
+// (hex, keyed by an id of the caller's choosing); assets in the trash are left out
+func (a *API) AssetIDsByChecksum(checksums map[string]string) (map[string]string, error) {
+	type check struct {
+		ID       string `json:"id"`
+		Checksum string `json:"checksum"`
+	}
+	var checks []check
+	for id, checksum := range checksums {
+		checks = append(checks, check{ID: id, Checksum: checksum})
+	}
+
+	assetIDs := make(map[string]string, len(checks))
+	for start := 0; start < len(checks); start += checkBatchSize {
+		end := start + checkBatchSize
+		if end > len(checks) {
+			end = len(checks)
+		}
+
+		var response struct {
+			Results []struct {
+				ID        string `json:"id"`
+				Action    string `json:"action"`
+				Reason    string `json:"reason"`
+				AssetID   string `json:"assetId"`
+				IsTrashed bool   `json:"isTrashed"`
+			} `json:"results"`
+		}
+		request := map[string]interface{}{"assets": checks[start:end]}
+		if err := a.do(http.MethodPost, "/assets/bulk-upload-check", request, &response); err != nil {
+			return nil, err
+		}
+
+		// The server rejects uploads of files it already has as duplicates of that asset
+		for _, result := range response.Results {
+			if result.Action == "reject" && result.Reason == "duplicate" && !result.IsTrashed {
+				assetIDs[result.ID] = result.AssetID
+			}
+		}
+	}
+
+	return assetIDs, nil
+}
+
+// SHA1File returns the hex SHA-1 checksum of a file, the checksum Immich identifies assets by
+func SHA1File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SetFavorite marks or unmarks the assets as favorites
+func (a *API) SetFavorite(ids []string, favorite bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	request := map[string]interface{}{
+		"ids":        ids,
+		"isFavorite": favorite,
+	}
+	return a.do(http.MethodPut, "/assets", request, nil)
+}
+
+// SetVisibility sets the visibility of the assets ("timeline", "archive", "hidden" or "locked")
+func (a *API) SetVisibility(ids []string, visibility string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	request := map[string]interface{}{
+		"ids":        ids,
+		"visibility": visibility,
+	}
+	err := a.do(http.MethodPut, "/assets", request, nil)
+	if err != nil && (visibility == "archive" || visibility == "timeline") {
+		// Servers before visibility (v1.133) only know the archived flag
+		legacy := map[string]interface{}{
+			"ids":        ids,
+			"isArchived": visibility == "archive",
+		}
+		if legacyErr := a.do(http.MethodPut, "/assets", legacy, nil); legacyErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Tag is the subset of an Immich tag used by this tool
+type Tag struct {
+	ID    string `json:"id"`
+	Value string `json:"value"` // Full name including parents, e.g. "parent/child"
+}
+
+// TagAssets adds a tag to the assets, creating it (and its parents, separated by "/")
+// if it doesn't exist yet
+func (a *API) TagAssets(tag string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var tags []Tag
+	if err := a.do(http.MethodPut, "/tags", map[string][]string{"tags": {tag}}, &tags); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if t.Value == tag {
+			return a.do(http.MethodPut, "/tags/"+t.ID+"/assets", map[string][]string{"ids": ids}, nil)
+		}
+	}
+	return fmt.Errorf("server didn't return tag %s", tag)
+}
+
+// SetDescription sets the description of an asset (its EXIF image description in Immich)
+func (a *API) SetDescription(id, description string) error {
+	return a.do(http.MethodPut, "/assets/"+id, map[string]string{"description": description}, nil)
+}
+
+// Album is the subset of an Immich album used by this tool
+type Album struct {
+	ID         string `json:"id"`
+	AlbumName  string `json:"albumName"`
+	AssetCount int    `json:"assetCount"`
+}
+
+// Albums returns the albums of the API key owner, including the ones shared with them
+func (a *API) Albums() ([]Album, error) {
+	var albums []Album
+	if err := a.do(http.MethodGet, "/albums", nil, &albums); err != nil {
+		return nil, err
+	}
+	return albums, nil
+}
+
+// User is the subset of an Immich user used by this tool
+type User struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// CurrentUser returns the user the API key belongs to
+func (a *API) CurrentUser() (*User, error) {
+	var user User
+	if err := a.do(http.MethodGet, "/users/me", nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindUserByEmail returns the server user with the given email address (case-insensitive)
+func (a *API) FindUserByEmail(email string) (*User, error) {
+	var users []User
+	if err := a.do(http.MethodGet, "/users", nil, &users); err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+	return nil, fmt.Errorf("no user with email %s", email)
+}
+
+// SharePartner shares the API key owner's library with a user as a partner
+// Returns false if the library was already shared with that user.
+func (a *API) SharePartner(userID string) (bool, error) {
+	var partners []User
+	if err := a.do(http.MethodGet, "/partners?direction=shared-by", nil, &partners); err != nil {
+		return false, err
+	}
+	for _, partner := range partners {
+		if partner.ID == userID {
+			return false, nil
+		}
+	}
+
+	// Newer servers take the partner in the body, older ones in the path
+	err := a.do(http.MethodPost, "/partners", map[string]string{"sharedWithId": userID}, nil)
+	if err != nil {
+		if legacyErr := a.do(http.MethodPost, "/partners/"+userID, nil, nil); legacyErr != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -1,27 +1,44 @@
 package uploader
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ohavrylyuk/camera-to-immich/internal/cmdline"
 )
 
 // ImmichConfig contains configuration for Immich uploads
 type ImmichConfig struct {
-	ExecutablePath string   // Path to immich-go executable
-	ServerURL      string   // Immich server URL
-	APIKey         string   // Immich API key
-	Album          string   // Optional album name
-	Tags           []string // Tags to apply to uploads
-	ShowProgress   bool     // Show upload progress (stream immich-go output)
+	ExecutablePath string        // Path to immich-go executable
+	ServerURL      string        // Immich server URL
+	APIKey         string        // Immich API key
+	Album          string        // Optional album name
+	Tags           []string      // Tags to apply to uploads
+	ShowProgress   bool          // Show upload progress (stream immich-go output)
+	ProgressOutput io.Writer     // Where streamed progress goes (default: stdout)
+	LogOutput      io.Writer     // Also receives the full immich-go output of every upload (nil = not saved)
+	Timeout        time.Duration // Kill immich-go when a single upload takes longer than this (0 = no limit)
+	Concurrency    int           // Number of files immich-go uploads in parallel (0 = immich-go default)
+	DeviceUUID     string        // Device ID the assets are recorded as uploaded from (empty = immich-go default, the host name)
 }
 
+// minImmichGoVersion is the first immich-go release with the "upload from-folder" syntax
+var minImmichGoVersion = [3]int{0, 22, 0}
+
 // Immich handles uploading files to Immich server
 type Immich struct {
-	config ImmichConfig
+	config  ImmichConfig
+	version string // Detected immich-go version ("" if unknown)
 }
 
 // NewImmich creates a new Immich uploader
@@ -43,8 +60,68 @@ func NewImmich(config ImmichConfig) (*Immich, error) {
 	if config.APIKey == "" {
 		return nil, fmt.Errorf("immich API key is required")
 	}
+	if config.ProgressOutput == nil {
+		config.ProgressOutput = os.Stdout
+	}
+
+	// The argument syntax used below only works with recent immich-go versions
+	version := detectImmichGoVersion(config.ExecutablePath)
+	if parsed, ok := parseVersion(version); ok && compareVersions(parsed, minImmichGoVersion) < 0 {
+		return nil, fmt.Errorf("immich-go %s is too old: version %d.%d.%d or newer is required (upgrade with: go install github.com/simulot/immich-go@latest)",
+			version, minImmichGoVersion[0], minImmichGoVersion[1], minImmichGoVersion[2])
+	}
+
+	return &Immich{config: config, version: version}, nil
+}
+
+// Version returns the detected immich-go version, or "" if it couldn't be determined
+func (im *Immich) Version() string {
+	return im.version
+}
+
+// versionPattern matches a semantic version anywhere in a string
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// detectImmichGoVersion runs "immich-go --version" and extracts the version number
+func detectImmichGoVersion(executablePath string) string {
+	// Old releases exit non-zero on unknown flags but still print their version,
+	// so the output is parsed regardless of the exit code
+	output, _ := exec.Command(executablePath, "--version").CombinedOutput()
+	return versionPattern.FindString(string(output))
+}
+
+// parseVersion splits a "major.minor.patch" version string
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	match := versionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return parsed, false
+	}
+	for i := 0; i < 3; i++ {
+		parsed[i], _ = strconv.Atoi(match[i+1])
+	}
+	return parsed, true
+}
+
+// compareVersions returns -1, 0 or 1 if a is older than, equal to or newer than b
+func compareVersions(a, b [3]int) int {
+	for i := 0; i < 3; i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
 
-	return &Immich{config: config}, nil
+// WithAlbum returns a copy of the uploader that uploads into the given album
+// An empty album name uploads without adding the assets to any album
+func (im *Immich) WithAlbum(album string) *Immich {
+	config := im.config
+	config.Album = album
+	return &Immich{config: config, version: im.version}
 }
 
 // UploadResult contains the result of an upload operation
@@ -130,11 +207,17 @@ func (im *Immich) uploadDirectory(dirPath string, additionalTags []string, recur
 		args = append(args, "--no-ui")
 	}
 
-	// Add recursive flag
-	if !recursive {
-		args = append(args, "--recursive=false")
+	if im.config.Concurrency > 0 {
+		args = append(args, "--concurrent-tasks", strconv.Itoa(im.config.Concurrency))
 	}
 
+	if im.config.DeviceUUID != "" {
+		args = append(args, "--device-uuid", im.config.DeviceUUID)
+	}
+
+	// Always pass the recursive flag, as its default has changed between immich-go versions
+	args = append(args, "--recursive="+strconv.FormatBool(recursive))
+
 	// Combine configured tags with additional tags
 	allTags := append(im.config.Tags, additionalTags...)
 	for _, tag := range allTags {
@@ -149,28 +232,74 @@ func (im *Immich) uploadDirectory(dirPath string, additionalTags []string, recur
 	// Add the folder path
 	args = append(args, dirPath)
 
-	// Execute immich-go
-	cmd := exec.Command(im.config.ExecutablePath, args...)
+	// Tags can't be split over several calls, so a command line over the OS limit is an error
+	if !cmdline.Fits(im.config.ExecutablePath, args) {
+		return fmt.Errorf("immich-go command line is too long (%d characters, the limit is %d): use fewer or shorter tags", cmdline.Length(im.config.ExecutablePath, args), cmdline.MaxLength())
+	}
+
+	// Execute immich-go, killing it if it hangs (e.g. on a stuck connection)
+	ctx := context.Background()
+	if im.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, im.config.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, im.config.ExecutablePath, args...)
+	cmd.WaitDelay = 5 * time.Second // Don't wait forever for output of orphaned child processes
+
+	if im.config.LogOutput != nil {
+		// The API key is left out of the log
+		fmt.Fprintf(im.config.LogOutput, "=== %s upload of %s (album: %q, tags: %s)\n",
+			time.Now().Format("2006-01-02 15:04:05"), dirPath, im.config.Album, strings.Join(allTags, ", "))
+	}
 	
 	if im.config.ShowProgress {
 		// Stream output to console in real-time for progress display
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = im.config.ProgressOutput
 		cmd.Stderr = os.Stderr
+		if im.config.LogOutput != nil {
+			cmd.Stdout = io.MultiWriter(cmd.Stdout, im.config.LogOutput)
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, im.config.LogOutput)
+		}
 		err := cmd.Run()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", im.config.Timeout)
+		}
 		if err != nil {
+			im.logResult(err)
 			return fmt.Errorf("immich-go upload failed: %v", err)
 		}
 	} else {
 		// Capture output (no progress display)
 		output, err := cmd.CombinedOutput()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", im.config.Timeout)
+		}
+		if im.config.LogOutput != nil {
+			im.config.LogOutput.Write(output)
+		}
 		if err != nil {
+			im.logResult(err)
 			return fmt.Errorf("immich-go upload failed: %v\nOutput: %s", err, string(output))
 		}
 	}
 
+	im.logResult(nil)
 	return nil
 }
 
+// logResult records the outcome of an upload in the upload log (if enabled)
+func (im *Immich) logResult(err error) {
+	if im.config.LogOutput == nil {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(im.config.LogOutput, "=== Failed: %v\n\n", err)
+	} else {
+		fmt.Fprintf(im.config.LogOutput, "=== Done\n\n")
+	}
+}
+
 // copyFile copies a file from src to dst
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)